@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"time"
+	"whapp-irc/ircconnection"
+	"whapp-irc/util"
+	"whapp-irc/whapp"
+)
+
+// statusTag is the message tag carrying the delivery state of messages sent by
+// the user.
+const statusTag = "+whapp-irc/status"
+
+// ackTrackingPeriod is how long the delivery state of messages sent by the user
+// is tracked after they have been sent.
+const ackTrackingPeriod = 24 * time.Hour
+
+// ackStatus returns the value of the status tag for the given acknowledgement
+// state.
+func ackStatus(ack int) string {
+	switch {
+	case ack <= whapp.AckError:
+		return "error"
+	case ack == whapp.AckPending:
+		return "pending"
+	case ack == whapp.AckSent:
+		return "sent"
+	case ack == whapp.AckDelivered:
+		return "delivered"
+	case ack == whapp.AckRead:
+		return "read"
+	default:
+		return "played"
+	}
+}
+
+// listenForAcks sends the delivery state of messages sent by the user to the
+// clients that negotiated message-tags whenever it changes, until the given
+// context is done.
+func (conn *Connection) listenForAcks(ctx context.Context) {
+	resCh, errCh := conn.WI.ListenForAckChange(ctx, 5*time.Second, ackTrackingPeriod)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case err := <-errCh:
+			util.LogIfErr("error while listening for message acks", err)
+			return
+
+		case ack, ok := <-resCh:
+			if !ok {
+				return
+			}
+
+			err := conn.sendAck(ack)
+			util.LogIfErr("error sending message ack", err)
+		}
+	}
+}
+
+// sendAck sends a TAGMSG carrying the given delivery state, referring to the
+// message by its msgid.
+func (conn *Connection) sendAck(ack whapp.MessageAck) error {
+	item, has := conn.Chats.ByID(ack.ChatID, false)
+	if !has {
+		return nil
+	}
+
+	to := item.Identifier
+	if isQuarantined(item.Chat) {
+		to = unknownChannel.name
+	}
+
+	tags := ircconnection.Tags{
+		"+draft/reply":       ack.ID,
+		"+whapp-irc/chat-id": ack.ChatID.String(),
+		statusTag:            ackStatus(ack.Ack),
+	}
+	return conn.irc.TagMessage(time.Now(), tags, conn.irc.Nick(), to)
+}
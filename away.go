@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"whapp-irc/util"
+)
+
+// maxAboutLength is the maximum length of an about text on WhatsApp.
+const maxAboutLength = 139
+
+// syncAway sets the about text of the user on WhatsApp to the given away
+// message, or restores the about text the user had before going away if the
+// message is empty.
+func (conn *Connection) syncAway(ctx context.Context, message string) error {
+	if conn.observed("updating the about text") {
+		return nil
+	}
+
+	conn.awayMutex.Lock()
+	defer conn.awayMutex.Unlock()
+
+	if message == "" {
+		if conn.aboutBeforeAway == nil {
+			return nil
+		}
+
+		if err := conn.WI.SetAbout(ctx, *conn.aboutBeforeAway); err != nil {
+			return err
+		}
+		conn.aboutBeforeAway = nil
+		return nil
+	}
+
+	// keep the about text from before the user went away, when the away
+	// message is only changed.
+	if conn.aboutBeforeAway == nil {
+		about, err := conn.WI.GetAbout(ctx)
+		if err != nil {
+			return err
+		}
+		conn.aboutBeforeAway = &about
+	}
+
+	// leave room for the ellipsis added when truncating.
+	return conn.WI.SetAbout(ctx, util.Truncate(message, maxAboutLength-1))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"whapp-irc/ircconnection"
+	"whapp-irc/whapp"
+)
+
+// setBlocked blocks or unblocks the contact with the given nick on WhatsApp,
+// and reports the result to the given client.
+func (conn *Connection) setBlocked(ctx context.Context, client *ircconnection.Connection, nick string, blocked bool) error {
+	action := "block"
+	if !blocked {
+		action = "unblock"
+	}
+
+	item, has := conn.privateChatByNick(nick)
+	if !has {
+		return client.Status("unknown contact: " + nick)
+	}
+	nick = contactNick(item)
+
+	if conn.observed(fmt.Sprintf("%sing %s", action, nick)) {
+		return nil
+	}
+
+	if err := item.Chat.RawChat.Contact.SetBlocked(ctx, conn.WI, blocked); err != nil {
+		str := fmt.Sprintf("error while %sing %s: %s", action, nick, err)
+		log.Println(str)
+		return client.Status(str)
+	}
+
+	return client.Status(fmt.Sprintf("%sed %s", action, nick))
+}
+
+// listBlocked sends the contacts blocked by the user to the given client.
+func (conn *Connection) listBlocked(ctx context.Context, client *ircconnection.Connection) error {
+	contacts, err := conn.WI.GetBlockedContacts(ctx)
+	if err != nil {
+		str := fmt.Sprintf("error while retrieving blocked contacts: %s", err)
+		log.Println(str)
+		return client.Status(str)
+	} else if len(contacts) == 0 {
+		return client.Status("no blocked contacts")
+	}
+
+	lines := []string{"-- blocked contacts --"}
+	for _, contact := range contacts {
+		name := contact.GetName()
+		if item, has := conn.Chats.ByID(contact.ID, false); has {
+			name = contactNick(item)
+		} else if name == "" {
+			name = contact.ID.User
+		}
+		lines = append(lines, name)
+	}
+	return client.StatusList(lines)
+}
+
+// isBlocked returns whether or not the contact with the given ID is blocked by
+// the user.
+func (conn *Connection) isBlocked(ctx context.Context, id whapp.ID) bool {
+	contacts, err := conn.WI.GetBlockedContacts(ctx)
+	if err != nil {
+		log.Printf("error while retrieving blocked contacts: %s\n", err)
+		return false
+	}
+
+	for _, contact := range contacts {
+		if contact.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+	"whapp-irc/whapp"
+)
+
+// maxCoalescedMessages is the maximum amount of messages coalesced into one.
+const maxCoalescedMessages = 10
+
+// coalescedMessage contains the messages of a sender in a chat waiting for
+// more messages of the same sender to be coalesced with.
+type coalescedMessage struct {
+	messages []Message
+	timer    *time.Timer
+}
+
+// last returns the newest coalesced message.
+func (c *coalescedMessage) last() Message {
+	return c.messages[len(c.messages)-1]
+}
+
+// coalescable returns whether or not the given message can be coalesced with
+// other messages, which is the case for single line messages without a quote
+// that aren't a translation.
+func coalescable(msg Message) bool {
+	return !msg.IsReply &&
+		!msg.IsTranslation &&
+		msg.Message.QuotedMessage == nil &&
+		!strings.Contains(msg.Body, "\n")
+}
+
+// newMessageHandler returns the handler for new messages, which coalesces and
+// schedules them if configured.
+func newMessageHandler() MessageHandler {
+	if conf.CoalesceWindow > 0 {
+		return handlerCoalesce
+	} else if conf.MaxLineRate > 0 {
+		return handlerScheduled
+	}
+	return handlerNormal
+}
+
+// handlerCoalesce is a message handler that holds back messages for
+// conf.CoalesceWindow, and coalesces consecutive messages of the same sender
+// in a chat arriving within that window, so that they're sent together.  Every
+// message keeps its own line and msgid.  Messages of another sender in the
+// same chat flush the held back messages first, so that messages are never
+// reordered.
+var handlerCoalesce = func(conn *Connection, msg Message) error {
+	chatID := msg.Message.Chat.ID
+
+	conn.coalesceMutex.Lock()
+	defer conn.coalesceMutex.Unlock()
+
+	if conn.coalesced == nil {
+		conn.coalesced = make(map[whapp.ID]*coalescedMessage)
+	}
+
+	pending, has := conn.coalesced[chatID]
+	if has && coalescable(msg) && pending.last().From == msg.From && pending.last().To == msg.To {
+		pending.messages = append(pending.messages, msg)
+		if len(pending.messages) >= maxCoalescedMessages {
+			return conn.flushCoalesced(chatID)
+		}
+
+		pending.timer.Reset(conf.CoalesceWindow)
+		return nil
+	}
+
+	if has {
+		if err := conn.flushCoalesced(chatID); err != nil {
+			return err
+		}
+	}
+
+	if !coalescable(msg) {
+		return conn.deliver(msg)
+	}
+
+	pending = &coalescedMessage{
+		messages: []Message{msg},
+	}
+	pending.timer = time.AfterFunc(conf.CoalesceWindow, func() {
+		conn.coalesceMutex.Lock()
+		defer conn.coalesceMutex.Unlock()
+
+		// the messages may have been flushed already by a newer message.
+		if conn.coalesced[chatID] != pending {
+			return
+		}
+		if err := conn.flushCoalesced(chatID); err != nil {
+			log.Printf("error while sending coalesced messages: %s\n", err)
+		}
+	})
+	conn.coalesced[chatID] = pending
+	return nil
+}
+
+// flushCoalesced sends the held back messages of the chat with the given ID.
+// conn.coalesceMutex has to be held.
+func (conn *Connection) flushCoalesced(chatID whapp.ID) error {
+	pending, has := conn.coalesced[chatID]
+	if !has {
+		return nil
+	}
+	delete(conn.coalesced, chatID)
+	pending.timer.Stop()
+
+	for _, msg := range pending.messages {
+		if err := conn.deliver(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushAllCoalesced sends all held back messages.
+func (conn *Connection) flushAllCoalesced() {
+	conn.coalesceMutex.Lock()
+	defer conn.coalesceMutex.Unlock()
+
+	for chatID := range conn.coalesced {
+		if err := conn.flushCoalesced(chatID); err != nil {
+			log.Printf("error while sending coalesced messages: %s\n", err)
+		}
+	}
+}
@@ -1,10 +1,15 @@
 package config
 
 import (
+	"encoding/hex"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"time"
+	"whapp-irc/formatting"
+	"whapp-irc/ircconnection"
 	"whapp-irc/maps"
 	"whapp-irc/whapp"
 )
@@ -14,16 +19,148 @@ type Config struct {
 	FileServerHost  string
 	FileServerPort  string
 	FileServerHTTPS bool
+	FileServerKey   []byte
 
-	IRCPort string
+	FileServerHealthInterval time.Duration
+
+	IRCListenAddresses []string
+	MaxConnections     int
+	TCPKeepAlive       time.Duration
+
+	// IRCTLSCert and IRCTLSKey are the paths of the certificate and key IRC
+	// connections are served over TLS with, TLS is disabled if they're empty.
+	IRCTLSCert string
+	IRCTLSKey  string
+	// SASLExternal maps the SHA-256 fingerprints of TLS client certificates,
+	// in lowercase hex, to the account their clients authenticate as using
+	// SASL EXTERNAL.
+	SASLExternal map[string]string
 
 	LogLevel whapp.LoggingLevel
 
 	MapProvider maps.Provider
 
+	NickMode ircconnection.NickMode
+
+	StatusNick string
+
+	ContactNickPrefix string
+	ContactNickSuffix string
+
+	PrivateChannels bool
+	IDSuffixes      bool
+
+	ServerTimeFormat string
+
+	MaxListedParticipants int
+
+	SnippetLength   int
+	SnippetEllipsis string
+
+	NotifyUnhandledMessages bool
+
+	PhoneInSource bool
+
+	ObserverMode bool
+
+	MediaMode       MediaMode
+	MediaThumbnails bool
+
+	CaptionPlacement CaptionPlacement
+
+	Formatting formatting.Mode
+
+	TopicMemberCount bool
+	PartSoleMember   bool
+
+	AwayAbout bool
+
+	Translate         bool
+	TranslateURL      string
+	TranslateLanguage string
+	TranslateTimeout  time.Duration
+
+	WebMessages WebMessagesMode
+
+	EchoOwnGroupMessages bool
+
+	EmojiShortcodes bool
+
+	CoalesceWindow time.Duration
+
+	MaxLineRate int
+
+	QuarantineUnknownSenders bool
+
+	CallsChannel bool
+
+	HighlightsChannel bool
+
+	ReactionSummaries bool
+
+	ReconnectInitialDelay time.Duration
+	ReconnectMaxDelay     time.Duration
+	ReconnectMultiplier   float64
+	ReconnectMaxAttempts  int
+
+	SessionGracePeriod time.Duration
+	SessionBufferSize  int
+
+	ReconnectBufferSize int
+
+	ReplaySinceDuration time.Duration
+	ReplaySinceDate     time.Time
+
 	AlternativeReplay bool
+	ReplayJoinedOnly  bool
+	ReplaySelfNick    string
+
+	ReplayMembershipThreshold time.Duration
 }
 
+// MediaMode is the way media messages are handled.
+type MediaMode int
+
+const (
+	// MediaDownload downloads and hosts media, and sends its URL.
+	MediaDownload MediaMode = iota
+	// MediaLinksOnly never downloads media, and sends a placeholder instead.
+	MediaLinksOnly
+	// MediaOff never downloads media, and only sends its caption, if any.
+	MediaOff
+)
+
+// CaptionPlacement is the place of the caption of media, relative to its URL.
+type CaptionPlacement int
+
+const (
+	// CaptionInline places the caption after the URL, on the same line.
+	CaptionInline CaptionPlacement = iota
+	// CaptionBefore places the caption on the lines before the URL.
+	CaptionBefore
+	// CaptionAfter places the caption on the lines after the URL.
+	CaptionAfter
+)
+
+// WebMessagesMode is the way messages sent by the user from WhatsApp Web are
+// handled.
+type WebMessagesMode int
+
+const (
+	// WebMessagesDrop drops messages sent from WhatsApp Web.
+	WebMessagesDrop WebMessagesMode = iota
+	// WebMessagesEcho sends messages sent from WhatsApp Web only to clients
+	// that negotiated echo-message.
+	WebMessagesEcho
+	// WebMessagesDeliver sends messages sent from WhatsApp Web to every
+	// client, like other messages sent by the user.
+	WebMessagesDeliver
+)
+
+// nickAffixChars contains the characters allowed in nick prefixes and
+// suffixes.
+const nickAffixChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789[]\\`^{}|-"
+
 func getEnvDefault(env, def string) string {
 	res := os.Getenv(env)
 	if res == "" {
@@ -32,22 +169,395 @@ func getEnvDefault(env, def string) string {
 	return res
 }
 
+// ReplayCutoff returns the time before which messages shouldn't be replayed,
+// and whether or not such a cutoff has been configured.
+func (c Config) ReplayCutoff() (cutoff time.Time, set bool) {
+	switch {
+	case c.ReplaySinceDuration > 0:
+		return time.Now().Add(-c.ReplaySinceDuration), true
+	case !c.ReplaySinceDate.IsZero():
+		return c.ReplaySinceDate, true
+	}
+	return time.Time{}, false
+}
+
+// parseReplaySince parses the given REPLAY_SINCE value, which is either a
+// duration relative to the moment of replaying, or an absolute date.
+func parseReplaySince(raw string) (time.Duration, time.Time, error) {
+	if raw == "" {
+		return 0, time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(raw); err == nil {
+		if d <= 0 {
+			return 0, time.Time{}, fmt.Errorf("REPLAY_SINCE has to be positive")
+		}
+		return d, time.Time{}, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, raw); err == nil {
+			return 0, t, nil
+		}
+	}
+
+	return 0, time.Time{}, fmt.Errorf("invalid REPLAY_SINCE %s", raw)
+}
+
+// ParseMapProvider parses the given map provider name, as used by
+// MAP_PROVIDER.
+func ParseMapProvider(raw string) (maps.Provider, error) {
+	switch strings.ToLower(raw) {
+	case "openstreetmap", "open-street-map":
+		return maps.OpenStreetMap, nil
+	case "googlemaps", "google-maps":
+		return maps.GoogleMaps, nil
+	}
+	return 0, fmt.Errorf("no map provider %s found", raw)
+}
+
+// ParseFormatting parses the given message formatting mode name, as used by
+// MESSAGE_FORMATTING.
+func ParseFormatting(raw string) (formatting.Mode, error) {
+	switch strings.ToLower(raw) {
+	case "raw":
+		return formatting.Raw, nil
+	case "strip":
+		return formatting.Strip, nil
+	case "irc":
+		return formatting.IRC, nil
+	}
+	return 0, fmt.Errorf("no message formatting mode %s found", raw)
+}
+
+// checkNickAffix returns an error if the given nick prefix or suffix, set by
+// the given environment variable, contains characters that aren't valid in
+// nicks.  `_` isn't allowed either, since it's used to make identifiers
+// unique.
+func checkNickAffix(env, affix string) error {
+	for _, r := range affix {
+		if !strings.ContainsRune(nickAffixChars, r) {
+			return fmt.Errorf("%s contains invalid character %q", env, r)
+		}
+	}
+	return nil
+}
+
+// checkServerTimeFormat returns an error if the given time format doesn't
+// produce valid IRCv3 server-time values, which are UTC timestamps in the ISO
+// 8601 format.
+func checkServerTimeFormat(format string) error {
+	ref := time.Date(2006, 1, 2, 15, 4, 5, 123000000, time.UTC)
+	str := ref.Format(format)
+
+	t, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil || !strings.HasSuffix(str, "Z") || t.Unix() != ref.Unix() {
+		return fmt.Errorf("invalid server-time format %s", format)
+	}
+	return nil
+}
+
 // ReadEnvVars reads environment variables and returns a Config instance
 // containing the parsed values, or an error.
 func ReadEnvVars() (Config, error) {
 	host := getEnvDefault("HOST", "localhost")
 	fileServerPort := getEnvDefault("FILE_SERVER_PORT", "3000")
 	fileServerUseHTTPS := getEnvDefault("FILE_SERVER_HTTPS", "false")
+	fileServerKeyRaw := getEnvDefault("FILE_SERVER_KEY", "")
+	fileServerHealthRaw := getEnvDefault("FILE_SERVER_HEALTH_CHECK", "1m")
+	observerModeRaw := getEnvDefault("OBSERVER_MODE", "false")
+	mediaModeRaw := getEnvDefault("MEDIA_MODE", "download")
+	mediaThumbnailsRaw := getEnvDefault("MEDIA_THUMBNAILS", "false")
+	captionPlacementRaw := getEnvDefault("MEDIA_CAPTION_PLACEMENT", "inline")
+	topicMemberCountRaw := getEnvDefault("TOPIC_MEMBER_COUNT", "false")
+	soleMemberRaw := getEnvDefault("SOLE_MEMBER_GROUPS", "mark")
+	awayAboutRaw := getEnvDefault("AWAY_ABOUT", "false")
+	translateRaw := getEnvDefault("TRANSLATE", "false")
+	translateURL := getEnvDefault("TRANSLATE_URL", "")
+	translateLanguage := getEnvDefault("TRANSLATE_LANGUAGE", "en")
+	translateTimeoutRaw := getEnvDefault("TRANSLATE_TIMEOUT", "2s")
 	ircPort := getEnvDefault("IRC_SERVER_PORT", "6060")
+	ircListenRaw := getEnvDefault("IRC_LISTEN", ":"+ircPort)
+	maxConnectionsRaw := getEnvDefault("MAX_CONNECTIONS", "0")
+	tcpKeepAliveRaw := getEnvDefault("TCP_KEEPALIVE", "1m")
+	ircTLSCert := getEnvDefault("IRC_TLS_CERT", "")
+	ircTLSKey := getEnvDefault("IRC_TLS_KEY", "")
+	saslExternalRaw := getEnvDefault("SASL_EXTERNAL", "")
 	logLevelRaw := getEnvDefault("LOG_LEVEL", "normal")
 	mapProviderRaw := getEnvDefault("MAP_PROVIDER", "google-maps")
 	replayMode := getEnvDefault("REPLAY_MODE", "normal")
+	replaySinceRaw := getEnvDefault("REPLAY_SINCE", "")
+	replayChatsRaw := getEnvDefault("REPLAY_CHATS", "all")
+	replaySelfNick := getEnvDefault("REPLAY_SELF_NICK", "")
+	replayMembershipThresholdRaw := getEnvDefault("REPLAY_MEMBERSHIP_THRESHOLD", "0s")
+	nickModeRaw := getEnvDefault("NICK_MODE", "ascii")
+	statusNick := getEnvDefault("STATUS_NICK", ircconnection.DefaultStatusNick)
+	contactNickPrefix := getEnvDefault("CONTACT_NICK_PREFIX", "")
+	contactNickSuffix := getEnvDefault("CONTACT_NICK_SUFFIX", "")
+	privateChatsRaw := getEnvDefault("PRIVATE_CHATS", "query")
+	identifierSuffixRaw := getEnvDefault("IDENTIFIER_SUFFIX", "number")
+	maxListedParticipantsRaw := getEnvDefault("MAX_LISTED_PARTICIPANTS", "500")
+	snippetLengthRaw := getEnvDefault("SNIPPET_LENGTH", "50")
+	snippetEllipsis := getEnvDefault("SNIPPET_ELLIPSIS", "…")
+	unhandledMessagesRaw := getEnvDefault("UNHANDLED_MESSAGES", "silent")
+	messageSourceRaw := getEnvDefault("MESSAGE_SOURCE", "nick")
+	formattingRaw := getEnvDefault("MESSAGE_FORMATTING", "raw")
+	webMessagesRaw := getEnvDefault("WEB_MESSAGES", "drop")
+	callLogRaw := getEnvDefault("CALL_LOG", "inline")
+	highlightsRaw := getEnvDefault("HIGHLIGHTS", "status")
+	reactionsRaw := getEnvDefault("REACTIONS", "lines")
+	ownGroupMessagesRaw := getEnvDefault("OWN_GROUP_MESSAGES", "deliver")
+	emojiRaw := getEnvDefault("EMOJI", "unicode")
+	coalesceWindowRaw := getEnvDefault("COALESCE_WINDOW", "0s")
+	maxLineRateRaw := getEnvDefault("MAX_LINE_RATE", "0")
+	unknownSendersRaw := getEnvDefault("UNKNOWN_SENDERS", "query")
+	reconnectInitialDelayRaw := getEnvDefault("RECONNECT_INITIAL_DELAY", "1s")
+	reconnectMaxDelayRaw := getEnvDefault("RECONNECT_MAX_DELAY", "1m")
+	reconnectMultiplierRaw := getEnvDefault("RECONNECT_MULTIPLIER", "2")
+	reconnectMaxAttemptsRaw := getEnvDefault("RECONNECT_MAX_ATTEMPTS", "10")
+	sessionGracePeriodRaw := getEnvDefault("SESSION_GRACE_PERIOD", "0s")
+	sessionBufferSizeRaw := getEnvDefault("SESSION_BUFFER_SIZE", "500")
+	reconnectBufferSizeRaw := getEnvDefault("RECONNECT_BUFFER_SIZE", "20")
+	serverTimeFormat := getEnvDefault(
+		"SERVER_TIME_FORMAT",
+		ircconnection.DefaultTimeFormat,
+	)
 
 	useHTTPS, err := strconv.ParseBool(fileServerUseHTTPS)
 	if err != nil {
 		return Config{}, err
 	}
 
+	var fileServerKey []byte
+	if fileServerKeyRaw != "" {
+		fileServerKey, err = hex.DecodeString(fileServerKeyRaw)
+		if err != nil {
+			return Config{}, err
+		} else if len(fileServerKey) != 32 {
+			err := fmt.Errorf("file server key should be 32 bytes, got %d", len(fileServerKey))
+			return Config{}, err
+		}
+	}
+
+	fileServerHealthInterval, err := time.ParseDuration(fileServerHealthRaw)
+	if err != nil {
+		return Config{}, err
+	} else if fileServerHealthInterval < 0 {
+		err := fmt.Errorf("FILE_SERVER_HEALTH_CHECK can't be negative")
+		return Config{}, err
+	}
+
+	observerMode, err := strconv.ParseBool(observerModeRaw)
+	if err != nil {
+		return Config{}, err
+	}
+
+	mediaThumbnails, err := strconv.ParseBool(mediaThumbnailsRaw)
+	if err != nil {
+		return Config{}, err
+	}
+
+	topicMemberCount, err := strconv.ParseBool(topicMemberCountRaw)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var partSoleMember bool
+	switch strings.ToLower(soleMemberRaw) {
+	case "mark":
+		partSoleMember = false
+	case "part":
+		partSoleMember = true
+
+	default:
+		err := fmt.Errorf("no sole member groups mode %s found", soleMemberRaw)
+		return Config{}, err
+	}
+
+	awayAbout, err := strconv.ParseBool(awayAboutRaw)
+	if err != nil {
+		return Config{}, err
+	}
+
+	translate, err := strconv.ParseBool(translateRaw)
+	if err != nil {
+		return Config{}, err
+	} else if translate && translateURL == "" {
+		err := fmt.Errorf("TRANSLATE_URL has to be set when TRANSLATE is true")
+		return Config{}, err
+	}
+
+	translateTimeout, err := time.ParseDuration(translateTimeoutRaw)
+	if err != nil {
+		return Config{}, err
+	} else if translateTimeout <= 0 {
+		err := fmt.Errorf("TRANSLATE_TIMEOUT has to be positive")
+		return Config{}, err
+	}
+
+	var ircListenAddresses []string
+	for _, addr := range strings.Split(ircListenRaw, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		} else if _, _, err := net.SplitHostPort(addr); err != nil {
+			err := fmt.Errorf("invalid IRC listen address %s: %s", addr, err)
+			return Config{}, err
+		}
+		ircListenAddresses = append(ircListenAddresses, addr)
+	}
+	if len(ircListenAddresses) == 0 {
+		err := fmt.Errorf("IRC_LISTEN can't be empty")
+		return Config{}, err
+	}
+
+	maxConnections, err := strconv.Atoi(maxConnectionsRaw)
+	if err != nil {
+		return Config{}, err
+	} else if maxConnections < 0 {
+		err := fmt.Errorf("MAX_CONNECTIONS can't be negative")
+		return Config{}, err
+	}
+
+	tcpKeepAlive, err := time.ParseDuration(tcpKeepAliveRaw)
+	if err != nil {
+		return Config{}, err
+	} else if tcpKeepAlive < 0 {
+		err := fmt.Errorf("TCP_KEEPALIVE can't be negative")
+		return Config{}, err
+	}
+
+	if (ircTLSCert == "") != (ircTLSKey == "") {
+		err := fmt.Errorf("IRC_TLS_CERT and IRC_TLS_KEY have to be set together")
+		return Config{}, err
+	}
+
+	saslExternal := make(map[string]string)
+	for _, entry := range strings.Split(saslExternalRaw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			err := fmt.Errorf("invalid SASL_EXTERNAL entry %s, expected fingerprint=account", entry)
+			return Config{}, err
+		}
+
+		fingerprint := strings.ToLower(strings.Replace(parts[0], ":", "", -1))
+		if raw, err := hex.DecodeString(fingerprint); err != nil || len(raw) != 32 {
+			err := fmt.Errorf("invalid SHA-256 fingerprint %s in SASL_EXTERNAL", parts[0])
+			return Config{}, err
+		}
+		saslExternal[fingerprint] = parts[1]
+	}
+	if len(saslExternal) > 0 && ircTLSCert == "" {
+		err := fmt.Errorf("SASL_EXTERNAL requires IRC_TLS_CERT and IRC_TLS_KEY to be set")
+		return Config{}, err
+	}
+
+	maxListedParticipants, err := strconv.Atoi(maxListedParticipantsRaw)
+	if err != nil {
+		return Config{}, err
+	} else if maxListedParticipants < 0 {
+		err := fmt.Errorf("MAX_LISTED_PARTICIPANTS can't be negative")
+		return Config{}, err
+	}
+
+	snippetLength, err := strconv.Atoi(snippetLengthRaw)
+	if err != nil {
+		return Config{}, err
+	} else if snippetLength <= 0 {
+		err := fmt.Errorf("SNIPPET_LENGTH should be positive")
+		return Config{}, err
+	}
+
+	reconnectInitialDelay, err := time.ParseDuration(reconnectInitialDelayRaw)
+	if err != nil {
+		return Config{}, err
+	} else if reconnectInitialDelay <= 0 {
+		err := fmt.Errorf("RECONNECT_INITIAL_DELAY has to be positive")
+		return Config{}, err
+	}
+
+	reconnectMaxDelay, err := time.ParseDuration(reconnectMaxDelayRaw)
+	if err != nil {
+		return Config{}, err
+	} else if reconnectMaxDelay < reconnectInitialDelay {
+		err := fmt.Errorf("RECONNECT_MAX_DELAY can't be less than RECONNECT_INITIAL_DELAY")
+		return Config{}, err
+	}
+
+	reconnectMultiplier, err := strconv.ParseFloat(reconnectMultiplierRaw, 64)
+	if err != nil {
+		return Config{}, err
+	} else if reconnectMultiplier < 1 {
+		err := fmt.Errorf("RECONNECT_MULTIPLIER can't be less than 1")
+		return Config{}, err
+	}
+
+	reconnectMaxAttempts, err := strconv.Atoi(reconnectMaxAttemptsRaw)
+	if err != nil {
+		return Config{}, err
+	} else if reconnectMaxAttempts < 0 {
+		err := fmt.Errorf("RECONNECT_MAX_ATTEMPTS can't be negative")
+		return Config{}, err
+	}
+
+	coalesceWindow, err := time.ParseDuration(coalesceWindowRaw)
+	if err != nil {
+		return Config{}, err
+	} else if coalesceWindow < 0 {
+		err := fmt.Errorf("COALESCE_WINDOW can't be negative")
+		return Config{}, err
+	}
+
+	maxLineRate, err := strconv.Atoi(maxLineRateRaw)
+	if err != nil {
+		return Config{}, err
+	} else if maxLineRate < 0 {
+		err := fmt.Errorf("MAX_LINE_RATE can't be negative")
+		return Config{}, err
+	}
+
+	sessionGracePeriod, err := time.ParseDuration(sessionGracePeriodRaw)
+	if err != nil {
+		return Config{}, err
+	} else if sessionGracePeriod < 0 {
+		err := fmt.Errorf("SESSION_GRACE_PERIOD can't be negative")
+		return Config{}, err
+	}
+
+	sessionBufferSize, err := strconv.Atoi(sessionBufferSizeRaw)
+	if err != nil {
+		return Config{}, err
+	} else if sessionBufferSize < 0 {
+		err := fmt.Errorf("SESSION_BUFFER_SIZE can't be negative")
+		return Config{}, err
+	}
+
+	reconnectBufferSize, err := strconv.Atoi(reconnectBufferSizeRaw)
+	if err != nil {
+		return Config{}, err
+	} else if reconnectBufferSize < 0 {
+		err := fmt.Errorf("RECONNECT_BUFFER_SIZE can't be negative")
+		return Config{}, err
+	}
+
+	replaySinceDuration, replaySinceDate, err := parseReplaySince(replaySinceRaw)
+	if err != nil {
+		return Config{}, err
+	}
+
+	replayMembershipThreshold, err := time.ParseDuration(replayMembershipThresholdRaw)
+	if err != nil {
+		return Config{}, err
+	} else if replayMembershipThreshold < 0 {
+		err := fmt.Errorf("REPLAY_MEMBERSHIP_THRESHOLD can't be negative")
+		return Config{}, err
+	}
+
 	var logLevel whapp.LoggingLevel
 	switch strings.ToLower(logLevelRaw) {
 	case "verbose":
@@ -60,15 +570,220 @@ func ReadEnvVars() (Config, error) {
 		return Config{}, err
 	}
 
-	var mapProvider maps.Provider
-	switch strings.ToLower(mapProviderRaw) {
-	case "openstreetmap", "open-street-map":
-		mapProvider = maps.OpenStreetMap
-	case "googlemaps", "google-maps":
-		mapProvider = maps.GoogleMaps
+	mapProvider, err := ParseMapProvider(mapProviderRaw)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var nickMode ircconnection.NickMode
+	switch strings.ToLower(nickModeRaw) {
+	case "ascii":
+		nickMode = ircconnection.NickModeASCII
+	case "unicode":
+		nickMode = ircconnection.NickModeUnicode
+
+	default:
+		err := fmt.Errorf("no nick mode %s found", nickModeRaw)
+		return Config{}, err
+	}
+
+	if err := checkNickAffix("STATUS_NICK", statusNick); err != nil {
+		return Config{}, err
+	} else if strings.EqualFold(statusNick, "whapp-irc") {
+		err := fmt.Errorf("STATUS_NICK can't be whapp-irc")
+		return Config{}, err
+	}
+
+	if err := checkNickAffix("CONTACT_NICK_PREFIX", contactNickPrefix); err != nil {
+		return Config{}, err
+	} else if err := checkNickAffix("CONTACT_NICK_SUFFIX", contactNickSuffix); err != nil {
+		return Config{}, err
+	}
+
+	if err := checkNickAffix("REPLAY_SELF_NICK", replaySelfNick); err != nil {
+		return Config{}, err
+	}
+
+	if err := checkServerTimeFormat(serverTimeFormat); err != nil {
+		return Config{}, err
+	}
+
+	var notifyUnhandledMessages bool
+	switch strings.ToLower(unhandledMessagesRaw) {
+	case "silent":
+		notifyUnhandledMessages = false
+	case "notify":
+		notifyUnhandledMessages = true
+
+	default:
+		err := fmt.Errorf("no unhandled messages mode %s found", unhandledMessagesRaw)
+		return Config{}, err
+	}
+
+	var mediaMode MediaMode
+	switch strings.ToLower(mediaModeRaw) {
+	case "download":
+		mediaMode = MediaDownload
+	case "links-only", "linksonly":
+		mediaMode = MediaLinksOnly
+	case "off":
+		mediaMode = MediaOff
+
+	default:
+		err := fmt.Errorf("no media mode %s found", mediaModeRaw)
+		return Config{}, err
+	}
+
+	var captionPlacement CaptionPlacement
+	switch strings.ToLower(captionPlacementRaw) {
+	case "inline":
+		captionPlacement = CaptionInline
+	case "before":
+		captionPlacement = CaptionBefore
+	case "after":
+		captionPlacement = CaptionAfter
+
+	default:
+		err := fmt.Errorf("no caption placement %s found", captionPlacementRaw)
+		return Config{}, err
+	}
+
+	formattingMode, err := ParseFormatting(formattingRaw)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var webMessages WebMessagesMode
+	switch strings.ToLower(webMessagesRaw) {
+	case "drop":
+		webMessages = WebMessagesDrop
+	case "echo":
+		webMessages = WebMessagesEcho
+	case "deliver":
+		webMessages = WebMessagesDeliver
 
 	default:
-		err := fmt.Errorf("no map provider %s found", mapProviderRaw)
+		err := fmt.Errorf("no web messages mode %s found", webMessagesRaw)
+		return Config{}, err
+	}
+
+	var quarantineUnknownSenders bool
+	switch strings.ToLower(unknownSendersRaw) {
+	case "query":
+		quarantineUnknownSenders = false
+	case "channel":
+		quarantineUnknownSenders = true
+
+	default:
+		err := fmt.Errorf("no unknown senders mode %s found", unknownSendersRaw)
+		return Config{}, err
+	}
+
+	var callsChannel bool
+	switch strings.ToLower(callLogRaw) {
+	case "inline":
+		callsChannel = false
+	case "channel":
+		callsChannel = true
+
+	default:
+		err := fmt.Errorf("no call log mode %s found", callLogRaw)
+		return Config{}, err
+	}
+
+	var highlightsChannel bool
+	switch strings.ToLower(highlightsRaw) {
+	case "status":
+		highlightsChannel = false
+	case "channel":
+		highlightsChannel = true
+
+	default:
+		err := fmt.Errorf("no highlights mode %s found", highlightsRaw)
+		return Config{}, err
+	}
+
+	var privateChannels bool
+	switch strings.ToLower(privateChatsRaw) {
+	case "query":
+		privateChannels = false
+	case "channel":
+		privateChannels = true
+
+	default:
+		err := fmt.Errorf("no private chats mode %s found", privateChatsRaw)
+		return Config{}, err
+	}
+
+	var idSuffixes bool
+	switch strings.ToLower(identifierSuffixRaw) {
+	case "number":
+		idSuffixes = false
+	case "id":
+		idSuffixes = true
+
+	default:
+		err := fmt.Errorf("no identifier suffix mode %s found", identifierSuffixRaw)
+		return Config{}, err
+	}
+
+	var replayJoinedOnly bool
+	switch strings.ToLower(replayChatsRaw) {
+	case "all":
+		replayJoinedOnly = false
+	case "joined":
+		replayJoinedOnly = true
+
+	default:
+		err := fmt.Errorf("no replay chats mode %s found", replayChatsRaw)
+		return Config{}, err
+	}
+
+	var echoOwnGroupMessages bool
+	switch strings.ToLower(ownGroupMessagesRaw) {
+	case "deliver":
+		echoOwnGroupMessages = false
+	case "echo":
+		echoOwnGroupMessages = true
+
+	default:
+		err := fmt.Errorf("no own group messages mode %s found", ownGroupMessagesRaw)
+		return Config{}, err
+	}
+
+	var emojiShortcodes bool
+	switch strings.ToLower(emojiRaw) {
+	case "unicode":
+		emojiShortcodes = false
+	case "shortcodes":
+		emojiShortcodes = true
+
+	default:
+		err := fmt.Errorf("no emoji mode %s found", emojiRaw)
+		return Config{}, err
+	}
+
+	var reactionSummaries bool
+	switch strings.ToLower(reactionsRaw) {
+	case "lines":
+		reactionSummaries = false
+	case "summary":
+		reactionSummaries = true
+
+	default:
+		err := fmt.Errorf("no reactions mode %s found", reactionsRaw)
+		return Config{}, err
+	}
+
+	var phoneInSource bool
+	switch strings.ToLower(messageSourceRaw) {
+	case "nick":
+		phoneInSource = false
+	case "phone":
+		phoneInSource = true
+
+	default:
+		err := fmt.Errorf("no message source format %s found", messageSourceRaw)
 		return Config{}, err
 	}
 
@@ -76,13 +791,97 @@ func ReadEnvVars() (Config, error) {
 		FileServerHost:  host,
 		FileServerPort:  fileServerPort,
 		FileServerHTTPS: useHTTPS,
+		FileServerKey:   fileServerKey,
+
+		FileServerHealthInterval: fileServerHealthInterval,
 
-		IRCPort: ircPort,
+		IRCListenAddresses: ircListenAddresses,
+		MaxConnections:     maxConnections,
+		TCPKeepAlive:       tcpKeepAlive,
+
+		IRCTLSCert:   ircTLSCert,
+		IRCTLSKey:    ircTLSKey,
+		SASLExternal: saslExternal,
 
 		LogLevel: logLevel,
 
 		MapProvider: mapProvider,
 
+		NickMode: nickMode,
+
+		StatusNick: statusNick,
+
+		ContactNickPrefix: contactNickPrefix,
+		ContactNickSuffix: contactNickSuffix,
+
+		PrivateChannels: privateChannels,
+		IDSuffixes:      idSuffixes,
+
+		ServerTimeFormat: serverTimeFormat,
+
+		MaxListedParticipants: maxListedParticipants,
+
+		SnippetLength:   snippetLength,
+		SnippetEllipsis: snippetEllipsis,
+
+		NotifyUnhandledMessages: notifyUnhandledMessages,
+
+		PhoneInSource: phoneInSource,
+
+		ObserverMode: observerMode,
+
+		MediaMode:       mediaMode,
+		MediaThumbnails: mediaThumbnails,
+
+		CaptionPlacement: captionPlacement,
+
+		Formatting: formattingMode,
+
+		TopicMemberCount: topicMemberCount,
+		PartSoleMember:   partSoleMember,
+
+		AwayAbout: awayAbout,
+
+		Translate:         translate,
+		TranslateURL:      translateURL,
+		TranslateLanguage: translateLanguage,
+		TranslateTimeout:  translateTimeout,
+
+		WebMessages: webMessages,
+
+		EchoOwnGroupMessages: echoOwnGroupMessages,
+
+		EmojiShortcodes: emojiShortcodes,
+
+		CoalesceWindow: coalesceWindow,
+
+		MaxLineRate: maxLineRate,
+
+		QuarantineUnknownSenders: quarantineUnknownSenders,
+
+		CallsChannel: callsChannel,
+
+		HighlightsChannel: highlightsChannel,
+
+		ReactionSummaries: reactionSummaries,
+
+		ReconnectInitialDelay: reconnectInitialDelay,
+		ReconnectMaxDelay:     reconnectMaxDelay,
+		ReconnectMultiplier:   reconnectMultiplier,
+		ReconnectMaxAttempts:  reconnectMaxAttempts,
+
+		SessionGracePeriod: sessionGracePeriod,
+		SessionBufferSize:  sessionBufferSize,
+
+		ReconnectBufferSize: reconnectBufferSize,
+
+		ReplaySinceDuration: replaySinceDuration,
+		ReplaySinceDate:     replaySinceDate,
+
 		AlternativeReplay: replayMode == "alternative",
+		ReplayJoinedOnly:  replayJoinedOnly,
+		ReplaySelfNick:    replaySelfNick,
+
+		ReplayMembershipThreshold: replayMembershipThreshold,
 	}, nil
 }
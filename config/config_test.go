@@ -0,0 +1,49 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseReplaySince(t *testing.T) {
+	tests := []struct {
+		raw      string
+		duration time.Duration
+		date     time.Time
+		err      bool
+	}{
+		{"", 0, time.Time{}, false},
+		{"72h", 72 * time.Hour, time.Time{}, false},
+		{"2019-03-01", 0, time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC), false},
+		{"2019-03-01T12:00:00Z", 0, time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC), false},
+		{"-1h", 0, time.Time{}, true},
+		{"yesterday", 0, time.Time{}, true},
+	}
+
+	for _, test := range tests {
+		duration, date, err := parseReplaySince(test.raw)
+		if (err != nil) != test.err {
+			t.Errorf("%q: got error %v, error expected: %t", test.raw, err, test.err)
+		} else if duration != test.duration || !date.Equal(test.date) {
+			t.Errorf("%q: got %s and %s, want %s and %s", test.raw, duration, date, test.duration, test.date)
+		}
+	}
+}
+
+func TestReplayCutoff(t *testing.T) {
+	if _, set := (Config{}).ReplayCutoff(); set {
+		t.Error("cutoff set without REPLAY_SINCE")
+	}
+
+	date := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	if cutoff, set := (Config{ReplaySinceDate: date}).ReplayCutoff(); !set || !cutoff.Equal(date) {
+		t.Errorf("got cutoff %s, want %s", cutoff, date)
+	}
+
+	// relative cutoffs are relative to the moment of replaying.
+	before := time.Now().Add(-time.Hour)
+	cutoff, set := (Config{ReplaySinceDuration: time.Hour}).ReplayCutoff()
+	if after := time.Now().Add(-time.Hour); !set || cutoff.Before(before) || cutoff.After(after) {
+		t.Errorf("got cutoff %s, want between %s and %s", cutoff, before, after)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// confirmationTimeout is the time a confirmation token stays valid.
+const confirmationTimeout = time.Minute
+
+// confirmation is a pending confirmation of a destructive action.
+type confirmation struct {
+	action  string
+	expires time.Time
+}
+
+// requestConfirmation returns a new token which has to be sent back by the
+// user to confirm the given action.
+func (conn *Connection) requestConfirmation(action string) (string, error) {
+	bytes := make([]byte, 4)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(bytes)
+
+	conn.confirmationsMutex.Lock()
+	defer conn.confirmationsMutex.Unlock()
+
+	if conn.confirmations == nil {
+		conn.confirmations = make(map[string]confirmation)
+	}
+	for key, c := range conn.confirmations {
+		if time.Now().After(c.expires) {
+			delete(conn.confirmations, key)
+		}
+	}
+
+	conn.confirmations[token] = confirmation{
+		action:  action,
+		expires: time.Now().Add(confirmationTimeout),
+	}
+	return token, nil
+}
+
+// confirm returns whether or not the given token confirms the given action.
+// A token can only be used once.
+func (conn *Connection) confirm(action, token string) bool {
+	conn.confirmationsMutex.Lock()
+	defer conn.confirmationsMutex.Unlock()
+
+	c, has := conn.confirmations[token]
+	if !has {
+		return false
+	}
+	delete(conn.confirmations, token)
+
+	return c.action == action && time.Now().Before(c.expires)
+}
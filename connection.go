@@ -7,7 +7,9 @@ import (
 	"log"
 	"math"
 	"net"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 	"whapp-irc/ircconnection"
 	"whapp-irc/timestampmap"
@@ -20,17 +22,103 @@ import (
 // time, and during connection setup.
 const ircMessageQueueSize = 10
 
+// the minimum time between two queued saves of the user entry to the database.
+const saveInterval = 2 * time.Second
+
+// the time listening for WhatsApp messages has to keep working after
+// reconnecting before the reconnect is announced.
+const reconnectSettleTime = 5 * time.Second
+
 // A Connection represents the internal state of a whapp-irc connection.
 type Connection struct {
 	WI    *whapp.Instance
 	Chats *types.ChatList
 
-	irc *ircconnection.Connection
+	// irc contains all IRC clients attached to the current session.
+	irc *Clients
+
+	// ctx is the context of the current session, which ends when the last
+	// client is detached.
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	timestampMap *timestampmap.Map
 
 	me           whapp.Me
 	localStorage map[string]string
+
+	// pushnameMutex guards me.Pushname, which is changed while the session
+	// runs.
+	pushnameMutex sync.Mutex
+
+	saveMutex      sync.Mutex
+	saveQueueMutex sync.Mutex
+	saveQueued     bool
+
+	reconnectBackoff *util.Backoff
+
+	typingMutex  sync.Mutex
+	typingStates map[whapp.ID]typingState
+
+	virtualChannelsMutex sync.Mutex
+	virtualChannels      []virtualChannel
+
+	metrics *Metrics
+	started time.Time
+
+	settingsMutex sync.Mutex
+	settings      types.Settings
+
+	confirmationsMutex sync.Mutex
+	confirmations      map[string]confirmation
+
+	reactionsMutex sync.Mutex
+	reactions      map[string]*messageReactions
+	reactionsOrder []string
+
+	interactiveMutex   sync.Mutex
+	interactiveOptions map[whapp.ID]interactiveOptions
+
+	undecryptedMutex sync.Mutex
+	undecryptedIDs   map[string]bool
+
+	awayMutex       sync.Mutex
+	aboutBeforeAway *string
+
+	// attachMutex is held while attaching or detaching clients, and while
+	// ending the session, so that a client never attaches to a session that's
+	// ending.
+	attachMutex sync.Mutex
+	graceStop   chan struct{}
+
+	whowasMutex sync.Mutex
+	whowas      []whowasEntry
+
+	coalesceMutex sync.Mutex
+	coalesced     map[whapp.ID]*coalescedMessage
+
+	schedulerMutex sync.Mutex
+	scheduled      map[whapp.ID][]scheduledMessage
+	scheduledOrder []whapp.ID
+	schedulerWake  chan struct{}
+
+	focusMutex sync.Mutex
+	focused    whapp.ID
+
+	watchMutex sync.Mutex
+	watchwords []string
+
+	failedMediaMutex sync.Mutex
+	failedMediaIDs   map[string]bool
+
+	quietMembershipMutex sync.Mutex
+	quietMembershipIDs   map[whapp.ID]bool
+
+	privacyMutex sync.Mutex
+	privacy      types.Privacy
+
+	translations     chan Message
+	translateBackoff *util.Backoff
 }
 
 // BindSocket binds the given TCP connection.
@@ -40,12 +128,15 @@ func BindSocket(socket *net.TCPConn) error {
 
 	irc := ircconnection.HandleConnection(ctx, socket)
 
-	// when the irc connection dies or the context is cancelled, kill
-	// everything off
+	// when the irc connection dies, the context is cancelled or the server is
+	// shutting down, kill everything off
 	go func() {
 		select {
 		case <-irc.StopChannel():
 		case <-ctx.Done():
+		case <-shutdownCh:
+			err := irc.WriteNow("ERROR :Closing link: server is shutting down")
+			util.LogIfErr("error while sending shutdown message", err)
 		}
 		cancel()
 	}()
@@ -62,7 +153,7 @@ func BindSocket(socket *net.TCPConn) error {
 	}
 
 	// send welcome message
-	if err := irc.WriteListNow([]string{
+	welcome := []string{
 		fmt.Sprintf(":whapp-irc 001 %s :Welcome to whapp-irc, %s.", irc.Nick(), irc.Nick()),
 		fmt.Sprintf(":whapp-irc 002 %s :Your host is whapp-irc.", irc.Nick()),
 		fmt.Sprintf(":whapp-irc 003 %s :This server was created %s.", irc.Nick(), startTime),
@@ -70,8 +161,21 @@ func BindSocket(socket *net.TCPConn) error {
 		fmt.Sprintf(":whapp-irc 005 %s PREFIX=(qo)~@ CHARSET=UTF-8 :are supported by this server", irc.Nick()),
 		fmt.Sprintf(":whapp-irc 375 %s :The server is running on commit %s", irc.Nick(), commit),
 		fmt.Sprintf(":whapp-irc 372 %s :Enjoy the ride.", irc.Nick()),
-		fmt.Sprintf(":whapp-irc 376 %s :End of /MOTD command.", irc.Nick()),
-	}); err != nil {
+	}
+	if conf.ObserverMode {
+		welcome = append(welcome, fmt.Sprintf(
+			":whapp-irc 372 %s :The server is running in observer mode, nothing will be sent to WhatsApp.",
+			irc.Nick(),
+		))
+	}
+	if inMaintenance() {
+		welcome = append(welcome, fmt.Sprintf(
+			":whapp-irc 372 %s :The server is in maintenance mode, sending to WhatsApp is disabled.",
+			irc.Nick(),
+		))
+	}
+	welcome = append(welcome, fmt.Sprintf(":whapp-irc 376 %s :End of /MOTD command.", irc.Nick()))
+	if err := irc.WriteListNow(welcome); err != nil {
 		return err
 	}
 
@@ -102,48 +206,63 @@ func BindSocket(socket *net.TCPConn) error {
 			return passErr(err)
 
 		case <-irc.PassSetChannel():
-			if irc.Pass() != user.Password {
+			if account := irc.Account(); account != "" {
+				// the client authenticated using SASL EXTERNAL instead of a
+				// password.  The stored password is used from now on, since
+				// it identifies the session and is saved with the user.
+				if account != irc.Nick() {
+					err := fmt.Errorf("client authenticated as %s, not as %s", account, irc.Nick())
+					return passErr(err)
+				}
+				irc.SetPass(user.Password)
+			} else if irc.Pass() != user.Password {
 				err := fmt.Errorf("client provided password incorrect")
 				return passErr(err)
 			}
 		}
 	}
 
+	// if the user already has a session running, attach to it instead of
+	// setting up a new one.  When it ended meanwhile, a new one is set up.
+	if conn, has := getSession(irc.Nick()); has {
+		if attached, err := conn.attachClient(ctx, irc); attached || err != nil {
+			return err
+		}
+	}
+
+	// the session outlives the current client when other clients attach to
+	// it, but until we're set up it ends with the current client.
+	sessionCtx, cancelSession := context.WithCancel(context.Background())
+	defer cancelSession()
+
+	setupDone := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancelSession()
+		case <-setupDone:
+		}
+	}()
+
 	// setup bridge and connection
-	conn, err := setupConnection(ctx, irc)
+	conn, err := setupConnection(sessionCtx, irc)
+	close(setupDone)
 	if err != nil {
 		irc.Status("error setting up whapp bridge: " + err.Error())
 		return err
 	}
+	conn.ctx, conn.cancel = sessionCtx, cancelSession
+
+	setSession(irc.Nick(), conn)
+	defer removeSession(irc.Nick(), conn)
 
 	// now that we have set-up the bridge...
 
 	// actually handle most of the IRC messages
-	go func() {
-		defer cancel()
-		ircReceiveCh := conn.irc.ReceiveChannel()
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
+	go conn.serveClient(ctx, irc)
 
-			case msg, ok := <-ircReceiveCh:
-				if !ok {
-					return
-				}
-
-				if err := conn.handleIRCCommand(ctx, msg); err != nil {
-					log.Printf("error handling new irc message: %s\n", err)
-
-					if err == io.ErrClosedPipe {
-						return
-					}
-					continue
-				}
-			}
-		}
-	}()
+	// from now on everything is bound to the session instead of the client.
+	ctx = sessionCtx
 
 	// we want to wait until we've finished negotiation, since when we send a
 	// replay we want to know if the user has servertime and even if they want a
@@ -151,7 +270,7 @@ func BindSocket(socket *net.TCPConn) error {
 	// if negotiation hasn't started yet, we just skip through (we figure the
 	// client doesn't support IRCv3, since normally negotiation occurs fairly
 	// early in the connection)
-	started, ok := conn.irc.Caps.WaitNegotiation(ctx)
+	started, ok := irc.Caps.WaitNegotiation(ctx)
 	if !ok {
 		return nil
 	} else if !started {
@@ -160,14 +279,23 @@ func BindSocket(socket *net.TCPConn) error {
 		log.Printf(str)
 	}
 
-	// replay older messages
+	// replay older messages.  The messages of all chats are sorted by their
+	// timestamp before replaying them, so that they're in order even in clients
+	// that don't sort by server-time.  The amount of messages is bounded by the
+	// replay cutoff.
 	empty := conn.timestampMap.Length() == 0
+	cutoff := int64(math.MinInt64)
+	if t, set := conf.ReplayCutoff(); set {
+		cutoff = t.Unix()
+	}
+	var replay []whapp.Message
 	for _, item := range conn.Chats.List(false) {
 		c := item.Chat
 
 		prevTimestamp, found := conn.timestampMap.Get(c.ID)
 
-		if empty || !conn.hasReplay() {
+		skip := conf.ReplayJoinedOnly && c.IsChannel() && !c.Joined
+		if empty || !conn.hasReplay() || skip || c.RawChat.Timestamp < cutoff {
 			conn.timestampMap.Set(c.ID, c.RawChat.Timestamp)
 			continue
 		} else if c.RawChat.Timestamp <= prevTimestamp {
@@ -189,23 +317,33 @@ func BindSocket(socket *net.TCPConn) error {
 			return err
 		}
 
-		for _, msg := range messages {
-			if msg.Timestamp <= prevTimestamp {
-				continue
-			}
-
-			err := conn.handleWhappMessageReplay(ctx, msg)
-			util.LogIfErr("error handling older whapp message", err)
+		newer, old := splitReplay(messages, prevTimestamp, cutoff)
+		for _, msg := range old {
+			// too old to replay, mark it as seen so that it won't be
+			// replayed later either.
+			c.AddMessageID(msg.ID.Serialized)
+			conn.timestampMap.Set(c.ID, msg.Timestamp)
 		}
+		replay = append(replay, newer...)
 	}
-	go conn.saveDatabaseEntry()
+
+	sort.SliceStable(replay, func(i, j int) bool {
+		return replay[i].Timestamp < replay[j].Timestamp
+	})
+	for _, msg := range replay {
+		err := conn.handleWhappMessageReplay(ctx, msg)
+		util.LogIfErr("error handling older whapp message", err)
+	}
+	err = conn.sendQuietMembership()
+	util.LogIfErr("error sending names after replay", err)
+	conn.queueDatabaseSave()
 
 	conn.irc.Status("ready for new messages")
 
 	// handle logging out on whatsapp web, this happens when the user removes
 	// the bridge client on their phone.
 	go func() {
-		defer cancel()
+		defer conn.endSession()
 
 		resCh, errCh := conn.WI.ListenLoggedIn(ctx, 3*time.Second)
 
@@ -223,22 +361,17 @@ func BindSocket(socket *net.TCPConn) error {
 					continue
 				}
 
-				conn.irc.Status("logged out of whatsapp")
+				conn.Broadcast("logged out of whatsapp")
 
 				return
 			}
 		}
 	}()
 
-	// listen for new WhatsApp messages
+	// notify the client when the user changes their pushname, so that clients
+	// supporting setname can update the realname.
 	go func() {
-		defer cancel()
-
-		messageCh, errCh := conn.WI.ListenForMessages(
-			ctx,
-			500*time.Millisecond,
-		)
-		queue := GetMessageQueue(ctx, messageCh, 50)
+		resCh, errCh := conn.WI.ListenForPushnameChange(ctx, 30*time.Second)
 
 		for {
 			select {
@@ -246,37 +379,327 @@ func BindSocket(socket *net.TCPConn) error {
 				return
 
 			case err := <-errCh:
-				util.LogIfErr("error while listening for whatsapp messages", err)
+				util.LogIfErr("error while listening for pushname changes", err)
 				return
 
-			case msgRes := <-<-queue:
-				if msgRes.Err == nil {
-					msgRes.Err = conn.handleWhappMessage(
-						ctx,
-						msgRes.Message,
-						handlerNormal,
-					)
+			case pushname, ok := <-resCh:
+				if !ok {
+					return
 				}
 
-				util.LogIfErr("error handling new whapp message", msgRes.Err)
+				// the pushname may have been set using the setname command
+				// already.
+				if !conn.setMePushname(pushname) {
+					continue
+				}
+
+				err := conn.irc.SetName(pushname)
+				util.LogIfErr("error sending SETNAME", err)
 			}
 		}
 	}()
 
+	// keep clients up to date on the delivery state of the messages of the
+	// user.
+	go conn.listenForAcks(ctx)
+
+	// WhatsApp Web shows the user as online when it's opened.
+	if conn.getPrivacy().HideOnline && !conf.ObserverMode && !inMaintenance() {
+		err := conn.WI.SetOnline(ctx, false)
+		util.LogIfErr("error while hiding online state", err)
+	}
+
+	// resume delivery of snoozed chats when their snooze expires.
+	go conn.watchSnoozes(ctx)
+
+	if conf.MaxLineRate > 0 {
+		go conn.runScheduler(ctx)
+	}
+	if conf.Translate {
+		go conn.translateMessages(ctx, newMessageHandler())
+	}
+
+	// listen for new WhatsApp messages, when listening fails we reconnect
+	// using the configured backoff.
+	go func() {
+		defer conn.endSession()
+
+		reconnecting := false
+		for {
+			// announce the reconnect once the listener has been running for
+			// a while without failing again.
+			var reconnected *time.Timer
+			if reconnecting {
+				reconnected = time.AfterFunc(reconnectSettleTime, func() {
+					conn.Broadcast("reconnected to whatsapp")
+				})
+			}
+
+			started := time.Now()
+			err := conn.listenForMessages(ctx)
+			if reconnected != nil {
+				reconnected.Stop()
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			util.LogIfErr("error while listening for whatsapp messages", err)
+
+			// if the listener has been running fine for a while, this
+			// failure isn't related to the previous ones.
+			if time.Since(started) > conf.ReconnectMaxDelay {
+				conn.reconnectBackoff.Reset()
+			}
+
+			delay, ok := conn.reconnectBackoff.Next()
+			if !ok {
+				conn.Broadcast("lost connection to whatsapp, giving up")
+				return
+			}
+			conn.Broadcast(fmt.Sprintf(
+				"lost connection to whatsapp, reconnecting in %s",
+				delay,
+			))
+			reconnecting = true
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			conn.metrics.reconnected()
+		}
+	}()
+
 	// now just wait until we have to shutdown.
 	<-ctx.Done()
 	log.Printf("connection ended: %s\n", ctx.Err())
-	return nil
+	log.Printf("connection metrics: %s\n", conn.metrics)
+	conn.stopReactionSummaries()
+	conn.flushAllCoalesced()
+	conn.flushScheduled()
+
+	// make sure we have the latest state on disk.
+	return conn.saveDatabaseEntry()
 }
 
-func (conn *Connection) joinChat(item types.ChatListItem) error {
+// attachClient attaches the given client to the current session, and handles
+// its IRC messages until the client or the session ends.  Returns false when
+// the session has ended already.
+func (conn *Connection) attachClient(ctx context.Context, client *ircconnection.Connection) (attached bool, err error) {
+	conn.attachMutex.Lock()
+	if conn.ctx.Err() != nil {
+		conn.attachMutex.Unlock()
+		return false, nil
+	}
+	conn.stopGracePeriod()
+	err = conn.irc.Attach(client, func(client *ircconnection.Connection) error {
+		client.Status("attached to the running session")
+
+		for _, item := range conn.Chats.List(false) {
+			if !item.Chat.IsChannel() || !item.Chat.Joined {
+				continue
+			}
+
+			if err := sendJoin(client, item, time.Now()); err != nil {
+				return err
+			}
+		}
+
+		for _, ch := range conn.joinedVirtualChannels() {
+			if err := ch.sendJoin(client, time.Now()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	conn.attachMutex.Unlock()
+	if err != nil {
+		conn.detachClient(client)
+		return true, err
+	}
+
+	conn.serveClient(ctx, client)
+	return true, nil
+}
+
+// detachClient detaches the given client.  When it was the last attached
+// client, the session ends after the configured grace period.
+func (conn *Connection) detachClient(client *ircconnection.Connection) {
+	conn.attachMutex.Lock()
+	defer conn.attachMutex.Unlock()
+
+	if conn.irc.Remove(client) == 0 {
+		conn.clearFocus()
+		conn.startGracePeriod()
+	}
+}
+
+// serveClient handles the IRC messages of the given client until the client or
+// the session ends.  When the last client is detached, the session ends after
+// the configured grace period.
+func (conn *Connection) serveClient(ctx context.Context, client *ircconnection.Connection) {
+	defer conn.detachClient(client)
+
+	receiveCh := client.ReceiveChannel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-conn.ctx.Done():
+			return
+
+		case msg, ok := <-receiveCh:
+			if !ok {
+				return
+			}
+
+			if err := conn.handleIRCCommand(conn.ctx, client, msg); err != nil {
+				log.Printf("error handling new irc message: %s\n", err)
+
+				if err == io.ErrClosedPipe {
+					return
+				}
+				continue
+			}
+		}
+	}
+}
+
+// startGracePeriod ends the session after conf.SessionGracePeriod, unless a
+// client attaches before that.  conn.attachMutex has to be held.
+func (conn *Connection) startGracePeriod() {
+	if conf.SessionGracePeriod == 0 {
+		conn.end()
+		return
+	}
+
+	stop := make(chan struct{})
+	conn.graceStop = stop
+	log.Printf("last client detached, keeping session for %s\n", conf.SessionGracePeriod)
+
+	go func() {
+		select {
+		case <-stop:
+			return
+		case <-conn.ctx.Done():
+			return
+		case <-shutdownCh:
+		case <-time.After(conf.SessionGracePeriod):
+		}
+
+		conn.attachMutex.Lock()
+		defer conn.attachMutex.Unlock()
+
+		// a client may have attached while we were waiting for the lock.
+		if conn.graceStop != stop {
+			return
+		}
+		conn.graceStop = nil
+		conn.end()
+	}()
+}
+
+// end ends the session.  It's removed from the running sessions first, so that
+// no client finds it anymore once it's cancelled.  conn.attachMutex has to be
+// held.
+func (conn *Connection) end() {
+	removeSession(conn.irc.Nick(), conn)
+	conn.cancel()
+}
+
+// endSession ends the session, see end.
+func (conn *Connection) endSession() {
+	conn.attachMutex.Lock()
+	defer conn.attachMutex.Unlock()
+
+	conn.end()
+}
+
+// stopGracePeriod stops the running grace period, if any, since a client
+// attached.  conn.attachMutex has to be held.
+func (conn *Connection) stopGracePeriod() {
+	if conn.graceStop != nil {
+		close(conn.graceStop)
+		conn.graceStop = nil
+	}
+}
+
+// listenForMessages listens for and handles new WhatsApp messages, until the
+// given context is done or an error occurs while listening.
+func (conn *Connection) listenForMessages(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	messageCh, errCh := conn.WI.ListenForMessages(
+		ctx,
+		500*time.Millisecond,
+	)
+	queue := GetMessageQueue(ctx, messageCh, 50, conn.downloadMessageMedia)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case err := <-errCh:
+			return err
+
+		case msgRes := <-<-queue:
+			if msgRes.Err == nil {
+				msgRes.Err = conn.handleWhappMessage(
+					ctx,
+					msgRes.Message,
+					withTranslation(newMessageHandler()),
+				)
+			}
+
+			util.LogIfErr("error handling new whapp message", msgRes.Err)
+
+			if msgRes.Err == nil {
+				err := conn.markFocusedRead(ctx, msgRes.Message)
+				util.LogIfErr("error while marking focused chat as read", err)
+			}
+		}
+	}
+}
+
+// chatTopic returns the topic of the given chat, which consists of the chat
+// name, the description (if any) and, if configured, the amount of members.
+func chatTopic(chat *types.Chat) string {
+	topic := chat.Name
+	if chat.RawChat.IsCommunity {
+		topic = "[community] " + topic
+	} else if chat.RawChat.IsAnnouncement {
+		topic = "[announcements] " + topic
+	}
+	if isSoleMember(chat) {
+		topic = "[only you] " + topic
+	}
+	if desc := chat.RawChat.Description; desc != nil {
+		if d := strings.TrimSpace(desc.Description); d != "" {
+			d = strings.Replace(d, "\n", " ", -1)
+			topic = fmt.Sprintf("%s: %s", topic, d)
+		}
+	}
+
+	if conf.TopicMemberCount && chat.IsGroupChat {
+		n := len(chat.Participants)
+		topic = fmt.Sprintf("%s [%d %s]", topic, n, util.Plural(n, "member", "members"))
+	}
+
+	return topic
+}
+
+func (conn *Connection) joinChat(item types.ChatListItem, date time.Time) error {
 	chat := item.Chat
 
 	// sanity checks
 	if chat == nil {
 		return fmt.Errorf("chat is nil")
-	} else if !chat.IsGroupChat {
-		return fmt.Errorf("not a group chat")
+	} else if !chat.IsChannel() {
+		return fmt.Errorf("not a group chat or broadcast list")
 	} else if chat.Joined {
 		return nil
 	}
@@ -287,30 +710,48 @@ func (conn *Connection) joinChat(item types.ChatListItem) error {
 		return fmt.Errorf("identifier is empty, chat.Name is %s", chat.Name)
 	}
 
+	if err := sendJoin(conn.irc, item, date); err != nil {
+		return err
+	}
+
+	chat.Joined = true
+	return nil
+}
+
+// sendJoin sends the JOIN, topic and names of the chat of the given item to the
+// given client, on the given date.
+func sendJoin(client ircClient, item types.ChatListItem, date time.Time) error {
+	chat := item.Chat
+	identifier := item.Identifier
+
 	// send JOIN to client
-	str := fmt.Sprintf(":%s JOIN %s", conn.irc.Nick(), identifier)
-	if err := conn.irc.WriteNow(str); err != nil {
+	str := fmt.Sprintf(":%s JOIN %s", client.Nick(), identifier)
+	if err := client.Write(date, str); err != nil {
 		return err
 	}
 
 	// send chat name and description (if any) as topic
-	topic := fmt.Sprintf(":whapp-irc 332 %s %s :%s", conn.irc.Nick(), identifier, chat.Name)
-	if desc := chat.RawChat.Description; desc != nil {
-		if d := strings.TrimSpace(desc.Description); d != "" {
-			d = strings.Replace(d, "\n", " ", -1)
-			topic = fmt.Sprintf("%s: %s", topic, d)
-		}
-	}
-	conn.irc.WriteNow(topic)
+	topic := fmt.Sprintf(":whapp-irc 332 %s %s :%s", client.Nick(), identifier, chatTopic(chat))
+	client.Write(date, topic)
 
 	// send chat members to client
+	return sendNames(client, item, date)
+}
+
+// sendNames sends the modes of the user and the names of the participants of
+// the chat of the given item to the given client, on the given date.
+func sendNames(client ircClient, item types.ChatListItem, date time.Time) error {
+	chat := item.Chat
+	identifier := item.Identifier
+
+	participants, capped := listedParticipants(chat)
 	names := make([]string, 0)
-	for _, participant := range chat.Participants {
+	for _, participant := range participants {
 		if participant.Contact.IsMe {
 			if participant.IsSuperAdmin {
-				conn.irc.WriteNow(fmt.Sprintf(":whapp-irc MODE %s +q %s", identifier, conn.irc.Nick()))
+				client.Write(date, fmt.Sprintf(":whapp-irc MODE %s +q %s", identifier, client.Nick()))
 			} else if participant.IsAdmin {
-				conn.irc.WriteNow(fmt.Sprintf(":whapp-irc MODE %s +o %s", identifier, conn.irc.Nick()))
+				client.Write(date, fmt.Sprintf(":whapp-irc MODE %s +o %s", identifier, client.Nick()))
 			}
 			continue
 		}
@@ -324,19 +765,154 @@ func (conn *Connection) joinChat(item types.ChatListItem) error {
 
 		names = append(names, prefix+participant.SafeName())
 	}
-	str = fmt.Sprintf(":whapp-irc 353 %s @ %s :%s", conn.irc.Nick(), identifier, strings.Join(names, " "))
-	if err := conn.irc.WriteNow(str); err != nil {
+	str := fmt.Sprintf(":whapp-irc 353 %s @ %s :%s", client.Nick(), identifier, strings.Join(names, " "))
+	if err := client.Write(date, str); err != nil {
 		return err
 	}
-	str = fmt.Sprintf(":whapp-irc 366 %s %s :End of /NAMES list.", conn.irc.Nick(), identifier)
-	if err := conn.irc.WriteNow(str); err != nil {
+	str = fmt.Sprintf(":whapp-irc 366 %s %s :End of /NAMES list.", client.Nick(), identifier)
+	if err := client.Write(date, str); err != nil {
 		return err
 	}
+	if capped {
+		client.Status(cappedListMessage(item, len(participants)))
+	}
 
-	chat.Joined = true
 	return nil
 }
 
+// isAdmin returns whether or not the user is an admin of the given chat.
+func isAdmin(chat *types.Chat) bool {
+	for _, p := range chat.Participants {
+		if p.Contact.IsMe {
+			return p.IsAdmin || p.IsSuperAdmin
+		}
+	}
+	return false
+}
+
+// isSoleMember returns whether or not the user is the only participant left in
+// the given group chat.
+func isSoleMember(chat *types.Chat) bool {
+	if !chat.IsGroupChat || chat.Left || len(chat.Participants) != 1 {
+		return false
+	}
+	return chat.Participants[0].Contact.IsMe
+}
+
+// isReadOnly returns whether or not the user can't send messages to the given
+// chat, which is the case for communities and for announcement groups of which
+// the user isn't an admin.
+func isReadOnly(chat *types.Chat) bool {
+	raw := chat.RawChat
+	return raw.IsCommunity || (raw.IsAnnouncement && !isAdmin(chat))
+}
+
+// contactNick returns the nick of the contact of the given private chat.  This
+// is the identifier of the chat, unless private chats are shown as channels.
+func contactNick(item types.ChatListItem) string {
+	if !item.Chat.IsChannel() {
+		return item.Identifier
+	}
+
+	p := types.Participant{ID: item.ID, Contact: item.Chat.RawChat.Contact}
+	return p.SafeName()
+}
+
+// privateChatByNick returns the private chat with the contact with the given
+// nick, if any.
+func (conn *Connection) privateChatByNick(nick string) (types.ChatListItem, bool) {
+	if item, has := conn.Chats.ByIdentifier(nick, false); has && !item.Chat.IsChannel() {
+		return item, true
+	} else if !conf.PrivateChannels {
+		return types.ChatListItem{}, false
+	}
+
+	for _, item := range conn.Chats.List(false) {
+		if item.Chat.IsPrivate() && strings.EqualFold(contactNick(item), nick) {
+			return item, true
+		}
+	}
+	return types.ChatListItem{}, false
+}
+
+// listedParticipants returns the participants of the given chat that should be
+// listed in NAMES and WHO replies.  When the chat has more participants than
+// conf.MaxListedParticipants, only the user, the admins and as much other
+// participants as fit are returned, and capped is true.
+func listedParticipants(chat *types.Chat) (res []types.Participant, capped bool) {
+	max := conf.MaxListedParticipants
+	if max == 0 || len(chat.Participants) <= max {
+		return chat.Participants, false
+	}
+
+	alwaysListed := func(p types.Participant) bool {
+		return p.Contact.IsMe || p.IsAdmin || p.IsSuperAdmin
+	}
+
+	nOthers := max
+	for _, p := range chat.Participants {
+		if alwaysListed(p) {
+			nOthers--
+		}
+	}
+
+	res = make([]types.Participant, 0, max)
+	for _, p := range chat.Participants {
+		if alwaysListed(p) {
+			res = append(res, p)
+		} else if nOthers > 0 {
+			res = append(res, p)
+			nOthers--
+		}
+	}
+	return res, true
+}
+
+// cappedListMessage returns the message notifying the user that the member
+// list of the given chat has been capped to n participants.
+func cappedListMessage(item types.ChatListItem, n int) string {
+	return fmt.Sprintf(
+		"member list of %s capped to %d of %d participants",
+		item.Identifier,
+		n,
+		len(item.Chat.Participants),
+	)
+}
+
+// Broadcast sends the given body to the status user and as a notice to every
+// joined group chat.
+func (conn *Connection) Broadcast(body string) error {
+	if err := conn.irc.Status(body); err != nil {
+		return err
+	}
+
+	for _, item := range conn.Chats.List(false) {
+		if !item.Chat.IsChannel() || !item.Chat.Joined {
+			continue
+		}
+
+		if err := conn.irc.Notice(
+			time.Now(),
+			"whapp-irc",
+			item.Identifier,
+			body,
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// chatNotice sends the given line as a notice to the chat of the given item,
+// on the given date.
+func (conn *Connection) chatNotice(item types.ChatListItem, date time.Time, line string) error {
+	if item.Chat.IsChannel() {
+		return conn.irc.Notice(date, "whapp-irc", item.Identifier, line)
+	}
+	return conn.irc.Notice(date, item.Identifier, conn.irc.Nick(), line)
+}
+
 func (conn *Connection) convertChat(
 	chat whapp.Chat,
 	participants []whapp.Participant,
@@ -346,11 +922,25 @@ func (conn *Connection) convertChat(
 		converted[i] = types.Participant(p)
 	}
 
+	name := chat.Title()
+	if name == "" && chat.ID.IsBroadcast() {
+		name = chat.ID.User
+	}
+
+	// private chats shown as channels have the contact as their only
+	// participant, besides the user.
+	if conf.PrivateChannels && !chat.IsGroupChat && !chat.ID.IsBroadcast() {
+		converted = []types.Participant{{ID: chat.ID, Contact: chat.Contact}}
+	}
+
 	return &types.Chat{
 		ID:   chat.ID,
-		Name: chat.Title(),
+		Name: name,
 
-		IsGroupChat:  chat.IsGroupChat,
+		// WhatsApp Web reports some broadcast lists as group chats, they
+		// aren't however.
+		IsGroupChat:  chat.IsGroupChat && !chat.ID.IsBroadcast(),
+		IsBroadcast:  chat.ID.IsBroadcast(),
 		Participants: converted,
 
 		RawChat: chat,
@@ -360,10 +950,10 @@ func (conn *Connection) convertChat(
 func (conn *Connection) addChat(chat *types.Chat) types.ChatListItem {
 	item, isNew := conn.Chats.Add(chat)
 	if isNew {
-		go conn.saveDatabaseEntry()
+		conn.queueDatabaseSave()
 	}
 
-	if item.Chat.IsGroupChat {
+	if item.Chat.IsChannel() {
 		log.Printf(
 			"%-30s %3d participants\n",
 			item.Identifier,
@@ -376,13 +966,43 @@ func (conn *Connection) addChat(chat *types.Chat) types.ChatListItem {
 	return item
 }
 
+// saveDatabaseEntry saves the user entry to the database right away.
 func (conn *Connection) saveDatabaseEntry() error {
+	// hold the lock while creating the entry as well, so that an older entry
+	// never overwrites a newer one.
+	conn.saveMutex.Lock()
+	defer conn.saveMutex.Unlock()
+
 	err := userDb.SaveItem(conn.irc.Nick(), types.User{
 		Password:             conn.irc.Pass(),
 		LocalStorage:         conn.localStorage,
 		LastReceivedReceipts: conn.timestampMap.GetCopy(),
 		Chats:                conn.Chats.List(true),
+		Settings:             conn.getSettings(),
+		Watchwords:           conn.getWatchwords(),
+		Privacy:              conn.getPrivacy(),
 	})
 	util.LogIfErr("error while updating user entry", err)
 	return err
 }
+
+// queueDatabaseSave queues a save of the user entry to the database.  Saves
+// queued in rapid succession are coalesced into a single save, done at most
+// saveInterval after the first one was queued.
+func (conn *Connection) queueDatabaseSave() {
+	conn.saveQueueMutex.Lock()
+	defer conn.saveQueueMutex.Unlock()
+
+	if conn.saveQueued {
+		return
+	}
+	conn.saveQueued = true
+
+	time.AfterFunc(saveInterval, func() {
+		conn.saveQueueMutex.Lock()
+		conn.saveQueued = false
+		conn.saveQueueMutex.Unlock()
+
+		conn.saveDatabaseEntry()
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"whapp-irc/config"
+	"whapp-irc/ircconnection"
+	"whapp-irc/timestampmap"
+	"whapp-irc/types"
+	"whapp-irc/whapp"
+)
+
+// testTimeout is the maximum time tests wait for an IRC client to receive a
+// line.
+const testTimeout = 5 * time.Second
+
+// testSentinel is the line written after the lines a test expects, so that
+// the client knows when it received all of them.
+const testSentinel = ":whapp-irc PING :sentinel"
+
+// selfID is the WhatsApp ID of the user of test sessions.
+var selfID = whapp.ID{User: "31600000000", Server: "c.us"}
+
+// testClient is the client end of an IRC connection attached to a test
+// session.
+type testClient struct {
+	t      *testing.T
+	socket net.Conn
+	reader *bufio.Reader
+}
+
+// send sends the given line to the bridge.
+func (c *testClient) send(line string) {
+	c.socket.SetWriteDeadline(time.Now().Add(testTimeout))
+	if _, err := c.socket.Write([]byte(line + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// readLine returns the next line received from the bridge.
+func (c *testClient) readLine() string {
+	c.socket.SetReadDeadline(time.Now().Add(testTimeout))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("error while reading line: %s", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// lines returns the lines the client received from the given session since
+// the last call.
+func (c *testClient) lines(conn *Connection) []string {
+	if err := conn.irc.WriteNow(testSentinel); err != nil {
+		c.t.Fatal(err)
+	}
+
+	var res []string
+	for {
+		line := c.readLine()
+		if strings.HasSuffix(line, testSentinel) {
+			return res
+		}
+		res = append(res, line)
+	}
+}
+
+// dialTestClient returns a new IRC connection with the nick "me", which
+// negotiated the given capabilities, and the client end of it.
+func dialTestClient(ctx context.Context, t *testing.T, caps ...string) (*ircconnection.Connection, *testClient) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	socket, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	irc := ircconnection.HandleConnection(ctx, server)
+	nickSet := irc.NickSetChannel()
+	client := &testClient{t, socket, bufio.NewReader(socket)}
+
+	if len(caps) > 0 {
+		client.send("CAP REQ :" + strings.Join(caps, " "))
+		client.readLine() // ACK
+		client.send("CAP END")
+	}
+	client.send("NICK me")
+
+	select {
+	case <-nickSet:
+	case <-time.After(testTimeout):
+		t.Fatal("nick never set")
+	}
+	return irc, client
+}
+
+// newTestConnection returns a session with a single attached IRC client
+// which negotiated the given capabilities, the client end of that client, and
+// a function ending the session.  The session isn't connected to WhatsApp, so
+// the chats used have to be added beforehand.
+func newTestConnection(t *testing.T, caps ...string) (conn *Connection, client *testClient, cancel func()) {
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	irc, client := dialTestClient(ctx, t, caps...)
+
+	conn = &Connection{
+		Chats:        &types.ChatList{},
+		irc:          NewClients(irc),
+		timestampMap: timestampmap.New(),
+		me:           whapp.Me{SelfID: selfID},
+		metrics:      &Metrics{},
+
+		// the session has no database entry to save.
+		saveQueued: true,
+	}
+	return conn, client, func() {
+		cancelCtx()
+		client.socket.Close()
+	}
+}
+
+// attachTestClient attaches a new IRC client which negotiated the given
+// capabilities to the given session, and returns the client end of it.
+func attachTestClient(t *testing.T, conn *Connection, caps ...string) *testClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	irc, client := dialTestClient(ctx, t, caps...)
+
+	err := conn.irc.Attach(irc, func(*ircconnection.Connection) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		<-irc.StopChannel()
+		cancel()
+	}()
+	return client
+}
+
+// withConfig sets conf to the given config for the rest of the test, and
+// returns a function restoring the previous one.
+func withConfig(c config.Config) (restore func()) {
+	prev := conf
+	conf = c
+	return func() { conf = prev }
+}
+
+// testContact returns a contact with the given phone number and name.
+func testContact(user, name string) whapp.Contact {
+	return whapp.Contact{
+		ID:            whapp.ID{User: user, Server: "c.us"},
+		FormattedName: name,
+		IsMyContact:   true,
+	}
+}
+
+// addTestGroup adds a joined group chat with the given ID, name and members
+// to the given session.  The user is a member as well.
+func addTestGroup(conn *Connection, id, name string, members ...whapp.Contact) types.ChatListItem {
+	participants := []types.Participant{{
+		ID:      selfID,
+		Contact: whapp.Contact{ID: selfID, IsMe: true},
+	}}
+	for _, c := range members {
+		participants = append(participants, types.Participant{ID: c.ID, Contact: c})
+	}
+
+	chatID := whapp.ID{User: id, Server: "g.us"}
+	item, _ := conn.Chats.Add(&types.Chat{
+		ID:           chatID,
+		Name:         name,
+		IsGroupChat:  true,
+		Participants: participants,
+		Joined:       true,
+		RawChat:      whapp.Chat{ID: chatID, Name: name, IsGroupChat: true},
+	})
+	return item
+}
+
+// addTestPrivateChat adds the private chat with the given contact to the given
+// session.
+func addTestPrivateChat(conn *Connection, contact whapp.Contact) types.ChatListItem {
+	item, _ := conn.Chats.Add(&types.Chat{
+		ID:      contact.ID,
+		Name:    contact.FormattedName,
+		RawChat: whapp.Chat{ID: contact.ID, Name: contact.FormattedName, Contact: contact},
+	})
+	return item
+}
+
+// testMessage returns a text message with the given ID and body sent by the
+// given contact in the chat of the given item.
+func testMessage(item types.ChatListItem, sender whapp.Contact, id, body string) whapp.Message {
+	raw := item.Chat.RawChat
+	msg := whapp.Message{
+		ID: whapp.MessageID{
+			ChatID:     raw.ID,
+			ID:         id,
+			Serialized: "false_" + raw.ID.String() + "_" + id,
+		},
+		Timestamp: 1500000000,
+		From:      sender.ID,
+		To:        raw.ID,
+		Body:      body,
+		Type:      "chat",
+		Chat:      raw,
+	}
+	if raw.IsGroupChat {
+		msg.Sender = &sender
+	}
+	if sender.ID == selfID {
+		msg.ID.FromMe = true
+		msg.ID.Serialized = "true_" + raw.ID.String() + "_" + id
+		msg.IsSentByMe = true
+	}
+	return msg
+}
+
+// handleTestMessage handles the given message like a new message.
+func handleTestMessage(t *testing.T, conn *Connection, msg whapp.Message) {
+	if err := conn.handleWhappMessage(context.Background(), msg, handlerNormal); err != nil {
+		t.Fatalf("error while handling message: %s", err)
+	}
+}
+
+// equalLines returns whether or not the given lists of lines are equal.
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
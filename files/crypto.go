@@ -0,0 +1,76 @@
+package files
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+)
+
+// encryptedMagic is prepended to files encrypted at rest, so that they can be
+// told apart from files stored in plaintext before encryption was enabled.
+var encryptedMagic = []byte("whapp-irc-enc1\n")
+
+func (fs *FileServer) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(fs.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the given plaintext using a fresh nonce, returning the magic,
+// the nonce and the ciphertext.
+func (fs *FileServer) seal(plain []byte) ([]byte, error) {
+	aead, err := fs.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	res := make([]byte, 0, len(encryptedMagic)+len(nonce)+len(plain)+aead.Overhead())
+	res = append(res, encryptedMagic...)
+	res = append(res, nonce...)
+	return aead.Seal(res, nonce, plain, nil), nil
+}
+
+// open decrypts the given file contents made by seal.  Contents without the
+// magic are returned as is.
+func (fs *FileServer) open(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, encryptedMagic) {
+		return data, nil
+	} else if fs.key == nil {
+		return nil, ErrNoKey
+	}
+	data = data[len(encryptedMagic):]
+
+	aead, err := fs.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < aead.NonceSize() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// writeFile writes the given bytes to the given path, encrypting them first
+// if a key is set.
+func (fs *FileServer) writeFile(path string, bytes []byte) error {
+	if fs.key != nil {
+		var err error
+		if bytes, err = fs.seal(bytes); err != nil {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(path, bytes, 0644)
+}
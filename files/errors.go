@@ -7,3 +7,6 @@ var ErrHashEmpty = errors.New("hash is empty")
 
 // ErrBytesEmpty is returned when the given byte slice is empty.
 var ErrBytesEmpty = errors.New("bytes are empty")
+
+// ErrNoKey is returned when an encrypted file is read while no key is set.
+var ErrNoKey = errors.New("file is encrypted but no key is set")
@@ -1,10 +1,14 @@
 package files
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 )
@@ -14,6 +18,8 @@ type File struct {
 	Hash string
 	Path string
 	URL  string
+
+	Metadata Metadata
 }
 
 // FileServer represents a (running) file server.
@@ -23,20 +29,25 @@ type FileServer struct {
 	UseHTTPS  bool
 	Directory string
 
+	key        []byte
 	mutex      sync.RWMutex
 	hashToPath map[string]File
+
+	healthMutex sync.RWMutex
+	unavailable bool
 }
 
 // MakeFileServer returns a new FileServer in the given dir, using the given
 // options. It first scans the dir for older files, and loads them in the
-// database.
-func MakeFileServer(host, port, dir string, useHTTPS bool) (*FileServer, error) {
+// database.  If key is non-nil, files are stored encrypted using it.
+func MakeFileServer(host, port, dir string, useHTTPS bool, key []byte) (*FileServer, error) {
 	fs := &FileServer{
 		Host:      host,
 		Port:      port,
 		UseHTTPS:  useHTTPS,
 		Directory: dir,
 
+		key:        key,
 		hashToPath: make(map[string]File),
 	}
 
@@ -78,6 +89,9 @@ func MakeFileServer(host, port, dir string, useHTTPS bool) (*FileServer, error)
 			if err != nil {
 				return nil, err
 			}
+			if f.Metadata, err = fs.readMetadata(b64url); err != nil {
+				log.Printf("error while reading metadata of file %s: %s\n", fname, err)
+			}
 			fs.hashToPath[hash] = f
 		}
 	}
@@ -85,11 +99,71 @@ func MakeFileServer(host, port, dir string, useHTTPS bool) (*FileServer, error)
 	return fs, nil
 }
 
+// fileByName returns the File struct with the given file name, if any.
+func (fs *FileServer) fileByName(name string) (file File, has bool) {
+	urlHash := name
+	if i := strings.LastIndexByte(name, '.'); i != -1 {
+		urlHash = name[:i]
+	}
+
+	if hash, err := b64urltob64(urlHash); err == nil {
+		if file, has = fs.GetFileByHash(hash); has {
+			return file, true
+		}
+	}
+	return fs.GetFileByHash(urlHash)
+}
+
+// serveFile serves the requested file, decrypting it if it's encrypted, with
+// headers based on its metadata and caching headers.
+func (fs *FileServer) serveFile(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(path.Clean("/" + r.URL.Path))
+	if name == "/" || name[0] == '.' {
+		http.NotFound(w, r)
+		return
+	}
+
+	p := filepath.Join(fs.Directory, name)
+	info, err := os.Stat(p)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, _ := fs.fileByName(name)
+	setHeaders(w, name, file.Metadata)
+
+	if fs.key == nil {
+		f, err := os.Open(p)
+		if err != nil {
+			log.Printf("error while serving file %s: %s\n", name, err)
+			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		http.ServeContent(w, r, name, info.ModTime(), f)
+		return
+	}
+
+	data, err := ioutil.ReadFile(p)
+	if err == nil {
+		data, err = fs.open(data)
+	}
+	if err != nil {
+		log.Printf("error while serving file %s: %s\n", name, err)
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(data))
+}
+
 // Serve starts the current FileServer.
 func (fs *FileServer) Serve() error {
 	httpServer := &http.Server{
 		Addr:    ":" + fs.Port,
-		Handler: noDirListing(http.FileServer(http.Dir(fs.Directory))),
+		Handler: withHealth(noDirListing(http.HandlerFunc(fs.serveFile))),
 	}
 
 	return httpServer.ListenAndServe()
@@ -108,16 +182,21 @@ func (fs *FileServer) getURL(fname string) string {
 	return fmt.Sprintf("%s://%s:%s/%s", protocol, fs.Host, fs.Port, fname)
 }
 
+// urlHash returns the given hash as used in file names.
+func urlHash(hash string) string {
+	res, err := b64tob64url(hash)
+	if err != nil {
+		return hash
+	}
+	return res
+}
+
 func (fs *FileServer) makeFile(hash, ext string) (File, error) {
 	if hash == "" {
 		return File{}, ErrHashEmpty
 	}
 
-	urlHash, err := b64tob64url(hash)
-	if err != nil {
-		urlHash = hash
-	}
-
+	urlHash := urlHash(hash)
 	fname := urlHash
 	if ext != "" {
 		fname += "." + ext
@@ -131,8 +210,8 @@ func (fs *FileServer) makeFile(hash, ext string) (File, error) {
 }
 
 // AddBlob adds the given bytes blob to the database, using the given hash and
-// extension for the file name.
-func (fs *FileServer) AddBlob(hash, ext string, bytes []byte) (File, error) {
+// extension for the file name, and stores the given metadata with it.
+func (fs *FileServer) AddBlob(hash, ext string, bytes []byte, meta Metadata) (File, error) {
 	if hash == "" {
 		return File{}, ErrHashEmpty
 	} else if len(bytes) == 0 {
@@ -144,9 +223,66 @@ func (fs *FileServer) AddBlob(hash, ext string, bytes []byte) (File, error) {
 		return File{}, err
 	}
 
-	if err := ioutil.WriteFile(f.Path, bytes, 0644); err != nil {
+	if err := fs.writeFile(f.Path, bytes); err != nil {
+		return File{}, err
+	}
+	if err := fs.writeMetadata(urlHash(hash), meta); err != nil {
+		return File{}, err
+	}
+	f.Metadata = meta
+
+	fs.mutex.Lock()
+	fs.hashToPath[hash] = f
+	fs.mutex.Unlock()
+
+	return f, nil
+}
+
+// TempPath returns the path of a temporary file for the file with the given
+// hash, with the given suffix.  Temporary files are hidden, so they're never
+// served or loaded as files.
+func (fs *FileServer) TempPath(hash, suffix string) (string, error) {
+	if hash == "" {
+		return "", ErrHashEmpty
+	}
+
+	return fmt.Sprintf("./%s/.%s.%s", fs.Directory, urlHash(hash), suffix), nil
+}
+
+// AddFile adds the file at the given path to the database, by moving it using
+// the given hash and extension for the file name, and stores the given
+// metadata with it.  If a key is set the file is encrypted instead, which
+// requires reading it into memory.
+func (fs *FileServer) AddFile(hash, ext, path string, meta Metadata) (File, error) {
+	f, err := fs.makeFile(hash, ext)
+	if err != nil {
+		return File{}, err
+	}
+
+	if info, err := os.Stat(path); err != nil {
+		return File{}, err
+	} else if info.Size() == 0 {
+		return File{}, ErrBytesEmpty
+	}
+
+	if fs.key == nil {
+		if err := os.Rename(path, f.Path); err != nil {
+			return File{}, err
+		}
+	} else {
+		bytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return File{}, err
+		}
+		if err := fs.writeFile(f.Path, bytes); err != nil {
+			return File{}, err
+		}
+		os.Remove(path)
+	}
+	if err := fs.writeMetadata(urlHash(hash), meta); err != nil {
 		return File{}, err
 	}
+	f.Metadata = meta
 
 	fs.mutex.Lock()
 	fs.hashToPath[hash] = f
@@ -160,6 +296,7 @@ func (fs *FileServer) RemoveFile(file File) error {
 	if err := os.Remove(file.Path); err != nil {
 		return err
 	}
+	os.Remove(fs.metadataPath(urlHash(file.Hash)))
 
 	fs.mutex.Lock()
 	delete(fs.hashToPath, file.Hash)
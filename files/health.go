@@ -0,0 +1,71 @@
+package files
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// healthPath is the path the file server answers health checks on.  It's a
+// dot file, so that it can never clash with a stored file.
+const healthPath = "/.health"
+
+// healthCheckTimeout is the maximum duration of a single health check.
+const healthCheckTimeout = 10 * time.Second
+
+// withHealth returns the given handler, answering health checks itself.
+func withHealth(handler http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == healthPath {
+			w.Write([]byte("ok\n"))
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// CheckHealth checks whether the file server is reachable using the URLs it
+// hands out.
+func (fs *FileServer) CheckHealth() error {
+	client := &http.Client{Timeout: healthCheckTimeout}
+
+	res, err := client.Get(fs.getURL(healthPath[1:]))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+// Available returns whether or not the file server was reachable during the
+// last health check.  It's true when no health check has been done.
+func (fs *FileServer) Available() bool {
+	fs.healthMutex.RLock()
+	defer fs.healthMutex.RUnlock()
+
+	return !fs.unavailable
+}
+
+// MonitorHealth checks the health of the file server every interval, updating
+// the result of Available.  It never returns.
+func (fs *FileServer) MonitorHealth(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		err := fs.CheckHealth()
+
+		fs.healthMutex.Lock()
+		if err != nil && !fs.unavailable {
+			log.Printf("file server became unavailable: %s\n", err)
+		} else if err == nil && fs.unavailable {
+			log.Println("file server is available again")
+		}
+		fs.unavailable = err != nil
+		fs.healthMutex.Unlock()
+	}
+}
@@ -0,0 +1,89 @@
+package files
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// cacheControl is the Cache-Control header of served files.  A file name is
+// derived from the hash of its content, so its content never changes.
+const cacheControl = "public, max-age=31536000, immutable"
+
+// Metadata contains information about a file used when serving it.
+type Metadata struct {
+	// MimeType is the MIME type of the file, if known.
+	MimeType string `json:"mimeType,omitempty"`
+	// Filename is the name the file is downloaded as, if any.
+	Filename string `json:"filename,omitempty"`
+}
+
+// metadataPath returns the path of the metadata of the file with the given
+// URL hash.  It's hidden, so it's never served or loaded as a file.
+func (fs *FileServer) metadataPath(urlHash string) string {
+	return fmt.Sprintf("./%s/.%s.meta", fs.Directory, urlHash)
+}
+
+// writeMetadata stores the given metadata of the file with the given URL hash,
+// encrypting it if a key is set.  Empty metadata isn't stored.
+func (fs *FileServer) writeMetadata(urlHash string, meta Metadata) error {
+	if meta == (Metadata{}) {
+		return nil
+	}
+
+	bytes, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return fs.writeFile(fs.metadataPath(urlHash), bytes)
+}
+
+// readMetadata returns the stored metadata of the file with the given URL
+// hash, which is empty if none is stored.
+func (fs *FileServer) readMetadata(urlHash string) (Metadata, error) {
+	var meta Metadata
+
+	data, err := ioutil.ReadFile(fs.metadataPath(urlHash))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return meta, nil
+		}
+		return meta, err
+	}
+
+	if data, err = fs.open(data); err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// setHeaders sets the headers of the response serving the file with the given
+// name and metadata.  The ETag is strong, since file names are derived from
+// the hash of their content.
+func setHeaders(w http.ResponseWriter, name string, meta Metadata) {
+	header := w.Header()
+
+	urlHash := name
+	if i := strings.LastIndexByte(name, '.'); i != -1 {
+		urlHash = name[:i]
+	}
+	header.Set("ETag", `"`+urlHash+`"`)
+	header.Set("Cache-Control", cacheControl)
+
+	if meta.MimeType != "" {
+		header.Set("Content-Type", meta.MimeType)
+	}
+	if meta.Filename != "" {
+		disposition := mime.FormatMediaType("inline", map[string]string{
+			"filename": meta.Filename,
+		})
+		if disposition != "" {
+			header.Set("Content-Disposition", disposition)
+		}
+	}
+}
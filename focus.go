@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"whapp-irc/ircconnection"
+	"whapp-irc/types"
+	"whapp-irc/whapp"
+)
+
+// focusTag is the client tag clients can send on a TAGMSG to a chat when its
+// buffer gets focused, or with the value `0` when it loses focus.
+const focusTag = "+whapp-irc/focus"
+
+// getFocus returns the focus state set by the given tags, and whether or not a
+// focus state was set at all.
+func getFocus(tags ircconnection.Tags) (focused, ok bool) {
+	val, has := tags[focusTag]
+	if !has {
+		return false, false
+	}
+	return val != "0", true
+}
+
+// setFocus sets whether or not the chat of the given item is focused in the
+// client of the user.  A chat getting focus is marked as read on WhatsApp, as
+// are new messages in it while it stays focused.
+func (conn *Connection) setFocus(ctx context.Context, item types.ChatListItem, focused bool) error {
+	conn.focusMutex.Lock()
+	if focused {
+		conn.focused = item.ID
+	} else if conn.focused == item.ID {
+		conn.focused = whapp.ID{}
+	}
+	conn.focusMutex.Unlock()
+
+	if !focused {
+		return nil
+	}
+	return conn.markRead(ctx, item)
+}
+
+// clearFocus forgets the focused chat, such as when no client is attached
+// anymore.
+func (conn *Connection) clearFocus() {
+	conn.focusMutex.Lock()
+	conn.focused = whapp.ID{}
+	conn.focusMutex.Unlock()
+}
+
+// markFocusedRead marks the chat of the given new message as read, if it's
+// focused.
+func (conn *Connection) markFocusedRead(ctx context.Context, msg whapp.Message) error {
+	if msg.IsSentByMe {
+		return nil
+	}
+
+	conn.focusMutex.Lock()
+	focused := conn.focused == msg.Chat.ID
+	conn.focusMutex.Unlock()
+	if !focused {
+		return nil
+	}
+
+	item, has := conn.Chats.ByID(msg.Chat.ID, false)
+	if !has {
+		return nil
+	}
+	return conn.markRead(ctx, item)
+}
+
+// markRead marks the chat of the given item as read on WhatsApp, unless in
+// observer or maintenance mode or the user hides their read receipts.
+func (conn *Connection) markRead(ctx context.Context, item types.ChatListItem) error {
+	if item.Chat == nil || conf.ObserverMode || inMaintenance() {
+		return nil
+	} else if conn.getPrivacy().HideReceipts {
+		return nil
+	}
+	return item.Chat.RawChat.SetRead(ctx, conn.WI, true)
+}
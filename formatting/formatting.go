@@ -0,0 +1,119 @@
+package formatting
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Mode is the way WhatsApp formatting markup is handled.
+type Mode int
+
+const (
+	// Raw leaves the WhatsApp markup as is.
+	Raw Mode = iota
+	// Strip removes the WhatsApp markup.
+	Strip
+	// IRC converts the WhatsApp markup to IRC formatting control codes.
+	IRC
+)
+
+type marker struct {
+	marker string
+	code   string
+}
+
+// markers contains the WhatsApp markers and their IRC control codes, in order
+// of precedence.
+var markers = []marker{
+	{"```", "\x11"}, // monospace
+	{"*", "\x02"},   // bold
+	{"_", "\x1d"},   // italic
+	{"~", "\x1e"},   // strikethrough
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// canOpen returns whether or not a marker starting at index i of str, with the
+// given length, can open a formatted span.
+func canOpen(str string, i, length int) bool {
+	if i > 0 {
+		if r, _ := utf8.DecodeLastRuneInString(str[:i]); isWordRune(r) {
+			return false
+		}
+	}
+
+	r, _ := utf8.DecodeRuneInString(str[i+length:])
+	return r != utf8.RuneError && !unicode.IsSpace(r)
+}
+
+// canClose returns whether or not a marker starting at index i of str, with
+// the given length, can close a formatted span.
+func canClose(str string, i, length int) bool {
+	if r, _ := utf8.DecodeLastRuneInString(str[:i]); unicode.IsSpace(r) {
+		return false
+	}
+
+	r, _ := utf8.DecodeRuneInString(str[i+length:])
+	return r == utf8.RuneError || !isWordRune(r)
+}
+
+// findSpan finds the formatted span starting at index i of str, and returns
+// its marker and the index of the closing marker.
+func findSpan(str string, i int) (m marker, end int, found bool) {
+	for _, m := range markers {
+		length := len(m.marker)
+		if !strings.HasPrefix(str[i:], m.marker) || !canOpen(str, i, length) {
+			continue
+		}
+
+		for j := i + length + 1; j+length <= len(str); j++ {
+			// inline markup doesn't span multiple lines, code blocks do.
+			if str[j-1] == '\n' && m.marker != "```" {
+				break
+			}
+
+			if strings.HasPrefix(str[j:], m.marker) && canClose(str, j, length) {
+				return m, j, true
+			}
+		}
+	}
+
+	return marker{}, 0, false
+}
+
+// Convert handles the WhatsApp formatting markup in the given string using the
+// given mode.
+func Convert(str string, mode Mode) string {
+	if mode == Raw {
+		return str
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(str); {
+		m, end, found := findSpan(str, i)
+		if !found {
+			b.WriteByte(str[i])
+			i++
+			continue
+		}
+
+		inner := str[i+len(m.marker) : end]
+		if m.marker != "```" {
+			// markup isn't applied inside of code.
+			inner = Convert(inner, mode)
+		}
+
+		if mode == IRC {
+			b.WriteString(m.code + inner + m.code)
+		} else {
+			b.WriteString(inner)
+		}
+
+		i = end + len(m.marker)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,40 @@
+package formatting
+
+import "testing"
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		irc   string
+		strip string
+	}{
+		{"plain", "hello world", "hello world", "hello world"},
+		{"bold", "*hi* there", "\x02hi\x02 there", "hi there"},
+		{"italic", "_hi_", "\x1dhi\x1d", "hi"},
+		{"strikethrough", "~hi~", "\x1ehi\x1e", "hi"},
+		{"monospace", "```x := 1```", "\x11x := 1\x11", "x := 1"},
+
+		{"nested", "*bold _both_*", "\x02bold \x1dboth\x1d\x02", "bold both"},
+		{"nested at the start", "_*both* italic_", "\x1d\x02both\x02 italic\x1d", "both italic"},
+		{"overlapping", "*a _b* c_", "\x02a _b\x02 c_", "a _b c_"},
+		{"markup in code", "```*not bold*```", "\x11*not bold*\x11", "*not bold*"},
+
+		{"unclosed", "*not bold", "*not bold", "*not bold"},
+		{"inside words", "snake_case_name", "snake_case_name", "snake_case_name"},
+		{"multiplication", "2 * 3 * 4", "2 * 3 * 4", "2 * 3 * 4"},
+		{"spanning lines", "*not\nbold*", "*not\nbold*", "*not\nbold*"},
+	}
+
+	for _, test := range tests {
+		if got := Convert(test.input, Raw); got != test.input {
+			t.Errorf("%s: raw: got %q, want %q", test.name, got, test.input)
+		}
+		if got := Convert(test.input, IRC); got != test.irc {
+			t.Errorf("%s: irc: got %q, want %q", test.name, got, test.irc)
+		}
+		if got := Convert(test.input, Strip); got != test.strip {
+			t.Errorf("%s: strip: got %q, want %q", test.name, got, test.strip)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+	"whapp-irc/util"
+
+	// register the image formats accepted as chat icon.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+const (
+	// the maximum size of an image downloaded to be used as chat icon.
+	maxIconSize = 10 << 20
+	// the maximum amount of pixels of an image used as chat icon, so that a
+	// small but highly compressed image can't exhaust memory when decoded.
+	maxIconPixels = 50 << 20
+	// the maximum time downloading an image used as chat icon may take.
+	iconDownloadTimeout = 30 * time.Second
+)
+
+// iconClient is the HTTP client used to download images used as chat icon.
+var iconClient = &http.Client{Timeout: iconDownloadTimeout}
+
+// downloadImage downloads the image at the given URL and decodes it.
+func downloadImage(ctx context.Context, url string) (image.Image, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := iconClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", res.Status)
+	} else if res.ContentLength > maxIconSize {
+		str := util.FormatSize(maxIconSize)
+		return nil, fmt.Errorf("image is larger than %s", str)
+	}
+
+	raw, err := ioutil.ReadAll(io.LimitReader(res.Body, maxIconSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(raw) > maxIconSize {
+		str := util.FormatSize(maxIconSize)
+		return nil, fmt.Errorf("image is larger than %s", str)
+	}
+
+	ext := util.GetExtensionByMimeOrBytes(res.Header.Get("Content-Type"), raw)
+	if !strings.HasPrefix(mime.TypeByExtension("."+ext), "image/") {
+		return nil, fmt.Errorf("not an image")
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	} else if config.Width*config.Height > maxIconPixels {
+		return nil, fmt.Errorf("image is too large (%dx%d)", config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	return img, err
+}
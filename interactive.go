@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"whapp-irc/whapp"
+)
+
+// interactiveOptions are the options of the last interactive message received
+// in a chat.
+type interactiveOptions struct {
+	messageID string
+	options   []string
+}
+
+// formatInteractive returns the text of the given interactive message, followed
+// by a numbered line for every option.
+func formatInteractive(data whapp.InteractiveData) string {
+	var lines []string
+	for _, text := range []string{data.Header, data.Body, data.Footer} {
+		if text = strings.TrimSpace(text); text != "" {
+			lines = append(lines, text)
+		}
+	}
+
+	for i, option := range data.Options {
+		lines = append(lines, fmt.Sprintf("[%d] %s", i+1, option))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// parseOptionReply returns the option number in the given body, if the body
+// is of the form `!reply N`.
+func parseOptionReply(body string) (int, bool) {
+	fields := strings.Fields(body)
+	if len(fields) != 2 || strings.ToLower(fields[0]) != "!reply" {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// setInteractiveOptions sets the given options, of the interactive message with
+// the given serialized ID, as the options that can be replied with in the chat
+// with the given ID.
+func (conn *Connection) setInteractiveOptions(chatID whapp.ID, messageID string, options []string) {
+	conn.interactiveMutex.Lock()
+	defer conn.interactiveMutex.Unlock()
+
+	if conn.interactiveOptions == nil {
+		conn.interactiveOptions = make(map[whapp.ID]interactiveOptions)
+	}
+	conn.interactiveOptions[chatID] = interactiveOptions{messageID, options}
+}
+
+// interactiveOption returns the serialized ID of the last interactive message
+// in the chat with the given ID, and the text of its option with the given
+// (1-based) number.
+func (conn *Connection) interactiveOption(chatID whapp.ID, n int) (messageID, option string, has bool) {
+	conn.interactiveMutex.Lock()
+	defer conn.interactiveMutex.Unlock()
+
+	last, has := conn.interactiveOptions[chatID]
+	if !has || n < 1 || n > len(last.options) {
+		return "", "", false
+	}
+	return last.messageID, last.options[n-1], true
+}
@@ -6,15 +6,59 @@ import (
 	"log"
 	"strings"
 	"time"
+	"whapp-irc/ircconnection"
+	"whapp-irc/types"
 	"whapp-irc/util"
 
-	"gopkg.in/sorcix/irc.v2"
+	"github.com/wangii/emoji"
 	"gopkg.in/sorcix/irc.v2/ctcp"
 )
 
-func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message) error {
-	write := conn.irc.WriteNow
-	status := conn.irc.Status
+// observed returns whether or not whapp-irc is running in observer mode or is
+// in maintenance mode, in which case the given action should not be sent to
+// WhatsApp.  The user is notified of the skipped action.
+func (conn *Connection) observed(action string) bool {
+	if inMaintenance() {
+		log.Println("maintenance mode, not " + action)
+		conn.irc.Notice(time.Now(), "whapp-irc", conn.irc.Nick(), maintenanceNotice)
+		return true
+	} else if !conf.ObserverMode {
+		return false
+	}
+
+	str := "observer mode, not " + action
+	log.Println(str)
+	conn.irc.Status(str)
+	return true
+}
+
+// getReply returns the serialized ID of the WhatsApp message the given body,
+// sent to the given chat, replies to, if any, and the body without the reply
+// marker.
+// Clients supporting message tags can use the `+draft/reply` tag, other
+// clients can prefix the body with `>msgid `.
+func getReply(item types.ChatListItem, tags ircconnection.Tags, body string) (replyID, text string) {
+	for _, key := range []string{"+draft/reply", "+reply"} {
+		if id := tags[key]; id != "" {
+			return id, body
+		}
+	}
+
+	if strings.HasPrefix(body, ">") && item.Chat != nil {
+		if i := strings.IndexByte(body, ' '); i > 1 {
+			if id := body[1:i]; item.Chat.HasMessageID(id) {
+				return id, body[i+1:]
+			}
+		}
+	}
+
+	return "", body
+}
+
+// handleIRCCommand handles the given message sent by the given client.
+func (conn *Connection) handleIRCCommand(ctx context.Context, client *ircconnection.Connection, msg *ircconnection.Message) error {
+	write := client.WriteNow
+	status := client.Status
 
 	switch msg.Command {
 	case "PRIVMSG":
@@ -24,26 +68,93 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 		if tag, text, ok := ctcp.Decode(msg.Trailing()); ok && tag == ctcp.ACTION {
 			body = fmt.Sprintf("_%s_", text)
 		}
+		if conf.EmojiShortcodes {
+			body = emoji.EmojiTagToUnicode(body)
+		}
 
 		util.LogMessage(time.Now(), conn.irc.Nick(), to, body)
 
-		if to == "status" {
-			return nil
+		for _, target := range strings.Split(to, ",") {
+			if strings.EqualFold(target, ircconnection.StatusNick()) {
+				if err := conn.handleStatusCommand(ctx, client, body); err != nil {
+					return err
+				}
+				continue
+			}
+
+			item, has := conn.Chats.ByIdentifier(target, true)
+			if !has {
+				item, has = conn.privateChatByNick(target)
+			}
+			if !has {
+				client.Fail("PRIVMSG", "UNKNOWN_CHAT", "unknown chat", target)
+				continue
+			}
+
+			if item.Chat != nil && isReadOnly(item.Chat) {
+				write(fmt.Sprintf(
+					":whapp-irc 404 %s %s :Cannot send to channel (announcements only)",
+					conn.irc.Nick(),
+					target,
+				))
+				continue
+			}
+
+			if conn.observed("sending message to " + target) {
+				continue
+			}
+
+			conn.resetTyping(item.ID)
+
+			echo := body
+			var err error
+			if n, ok := parseOptionReply(body); ok {
+				replyID, option, has := conn.interactiveOption(item.ID, n)
+				if !has {
+					str := fmt.Sprintf("no option %d to reply with in %s", n, target)
+					client.Fail("PRIVMSG", "UNKNOWN_OPTION", str, target)
+					continue
+				}
+				echo = option
+				err = conn.WI.SendReplyToChatID(ctx, item.ID, option, replyID)
+			} else if replyID, text := getReply(item, msg.Tags, body); replyID != "" {
+				err = conn.WI.SendReplyToChatID(ctx, item.ID, text, replyID)
+			} else {
+				err = conn.WI.SendMessageToChatID(ctx, item.ID, body)
+			}
+			if err != nil {
+				str := fmt.Sprintf("err while sending to %s: %s", target, err)
+				log.Println(str)
+				client.Fail("PRIVMSG", "SEND_FAILED", str, target)
+				continue
+			}
+
+			// let the other clients of the session know about the message.
+			err = conn.irc.Echo(client, time.Now(), target, echo)
+			util.LogIfErr("error while echoing message", err)
 		}
 
-		item, has := conn.Chats.ByIdentifier(to, true)
-		if !has {
-			return status("unknown chat")
+	case "TAGMSG":
+		active, typing := getTyping(msg.Tags)
+		focused, focus := getFocus(msg.Tags)
+		if (!typing && !focus) || len(msg.Params) == 0 {
+			return nil
 		}
 
-		if err := conn.WI.SendMessageToChatID(
-			ctx,
-			item.ID,
-			body,
-		); err != nil {
-			str := fmt.Sprintf("err while sending: %s", err)
-			log.Println(str)
-			return status(str)
+		for _, target := range strings.Split(msg.Params[0], ",") {
+			item, has := conn.Chats.ByIdentifier(target, false)
+			if !has {
+				continue
+			}
+
+			if typing {
+				err := conn.sendTyping(ctx, item, active)
+				util.LogIfErr("error while sending typing state", err)
+			}
+			if focus {
+				err := conn.setFocus(ctx, item, focused)
+				util.LogIfErr("error while setting focus", err)
+			}
 		}
 
 	case "JOIN":
@@ -51,11 +162,12 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 		for _, ident := range idents {
 			item, has := conn.Chats.ByIdentifier(ident, true)
 			if !has {
-				return status("chat not found: " + msg.Params[0])
+				return client.Fail("JOIN", "UNKNOWN_CHAT", "chat not found", ident)
 			}
 
-			if err := conn.joinChat(item); err != nil {
-				return status("error while joining: " + err.Error())
+			if err := conn.joinChat(item, time.Now()); err != nil {
+				str := "error while joining: " + err.Error()
+				return client.Fail("JOIN", "JOIN_FAILED", str, ident)
 			}
 		}
 
@@ -64,7 +176,7 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 		for _, ident := range idents {
 			item, has := conn.Chats.ByIdentifier(ident, false)
 			if !has {
-				return status("unknown chat")
+				return client.Fail("PART", "UNKNOWN_CHAT", "unknown chat", ident)
 			}
 
 			item.Chat.Joined = false
@@ -81,7 +193,7 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 
 		item, has := conn.Chats.ByIdentifier(ident, false)
 		if !has {
-			return status("chat not found")
+			return client.Fail("MODE", "UNKNOWN_CHAT", "chat not found", ident)
 		}
 
 		var op bool
@@ -100,6 +212,14 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 				continue
 			}
 
+			if !isAdmin(item.Chat) {
+				return client.Fail("MODE", "CHANOPRIVSNEEDED", "You are not a group admin", ident)
+			}
+
+			if conn.observed(fmt.Sprintf("setting mode %s %s on %s", mode, nick, ident)) {
+				return nil
+			}
+
 			if err := item.Chat.RawChat.SetAdmin(
 				ctx,
 				conn.WI,
@@ -108,7 +228,7 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 			); err != nil {
 				str := fmt.Sprintf("error while opping %s: %s", nick, err)
 				log.Println(str)
-				return status(str)
+				return client.Fail("MODE", "MODE_FAILED", str, ident, nick)
 			}
 
 			return write(fmt.Sprintf(":%s MODE %s +o %s", conn.irc.Nick(), ident, nick))
@@ -118,7 +238,7 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 		// TODO: support args
 		for _, item := range conn.Chats.List(false) {
 			nParticipants := len(item.Chat.Participants)
-			if !item.Chat.IsGroupChat {
+			if item.Chat.IsPrivate() {
 				nParticipants = 2
 			}
 
@@ -136,8 +256,13 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 	case "WHO":
 		identifier := msg.Params[0]
 		item, has := conn.Chats.ByIdentifier(identifier, false)
-		if has && item.Chat.IsGroupChat {
-			for _, p := range item.Chat.Participants {
+		if has && item.Chat.IsChannel() {
+			participants, capped := listedParticipants(item.Chat)
+			if capped {
+				status(cappedListMessage(item, len(participants)))
+			}
+
+			for _, p := range participants {
 				if p.Contact.IsMe {
 					continue
 				}
@@ -167,22 +292,42 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 		write(fmt.Sprintf(":whapp-irc 315 %s %s :End of /WHO list.", conn.irc.Nick(), identifier))
 
 	case "WHOIS": // TODO: fix
-		item, _ := conn.Chats.ByIdentifier(msg.Params[0], false)
-		chat := item.Chat
-
-		if chat == nil || chat.IsGroupChat {
+		item, has := conn.privateChatByNick(msg.Params[0])
+		if !has {
 			return write(fmt.Sprintf(":whapp-irc 401 %s %s :No such nick/channel", conn.irc.Nick(), msg.Params[0]))
 		}
+		chat := item.Chat
+		nick := contactNick(item)
 
 		str := fmt.Sprintf(
 			":whapp-irc 311 %s %s ~%s whapp-irc * :%s",
 			conn.irc.Nick(),
-			item.Identifier,
-			item.Identifier,
+			nick,
+			nick,
 			chat.Name,
 		)
 		write(str)
 
+		// WhatsApp doesn't share the presence of blocked contacts.
+		if conn.isBlocked(ctx, chat.ID) {
+			write(fmt.Sprintf(":whapp-irc 320 %s %s :is blocked", conn.irc.Nick(), nick))
+		} else if presence, err := chat.RawChat.GetPresence(ctx, conn.WI); err != nil {
+			log.Printf("error while retrieving presence: %s\n", err)
+		} else if lastSeen, ok := presence.LastSeenTime(); ok {
+			idle := time.Since(lastSeen)
+			if idle < 0 {
+				idle = 0
+			}
+
+			str := fmt.Sprintf(
+				":whapp-irc 317 %s %s %d :seconds idle",
+				conn.irc.Nick(),
+				nick,
+				int64(idle/time.Second),
+			)
+			write(str)
+		}
+
 		if groups, err := chat.RawChat.Contact.GetCommonGroups(
 			ctx,
 			conn.WI,
@@ -201,13 +346,38 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 			str := fmt.Sprintf(
 				":whapp-irc 319 %s %s :%s",
 				conn.irc.Nick(),
-				item.Identifier,
+				nick,
 				strings.Join(names, " "),
 			)
 			write(str)
 		}
 
-		write(fmt.Sprintf(":whapp-irc 318 %s %s :End of /WHOIS list.", conn.irc.Nick(), item.Identifier))
+		write(fmt.Sprintf(":whapp-irc 318 %s %s :End of /WHOIS list.", conn.irc.Nick(), nick))
+
+	case "WHOWAS":
+		nick := msg.Params[0]
+
+		entries := conn.findDepartures(nick)
+		if len(entries) == 0 {
+			write(fmt.Sprintf(":whapp-irc 406 %s %s :There was no such nickname", conn.irc.Nick(), nick))
+		}
+		for _, entry := range entries {
+			write(fmt.Sprintf(
+				":whapp-irc 314 %s %s ~%s whapp-irc * :%s",
+				conn.irc.Nick(),
+				entry.nick,
+				entry.nick,
+				entry.realname,
+			))
+			write(fmt.Sprintf(
+				":whapp-irc 312 %s %s whapp-irc :left %s at %s",
+				conn.irc.Nick(),
+				entry.nick,
+				entry.channel,
+				entry.left.Format("2006-01-02 15:04:05"),
+			))
+		}
+		write(fmt.Sprintf(":whapp-irc 369 %s %s :End of WHOWAS", conn.irc.Nick(), nick))
 
 	case "KICK":
 		chatIdentifier := msg.Params[0]
@@ -228,6 +398,14 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 				continue
 			}
 
+			if !isAdmin(item.Chat) {
+				return client.Fail("KICK", "CHANOPRIVSNEEDED", "You are not a group admin", chatIdentifier)
+			}
+
+			if conn.observed(fmt.Sprintf("kicking %s from %s", nick, chatIdentifier)) {
+				return nil
+			}
+
 			if err := item.Chat.RawChat.RemoveParticipant(
 				ctx,
 				conn.WI,
@@ -235,12 +413,32 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 			); err != nil {
 				str := fmt.Sprintf("error while kicking %s: %s", nick, err)
 				log.Println(str)
-				return status(str)
+				return client.Fail("KICK", "KICK_FAILED", str, chatIdentifier, nick)
 			}
 
 			return nil
 		}
 
+	case "AWAY":
+		message := ""
+		if len(msg.Params) > 0 {
+			message = strings.TrimSpace(msg.Params[0])
+		}
+
+		if message == "" {
+			write(fmt.Sprintf(":whapp-irc 305 %s :You are no longer marked as being away", conn.irc.Nick()))
+		} else {
+			write(fmt.Sprintf(":whapp-irc 306 %s :You have been marked as being away", conn.irc.Nick()))
+		}
+
+		if conf.AwayAbout {
+			if err := conn.syncAway(ctx, message); err != nil {
+				str := "error while updating about: " + err.Error()
+				log.Println(str)
+				return client.Fail("AWAY", "ABOUT_FAILED", str)
+			}
+		}
+
 	case "INVITE":
 		nick := msg.Params[0]
 		chatIdentifier := msg.Params[1]
@@ -254,8 +452,8 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 			)
 			return write(str)
 		}
-		personChatInfo, has := conn.Chats.ByIdentifier(nick, false)
-		if !has || personChatInfo.Chat.IsGroupChat {
+		personChatInfo, has := conn.privateChatByNick(nick)
+		if !has {
 			str := fmt.Sprintf(
 				":whapp-irc 401 %s %s :No such nick/channel",
 				conn.irc.Nick(),
@@ -264,6 +462,14 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 			return write(str)
 		}
 
+		if !isAdmin(item.Chat) {
+			return client.Fail("INVITE", "CHANOPRIVSNEEDED", "You are not a group admin", chatIdentifier)
+		}
+
+		if conn.observed(fmt.Sprintf("inviting %s to %s", nick, chatIdentifier)) {
+			return nil
+		}
+
 		if err := item.Chat.RawChat.AddParticipant(
 			ctx,
 			conn.WI,
@@ -271,7 +477,7 @@ func (conn *Connection) handleIRCCommand(ctx context.Context, msg *irc.Message)
 		); err != nil {
 			str := fmt.Sprintf("error while adding %s: %s", nick, err)
 			log.Println(str)
-			return status(str)
+			return client.Fail("INVITE", "INVITE_FAILED", str, nick, chatIdentifier)
 		}
 	}
 
@@ -0,0 +1,78 @@
+package ircconnection
+
+import (
+	"fmt"
+	"strings"
+)
+
+// supportedCaps contains the capabilities supported by whapp-irc, with the
+// values advertised to clients negotiating CAP version 302 or later.
+var supportedCaps = []struct {
+	name, value string
+}{
+	{"server-time", ""},
+	{"message-tags", ""},
+	{"echo-message", ""},
+	{"setname", ""},
+	{"standard-replies", ""},
+	{"sasl", ""},
+	{"whapp-irc/replay", ""},
+}
+
+// maxCapLineLength is the maximum length of a CAP LS reply line, excluding the
+// line ending.
+const maxCapLineLength = 510
+
+// sendCapLS sends the supported capabilities to the client, which requested
+// them using the given CAP version.  From version 302 on, capability values
+// are included and the list is split over multiple lines if it doesn't fit on
+// one, every line but the last being marked with `*`.
+func (conn *Connection) sendCapLS(version int) error {
+	var tokens []string
+	for _, c := range supportedCaps {
+		value := c.value
+		if c.name == "sasl" {
+			// the mechanisms depend on the connection.
+			value = strings.Join(conn.saslMechanisms(), ",")
+		}
+
+		token := c.name
+		if version >= 302 && value != "" {
+			token += "=" + value
+		}
+		tokens = append(tokens, token)
+	}
+
+	prefix := fmt.Sprintf(":whapp-irc CAP %s LS ", conn.nickOrStar())
+	if version < 302 {
+		return conn.WriteNow(prefix + ":" + strings.Join(tokens, " "))
+	}
+
+	limit := maxCapLineLength - len(prefix) - len("* :")
+	var lines []string
+	line := ""
+	for _, token := range tokens {
+		if line != "" && len(line)+1+len(token) > limit {
+			lines = append(lines, line)
+			line = ""
+		}
+
+		if line != "" {
+			line += " "
+		}
+		line += token
+	}
+	lines = append(lines, line)
+
+	for i, line := range lines {
+		str := prefix + ":" + line
+		if i < len(lines)-1 {
+			str = prefix + "* :" + line
+		}
+
+		if err := conn.WriteNow(str); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,11 +1,16 @@
 package ircconnection
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,37 +23,119 @@ import (
 
 const queueSize = 10
 
+// the maximum lengths of the message tags of a line received from the client,
+// including the leading `@` and the trailing space, and of the rest of the
+// line, including the CRLF.
+const (
+	maxTagsLength    = 8191
+	maxMessageLength = 512
+)
+
+// errLineTooLong is returned by readLine when the message tags or the rest of
+// the line read are too long.
+var errLineTooLong = errors.New("line too long")
+
+// capNegotiationTimeout is the time after which capability negotiation is
+// finished with the requested capabilities, if the client hasn't sent CAP END
+// by then.  It's a variable so that tests can shorten it.
+var capNegotiationTimeout = 5 * time.Second
+
+// DefaultTimeFormat is the default format used for the server-time tag.
+const DefaultTimeFormat = "2006-01-02T15:04:05.000Z"
+
+var timeFormat = DefaultTimeFormat
+
+// SetTimeFormat sets the format used for the server-time tag.
+func SetTimeFormat(format string) {
+	timeFormat = format
+}
+
+var keepAlivePeriod time.Duration
+
+// SetKeepAlive sets the TCP keepalive period of new connections, 0 disables
+// keepalive.
+func SetKeepAlive(period time.Duration) {
+	keepAlivePeriod = period
+}
+
+var tlsConfig *tls.Config
+
+// SetTLSConfig sets the TLS configuration new connections are served with,
+// nil disables TLS.
+func SetTLSConfig(config *tls.Config) {
+	tlsConfig = config
+}
+
+// DefaultStatusNick is the default nick service messages are sent from.
+const DefaultStatusNick = "status"
+
+var statusNick = DefaultStatusNick
+
+// SetStatusNick sets the nick service messages are sent from.
+func SetStatusNick(nick string) {
+	statusNick = nick
+}
+
+// StatusNick returns the nick service messages are sent from.
+func StatusNick() string {
+	return statusNick
+}
+
 // Connection represents an IRC connection.
 type Connection struct {
 	Caps *capabilities.Map
 
-	receiveCh chan *irc.Message
+	receiveCh chan *Message
 	passCh    chan interface{}
 
 	ctx     context.Context
 	emitter *emitter.Emitter
 
-	nick string
-	pass string
+	nick     string
+	pass     string
+	passOnce sync.Once
+
+	saslMechanism string
+	// account is the account the client authenticated as using SASL
+	// EXTERNAL, if any.
+	account string
 
-	irc *irc.Conn
+	socket net.Conn
+	irc    *irc.Conn
 }
 
 // HandleConnection wraps around the given socket connection, which you
 // shouldn't use after providing it.  It will then handle all the IRC connection
 // stuff for you.  You should interface with it using it's methods.
 func HandleConnection(ctx context.Context, socket *net.TCPConn) *Connection {
+	// let the OS detect peers that are gone without closing the connection.
+	err := socket.SetKeepAlive(keepAlivePeriod > 0)
+	if err == nil && keepAlivePeriod > 0 {
+		err = socket.SetKeepAlivePeriod(keepAlivePeriod)
+	}
+	util.LogIfErr("error while setting TCP keepalive", err)
+
+	if tlsConfig != nil {
+		return handleConnection(ctx, tls.Server(socket, tlsConfig))
+	}
+	return handleConnection(ctx, socket)
+}
+
+// handleConnection wraps around the given socket connection, see
+// HandleConnection.
+func handleConnection(ctx context.Context, socket net.Conn) *Connection {
 	ctx, cancel := context.WithCancel(ctx)
 	conn := &Connection{
 		Caps: capabilities.MakeMap(),
 
-		receiveCh: make(chan *irc.Message, queueSize),
+		receiveCh: make(chan *Message, queueSize),
 		passCh:    make(chan interface{}),
 
 		ctx:     ctx,
 		emitter: &emitter.Emitter{},
 
-		irc: irc.NewConn(socket),
+		socket: socket,
+		irc:    irc.NewConn(socket),
 	}
 
 	// close irc connection when context ends
@@ -64,16 +151,39 @@ func HandleConnection(ctx context.Context, socket *net.TCPConn) *Connection {
 		defer close(conn.receiveCh)
 		defer cancel()
 
-		var passOnce sync.Once
+		// we read and parse the lines ourselves instead of using the irc
+		// package's decoder, since it doesn't support message tags.
+		reader := bufio.NewReaderSize(socket, maxTagsLength+maxMessageLength)
+
+		// capTimer finishes capability negotiation if the client never sends
+		// CAP END, it's stopped when it does or when the connection closes.
+		var capTimer *time.Timer
+		defer func() {
+			if capTimer != nil {
+				capTimer.Stop()
+			}
+		}()
 
 		for {
-			msg, err := conn.irc.Decode()
-			if err == io.EOF { // connection closed
+			line, err := readLine(reader)
+			if err == errLineTooLong {
+				// the rest of the line has been discarded, so we can just
+				// tell the client and continue with the next line.
+				log.Println("got too long IRC message, ignoring")
+				if err := conn.writeNumeric("417", "Input line was too long"); err != nil {
+					log.Printf("error while sending ERR_INPUTTOOLONG: %s", err)
+					return
+				}
+				continue
+			} else if err == io.EOF { // connection closed
 				return
 			} else if err != nil { // socket error
 				log.Printf("error while listening for IRC messages: %s\n", err)
 				return
-			} else if msg == nil { // invalid message
+			}
+
+			msg := parseMessage(line)
+			if msg == nil { // invalid message
 				log.Println("got invalid IRC message, ignoring")
 				continue
 			}
@@ -93,17 +203,33 @@ func HandleConnection(ctx context.Context, socket *net.TCPConn) *Connection {
 				conn.setNick(msg.Params[0])
 
 			case "PASS":
-				conn.pass = ""
+				pass := ""
 				if len(msg.Params) > 0 {
-					conn.pass = msg.Params[0]
+					pass = msg.Params[0]
 				}
-				passOnce.Do(func() { close(conn.passCh) })
+				conn.setPass(pass)
+
+			case "AUTHENTICATE":
+				conn.handleAuthenticate(msg)
 
 			case "CAP":
-				conn.Caps.StartNegotiation()
+				if conn.Caps.StartNegotiation() {
+					capTimer = time.AfterFunc(capNegotiationTimeout, func() {
+						if conn.Caps.FinishNegotiation() {
+							log.Printf("no CAP END received from %s, finishing negotiation", conn.Nick())
+						}
+					})
+				}
 				switch msg.Params[0] {
 				case "LS":
-					conn.WriteNow(":whapp-irc CAP * LS :server-time whapp-irc/replay")
+					// clients not sending a version use version 301.
+					version := 301
+					if len(msg.Params) > 1 {
+						if v, err := strconv.Atoi(msg.Params[1]); err == nil {
+							version = v
+						}
+					}
+					conn.sendCapLS(version)
 
 				case "LIST":
 					caps := conn.Caps.List()
@@ -118,6 +244,9 @@ func HandleConnection(ctx context.Context, socket *net.TCPConn) *Connection {
 
 				case "END":
 					conn.Caps.FinishNegotiation()
+					if capTimer != nil {
+						capTimer.Stop()
+					}
 				}
 
 			default:
@@ -129,16 +258,74 @@ func HandleConnection(ctx context.Context, socket *net.TCPConn) *Connection {
 	return conn
 }
 
+// readLine reads a line from the given reader.  If its message tags are longer
+// than maxTagsLength or the rest of it is longer than maxMessageLength, the
+// line is discarded and errLineTooLong is returned.
+func readLine(reader *bufio.Reader) (string, error) {
+	line, isPrefix, err := reader.ReadLine()
+	if err != nil {
+		return "", err
+	} else if !isPrefix {
+		return string(line), checkLineLength(line)
+	}
+
+	for isPrefix {
+		if _, isPrefix, err = reader.ReadLine(); err != nil {
+			return "", err
+		}
+	}
+	return "", errLineTooLong
+}
+
+// checkLineLength returns errLineTooLong if the message tags or the rest of the
+// given line, without its line ending, are too long.
+func checkLineLength(line []byte) error {
+	message := line
+	if len(line) > 0 && line[0] == '@' {
+		i := bytes.IndexByte(line, ' ')
+		if i == -1 {
+			i = len(line) - 1
+		}
+		if i+1 > maxTagsLength {
+			return errLineTooLong
+		}
+		message = line[i+1:]
+	}
+
+	if len(message)+len("\r\n") > maxMessageLength {
+		return errLineTooLong
+	}
+	return nil
+}
+
+// write writes the given message to the given irc.Conn, which terminates it
+// with CRLF itself.
 func write(w io.Writer, msg string) error {
-	_, err := w.Write([]byte(msg + "\n"))
+	_, err := w.Write([]byte(msg))
 	return err
 }
 
 // Write writes the given message with the given timestamp to the connection
 func (conn *Connection) Write(time time.Time, msg string) error {
+	return conn.WriteTags(time, nil, msg)
+}
+
+// WriteTags writes the given message with the given timestamp and message tags
+// to the connection.  The tags are only sent when the client negotiated
+// message-tags.
+func (conn *Connection) WriteTags(time time.Time, tags Tags, msg string) error {
+	allTags := make(Tags)
+	if conn.Caps.Has("message-tags") {
+		for key, val := range tags {
+			allTags[key] = val
+		}
+	}
 	if conn.Caps.Has("server-time") {
-		timeFormat := time.UTC().Format("2006-01-02T15:04:05.000Z")
-		msg = fmt.Sprintf("@time=%s %s", timeFormat, msg)
+		allTags["time"] = time.UTC().Format(timeFormat)
+	}
+
+	if len(allTags) > 0 {
+		msg = fmt.Sprintf("@%s %s", allTags, msg)
 	}
 
 	if err := write(conn.irc, msg); err != nil {
@@ -168,15 +355,91 @@ func (conn *Connection) WriteListNow(messages []string) error {
 // PrivateMessage sends the given line as a private message from from, to to, on
 // the the given date.
 func (conn *Connection) PrivateMessage(date time.Time, from, to, line string) error {
+	return conn.PrivateMessageTags(date, nil, from, to, line)
+}
+
+// PrivateMessageTags sends the given line as a private message from from, to
+// to, on the the given date, with the given message tags.
+func (conn *Connection) PrivateMessageTags(date time.Time, tags Tags, from, to, line string) error {
 	util.LogMessage(date, from, to, line)
 	msg := formatPrivateMessage(from, to, line)
+	return conn.WriteTags(date, tags, msg)
+}
+
+// TagMessage sends a TAGMSG with the given message tags from from, to to, on
+// the given date, if the client negotiated message-tags.
+func (conn *Connection) TagMessage(date time.Time, tags Tags, from, to string) error {
+	if !conn.Caps.Has("message-tags") {
+		return nil
+	}
+	return conn.WriteTags(date, tags, formatTagMessage(from, to))
+}
+
+// Notice sends the given line as a notice from from, to to, on the given date.
+func (conn *Connection) Notice(date time.Time, from, to, line string) error {
+	util.LogMessage(date, from, to, line)
+	msg := formatNotice(from, to, line)
 	return conn.Write(date, msg)
 }
 
+// SetName notifies the client that the realname of the user changed to the
+// given name, if the client negotiated setname.
+func (conn *Connection) SetName(name string) error {
+	if !conn.Caps.Has("setname") {
+		return nil
+	}
+	return conn.WriteNow(fmt.Sprintf(":%s SETNAME :%s", conn.nick, name))
+}
+
+// standardReply sends an IRCv3 standard reply of the given type (FAIL, WARN or
+// NOTE) about the given command, if the client negotiated standard-replies.
+// Otherwise the description is sent as a notice from 'status'.
+func (conn *Connection) standardReply(typ, command, code, description string, context []string) error {
+	if !conn.Caps.Has("standard-replies") {
+		line := fmt.Sprintf("%s: %s", command, description)
+		return conn.Notice(time.Now(), statusNick, conn.nick, line)
+	}
+
+	params := append([]string{typ, command, code}, context...)
+	return conn.WriteNow(fmt.Sprintf(
+		":whapp-irc %s :%s",
+		strings.Join(params, " "),
+		description,
+	))
+}
+
+// Fail reports that the given command failed, with the given machine readable
+// code, human readable description and context (such as the channel the
+// command was sent to).
+func (conn *Connection) Fail(command, code, description string, context ...string) error {
+	return conn.standardReply("FAIL", command, code, description, context)
+}
+
+// Warn reports a non-fatal problem with the given command, see Fail.
+func (conn *Connection) Warn(command, code, description string, context ...string) error {
+	return conn.standardReply("WARN", command, code, description, context)
+}
+
+// Note reports information about the given command, see Fail.
+func (conn *Connection) Note(command, code, description string, context ...string) error {
+	return conn.standardReply("NOTE", command, code, description, context)
+}
+
 // Status writes the given message as if sent by 'status' to the current
 // connection.
 func (conn *Connection) Status(body string) error {
-	return conn.PrivateMessage(time.Now(), "status", conn.nick, body)
+	return conn.PrivateMessage(time.Now(), statusNick, conn.nick, body)
+}
+
+// StatusList writes the given messages as if sent by 'status' to the current
+// connection.
+func (conn *Connection) StatusList(bodies []string) error {
+	for _, body := range bodies {
+		if err := conn.Status(body); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // setNick sets the current connection's nickname to the given new nick, and
@@ -186,6 +449,13 @@ func (conn *Connection) setNick(nick string) {
 	<-conn.emitter.Emit("nick", nick)
 }
 
+// setPass sets the current connection's password to the given pass, and
+// notifies any listeners.
+func (conn *Connection) setPass(pass string) {
+	conn.pass = pass
+	conn.passOnce.Do(func() { close(conn.passCh) })
+}
+
 // Nick returns the nickname of the user at the other end of the current
 // connection.
 func (conn *Connection) Nick() string {
@@ -198,8 +468,21 @@ func (conn *Connection) Pass() string {
 	return conn.pass
 }
 
+// SetPass replaces the password of the current connection with the given one,
+// such as with the stored password of the account the client authenticated as
+// using SASL EXTERNAL.  It doesn't notify listeners.
+func (conn *Connection) SetPass(pass string) {
+	conn.pass = pass
+}
+
+// Account returns the account the user at the other end of the current
+// connection authenticated as using SASL EXTERNAL, or an empty string.
+func (conn *Connection) Account() string {
+	return conn.account
+}
+
 // ReceiveChannel returns the channel where new messages are sent on.
-func (conn *Connection) ReceiveChannel() <-chan *irc.Message {
+func (conn *Connection) ReceiveChannel() <-chan *Message {
 	return conn.receiveCh
 }
 
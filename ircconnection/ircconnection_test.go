@@ -0,0 +1,117 @@
+package ircconnection
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTimeout is the maximum time tests wait for the connection to respond.
+const testTimeout = 5 * time.Second
+
+// pipeConnection returns a connection handling one end of a net.Pipe, and the
+// other end of it.
+func pipeConnection(t *testing.T) (conn *Connection, client net.Conn, cancel func()) {
+	server, client := net.Pipe()
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	return handleConnection(ctx, server), client, func() {
+		cancelCtx()
+		client.Close()
+	}
+}
+
+// expectReceived returns the next message received by the given connection.
+func expectReceived(t *testing.T, conn *Connection) *Message {
+	select {
+	case msg, ok := <-conn.ReceiveChannel():
+		if !ok {
+			t.Fatal("connection closed")
+		}
+		return msg
+	case <-time.After(testTimeout):
+		t.Fatal("no message received")
+	}
+	return nil
+}
+
+func TestCheckLineLength(t *testing.T) {
+	tags := "@" + strings.Repeat("a", maxTagsLength-2) + " "
+	message := "PRIVMSG #chat :" + strings.Repeat("x", maxMessageLength-len("PRIVMSG #chat :\r\n"))
+
+	tests := []struct {
+		name    string
+		line    string
+		tooLong bool
+	}{
+		{"short", "PRIVMSG #chat :hi", false},
+		{"longest message", message, false},
+		{"message too long", message + "x", true},
+		{"longest tags", tags + message, false},
+		{"tags too long", "@a" + tags[1:] + "PRIVMSG #chat :hi", true},
+		{"tags without message", "@" + strings.Repeat("a", maxTagsLength), true},
+	}
+
+	for _, test := range tests {
+		err := checkLineLength([]byte(test.line))
+		if tooLong := err == errLineTooLong; tooLong != test.tooLong {
+			t.Errorf("%s: checkLineLength returned %v, too long expected: %t", test.name, err, test.tooLong)
+		}
+	}
+}
+
+func TestOversizedLine(t *testing.T) {
+	conn, client, cancel := pipeConnection(t)
+	defer cancel()
+
+	go func() {
+		client.Write([]byte("PRIVMSG #a :" + strings.Repeat("x", 2048) + "\r\n"))
+		client.Write([]byte("PRIVMSG #b :hi\r\n"))
+	}()
+
+	client.SetReadDeadline(time.Now().Add(testTimeout))
+	reader := bufio.NewReader(client)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("error while reading response: %s", err)
+	} else if !strings.Contains(line, " 417 ") {
+		t.Fatalf("expected ERR_INPUTTOOLONG, got %q", line)
+	}
+	go io.Copy(ioutil.Discard, reader)
+
+	msg := expectReceived(t, conn)
+	if msg.Command != "PRIVMSG" || msg.Params[0] != "#b" || msg.Trailing() != "hi" {
+		t.Errorf("expected the next command to be parsed, got %s %v", msg.Command, msg.Params)
+	}
+}
+
+func TestCapNegotiationNeverEnds(t *testing.T) {
+	defer func(timeout time.Duration) { capNegotiationTimeout = timeout }(capNegotiationTimeout)
+	capNegotiationTimeout = 50 * time.Millisecond
+
+	conn, client, cancel := pipeConnection(t)
+	defer cancel()
+
+	go client.Write([]byte("CAP REQ :server-time\r\n"))
+	client.SetReadDeadline(time.Now().Add(testTimeout))
+	reader := bufio.NewReader(client)
+	if line, err := reader.ReadString('\n'); err != nil {
+		t.Fatalf("error while reading response: %s", err)
+	} else if !strings.Contains(line, " ACK ") {
+		t.Fatalf("expected CAP ACK, got %q", line)
+	}
+	go io.Copy(ioutil.Discard, reader)
+
+	// the client never sends CAP END.
+	ctx, cancelWait := context.WithTimeout(context.Background(), testTimeout)
+	defer cancelWait()
+	if started, ok := conn.Caps.WaitNegotiation(ctx); !started || !ok {
+		t.Fatalf("negotiation not finished, started: %t", started)
+	} else if !conn.Caps.Has("server-time") {
+		t.Errorf("requested capability not negotiated, got %v", conn.Caps.List())
+	}
+}
@@ -0,0 +1,162 @@
+package ircconnection
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+var externalAccounts map[string]string
+
+// SetExternalAccounts sets the accounts clients authenticate as using SASL
+// EXTERNAL, by the SHA-256 fingerprint, in lowercase hex, of their TLS client
+// certificate.
+func SetExternalAccounts(accounts map[string]string) {
+	externalAccounts = accounts
+}
+
+// saslMechanisms returns the SASL mechanisms supported on the current
+// connection.  EXTERNAL is only offered on TLS connections when accounts are
+// configured for it, clients fall back to PLAIN otherwise.
+func (conn *Connection) saslMechanisms() []string {
+	if _, ok := conn.socket.(*tls.Conn); ok && len(externalAccounts) > 0 {
+		return []string{"EXTERNAL", "PLAIN"}
+	}
+	return []string{"PLAIN"}
+}
+
+// peerFingerprint returns the SHA-256 fingerprint, in lowercase hex, of the
+// TLS client certificate of the current connection, or an empty string if the
+// client didn't present one.
+func (conn *Connection) peerFingerprint() string {
+	tlsConn, ok := conn.socket.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(certs[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeNumeric writes the given numeric reply with the given trailing text to
+// the current connection.
+func (conn *Connection) writeNumeric(numeric, text string) error {
+	str := fmt.Sprintf(":whapp-irc %s %s :%s", numeric, conn.nickOrStar(), text)
+	return conn.WriteNow(str)
+}
+
+// nickOrStar returns the nickname of the current connection, or `*` if it
+// hasn't been set yet.
+func (conn *Connection) nickOrStar() string {
+	if conn.nick == "" {
+		return "*"
+	}
+	return conn.nick
+}
+
+// handleAuthenticate handles the given AUTHENTICATE message.
+// Credentials received using the PLAIN mechanism are used as if they were sent
+// using PASS, the password is checked when the connection is set up.  Using
+// the EXTERNAL mechanism the client authenticates as the account configured
+// for the fingerprint of its certificate, which has to match its nick when
+// the connection is set up.
+func (conn *Connection) handleAuthenticate(msg *Message) {
+	if len(msg.Params) == 0 {
+		return
+	}
+	param := msg.Params[0]
+
+	if param == "*" {
+		conn.saslMechanism = ""
+		conn.writeNumeric("906", "SASL authentication aborted")
+		return
+	}
+
+	if conn.saslMechanism == "" {
+		mechanism := strings.ToUpper(param)
+		for _, m := range conn.saslMechanisms() {
+			if m == mechanism {
+				conn.saslMechanism = mechanism
+				conn.WriteNow("AUTHENTICATE +")
+				return
+			}
+		}
+
+		mechanisms := strings.Join(conn.saslMechanisms(), ",")
+		str := fmt.Sprintf("%s :are available SASL mechanisms", mechanisms)
+		conn.writeNumeric("908", str)
+		conn.writeNumeric("904", "SASL authentication failed")
+		return
+	}
+
+	mechanism := conn.saslMechanism
+	conn.saslMechanism = ""
+	if mechanism == "EXTERNAL" {
+		conn.authenticateExternal(param)
+		return
+	}
+
+	// PLAIN has the form `authzid NUL authcid NUL passwd`, base64 encoded.
+
+	decoded, err := base64.StdEncoding.DecodeString(param)
+	if err != nil {
+		conn.writeNumeric("904", "SASL authentication failed")
+		return
+	}
+
+	parts := bytes.Split(decoded, []byte{0})
+	if len(parts) != 3 {
+		conn.writeNumeric("904", "SASL authentication failed")
+		return
+	}
+	account := string(parts[1])
+	conn.setPass(string(parts[2]))
+
+	conn.WriteNow(fmt.Sprintf(
+		":whapp-irc 900 %s * %s :You are now logged in as %s",
+		conn.nickOrStar(),
+		account,
+		account,
+	))
+	conn.writeNumeric("903", "SASL authentication successful")
+}
+
+// authenticateExternal handles the given response of the client to the
+// EXTERNAL mechanism, which is either empty (`+`) or the base64 encoded
+// account the client wants to authenticate as.
+func (conn *Connection) authenticateExternal(param string) {
+	authzid := ""
+	if param != "+" {
+		decoded, err := base64.StdEncoding.DecodeString(param)
+		if err != nil {
+			conn.writeNumeric("904", "SASL authentication failed")
+			return
+		}
+		authzid = string(decoded)
+	}
+
+	account, ok := externalAccounts[conn.peerFingerprint()]
+	if !ok || (authzid != "" && authzid != account) {
+		conn.writeNumeric("904", "SASL authentication failed")
+		return
+	}
+	conn.account = account
+	// no password is sent, but the client is done authenticating.
+	conn.setPass("")
+
+	conn.WriteNow(fmt.Sprintf(
+		":whapp-irc 900 %s * %s :You are now logged in as %s",
+		conn.nickOrStar(),
+		account,
+		account,
+	))
+	conn.writeNumeric("903", "SASL authentication successful")
+}
@@ -0,0 +1,174 @@
+package ircconnection
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a new self-signed certificate with the given common
+// name, and its SHA-256 fingerprint.
+func testCertificate(t *testing.T, name string) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(raw)
+	return tls.Certificate{Certificate: [][]byte{raw}, PrivateKey: key}, hex.EncodeToString(sum[:])
+}
+
+// tlsPipeConnection returns a connection handling the server end of a TLS
+// connection over a net.Pipe, and the client end of it using the given client
+// certificates.
+func tlsPipeConnection(t *testing.T, clientCerts []tls.Certificate) (conn *Connection, client net.Conn, cancel func()) {
+	serverCert, _ := testCertificate(t, "whapp-irc")
+
+	server, client := net.Pipe()
+	server = tls.Server(server, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	client = tls.Client(client, &tls.Config{
+		Certificates:       clientCerts,
+		InsecureSkipVerify: true,
+	})
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	return handleConnection(ctx, server), client, func() {
+		cancelCtx()
+		client.Close()
+	}
+}
+
+// authenticateExternal authenticates using SASL EXTERNAL with the given
+// response over the given client connection, and returns the numerics of the
+// replies.
+func authenticateExternal(t *testing.T, client net.Conn, response string) []string {
+	client.SetDeadline(time.Now().Add(testTimeout))
+
+	// the replies are read while writing, since writes on either end of a pipe
+	// block until the other end reads them.
+	lines := make(chan []string)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(client)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			select {
+			case lines <- strings.Fields(line):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	readLine := func() []string {
+		fields, ok := <-lines
+		if !ok {
+			t.Fatal("connection closed while reading response")
+		}
+		return fields
+	}
+
+	if _, err := client.Write([]byte("AUTHENTICATE EXTERNAL\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if fields := readLine(); len(fields) != 2 || fields[0] != "AUTHENTICATE" || fields[1] != "+" {
+		t.Fatalf("expected AUTHENTICATE +, got %v", fields)
+	}
+
+	if _, err := client.Write([]byte("AUTHENTICATE " + response + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	var numerics []string
+	for {
+		fields := readLine()
+		if len(fields) < 2 {
+			t.Fatalf("unexpected reply %v", fields)
+		}
+		numerics = append(numerics, fields[1])
+		if fields[1] == "903" || fields[1] == "904" {
+			return numerics
+		}
+	}
+}
+
+func TestSASLExternal(t *testing.T) {
+	defer SetExternalAccounts(externalAccounts)
+
+	cert, fingerprint := testCertificate(t, "alice")
+	other, _ := testCertificate(t, "mallory")
+	SetExternalAccounts(map[string]string{fingerprint: "alice"})
+
+	tests := []struct {
+		name     string
+		certs    []tls.Certificate
+		response string
+		account  string
+	}{
+		{"known certificate", []tls.Certificate{cert}, "+", "alice"},
+		{"matching authzid", []tls.Certificate{cert}, "YWxpY2U=", "alice"}, // alice
+		{"other authzid", []tls.Certificate{cert}, "Ym9i", ""},             // bob
+		{"unknown certificate", []tls.Certificate{other}, "+", ""},
+		{"no certificate", nil, "+", ""},
+	}
+
+	for _, test := range tests {
+		conn, client, cancel := tlsPipeConnection(t, test.certs)
+
+		numerics := authenticateExternal(t, client, test.response)
+		last := numerics[len(numerics)-1]
+		if test.account != "" && last != "903" {
+			t.Errorf("%s: expected success, got %v", test.name, numerics)
+		} else if test.account == "" && last != "904" {
+			t.Errorf("%s: expected failure, got %v", test.name, numerics)
+		} else if conn.Account() != test.account {
+			t.Errorf("%s: authenticated as %q, expected %q", test.name, conn.Account(), test.account)
+		}
+
+		cancel()
+	}
+}
+
+func TestSASLMechanisms(t *testing.T) {
+	defer SetExternalAccounts(externalAccounts)
+	SetExternalAccounts(map[string]string{"00": "alice"})
+
+	conn, _, cancel := pipeConnection(t)
+	defer cancel()
+
+	// EXTERNAL requires TLS, so plain connections only offer PLAIN.
+	if mechanisms := conn.saslMechanisms(); len(mechanisms) != 1 || mechanisms[0] != "PLAIN" {
+		t.Errorf("expected only PLAIN on a plain connection, got %v", mechanisms)
+	}
+}
@@ -0,0 +1,121 @@
+package ircconnection
+
+import (
+	"sort"
+	"strings"
+
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// Tags contains the IRCv3 message tags of a message.
+type Tags map[string]string
+
+// Message is an IRC message received from the client, with its message tags.
+type Message struct {
+	*irc.Message
+	Tags Tags
+}
+
+var tagValueEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	";", "\\:",
+	" ", "\\s",
+	"\r", "\\r",
+	"\n", "\\n",
+)
+
+// unescapeTagValue unescapes the given escaped tag value.
+func unescapeTagValue(str string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(str); i++ {
+		if str[i] != '\\' {
+			b.WriteByte(str[i])
+			continue
+		}
+
+		i++
+		if i == len(str) {
+			break
+		}
+
+		switch str[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(str[i])
+		}
+	}
+
+	return b.String()
+}
+
+// String returns the tags formatted to be sent, without the leading `@`.
+func (tags Tags) String() string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key
+		if val := tags[key]; val != "" {
+			parts[i] += "=" + tagValueEscaper.Replace(val)
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// parseTags parses the given tags string, without the leading `@`.
+func parseTags(str string) Tags {
+	tags := make(Tags)
+
+	for _, part := range strings.Split(str, ";") {
+		if part == "" {
+			continue
+		}
+
+		key, val := part, ""
+		if i := strings.IndexByte(part, '='); i > -1 {
+			key, val = part[:i], unescapeTagValue(part[i+1:])
+		}
+		tags[key] = val
+	}
+
+	return tags
+}
+
+// parseMessage parses the given raw line, including its message tags.
+// Returns nil if the line isn't a valid IRC message.
+func parseMessage(line string) *Message {
+	line = strings.TrimRight(line, "\r\n")
+
+	tags := make(Tags)
+	if strings.HasPrefix(line, "@") {
+		i := strings.IndexByte(line, ' ')
+		if i == -1 {
+			return nil
+		}
+
+		tags = parseTags(line[1:i])
+		line = strings.TrimLeft(line[i+1:], " ")
+	}
+
+	msg := irc.ParseMessage(line)
+	if msg == nil {
+		return nil
+	}
+
+	return &Message{
+		Message: msg,
+		Tags:    tags,
+	}
+}
@@ -4,25 +4,79 @@ import (
 	"encoding/hex"
 	"fmt"
 	"regexp"
+	"strings"
+	"unicode"
 
 	unidecode "github.com/mozillazg/go-unidecode"
 	"github.com/wangii/emoji"
+	"golang.org/x/text/unicode/norm"
 )
 
+// NickMode is the way SafeString converts names to IRC-safe names.
+type NickMode int
+
+const (
+	// NickModeASCII converts names to their matching ASCII representation.
+	NickModeASCII NickMode = iota
+	// NickModeUnicode keeps Unicode letters and digits in names.
+	NickModeUnicode
+)
+
+var nickMode = NickModeASCII
+
+// SetNickMode sets the NickMode used by SafeString.
+func SetNickMode(mode NickMode) {
+	nickMode = mode
+}
+
 // formatPrivateMessage formats the given line for a private message.
 func formatPrivateMessage(from, to, line string) string {
 	return fmt.Sprintf(":%s PRIVMSG %s :%s", from, to, line)
 }
 
-var unsafeRegex = regexp.MustCompile(`(?i)[^a-z\d+:]`)
+// formatTagMessage formats a TAGMSG, to be sent with message tags.
+func formatTagMessage(from, to string) string {
+	return fmt.Sprintf(":%s TAGMSG %s", from, to)
+}
+
+// formatNotice formats the given line for a notice.
+func formatNotice(from, to, line string) string {
+	return fmt.Sprintf(":%s NOTICE %s :%s", from, to, line)
+}
+
+var (
+	unsafeRegex        = regexp.MustCompile(`(?i)[^a-z\d+:]`)
+	unsafeUnicodeRegex = regexp.MustCompile(`[^\pL\pM\pN+:]`)
+)
+
+// stripInvisible removes all invisible formatting characters, such as
+// zero-width spaces and right-to-left overrides, from the given str.
+func stripInvisible(str string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, str)
+}
 
-// SafeString converts emojis into their corresponding tag, converts Unicode
-// into their matching ASCII representation and removes and left non safe
-// characters in the given str.
+// SafeString NFKC-normalizes the given str and removes invisible formatting
+// characters.  When the NickMode is NickModeASCII, it then converts emojis into
+// their corresponding tag and Unicode into their matching ASCII
+// representation.  Finally it removes any left non safe characters.
 func SafeString(str string) string {
-	emojiTagged := emoji.UnicodeToEmojiTag(str)
-	decoded := unidecode.Unidecode(emojiTagged)
-	ircSafe := unsafeRegex.ReplaceAllLiteralString(decoded, "")
+	normalized := norm.NFKC.String(stripInvisible(str))
+
+	var ircSafe string
+	switch nickMode {
+	case NickModeUnicode:
+		ircSafe = unsafeUnicodeRegex.ReplaceAllLiteralString(normalized, "")
+
+	default:
+		emojiTagged := emoji.UnicodeToEmojiTag(normalized)
+		decoded := unidecode.Unidecode(emojiTagged)
+		ircSafe = unsafeRegex.ReplaceAllLiteralString(decoded, "")
+	}
 
 	if ircSafe == "" {
 		return "x" + hex.EncodeToString([]byte(str))
@@ -0,0 +1,34 @@
+package ircconnection
+
+import "testing"
+
+func TestSafeString(t *testing.T) {
+	defer SetNickMode(nickMode)
+
+	tests := []struct {
+		name  string
+		mode  NickMode
+		input string
+		want  string
+	}{
+		{"emoji ascii", NickModeASCII, "Bob 😀", "Bob:grinning:"},
+		{"emoji unicode", NickModeUnicode, "Bob 😀", "Bob"},
+		{"only emoji unicode", NickModeUnicode, "😀", "xf09f9880"},
+
+		{"combining mark ascii", NickModeASCII, "cafe\u0301", "cafe"},
+		{"combining mark unicode", NickModeUnicode, "cafe\u0301", "caf\u00e9"},
+		{"compatibility form", NickModeUnicode, "\uff21\uff4c\uff49\uff43\uff45", "Alice"},
+
+		{"rtl override ascii", NickModeASCII, "abc\u202egnp.exe", "abcgnpexe"},
+		{"rtl override unicode", NickModeUnicode, "abc\u202egnp.exe", "abcgnpexe"},
+		{"zero-width space", NickModeUnicode, "evil\u200bname", "evilname"},
+		{"only rtl override", NickModeASCII, "\u202e", "xe280ae"},
+	}
+
+	for _, test := range tests {
+		SetNickMode(test.mode)
+		if got := SafeString(test.input); got != test.want {
+			t.Errorf("%s: SafeString(%q) = %q, want %q", test.name, test.input, got, test.want)
+		}
+	}
+}
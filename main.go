@@ -1,12 +1,22 @@
 package main
 
 import (
+	"crypto/tls"
+	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"whapp-irc/config"
 	"whapp-irc/database"
 	"whapp-irc/files"
+	"whapp-irc/ircconnection"
+	"whapp-irc/types"
+	"whapp-irc/util"
 	"whapp-irc/whapp"
 
 	"github.com/chromedp/chromedp"
@@ -21,8 +31,104 @@ var (
 
 	startTime = time.Now()
 	commit    string
+
+	// shutdownCh is closed when the server is shutting down.
+	shutdownCh = make(chan struct{})
+	// mediaDownloads tracks the media downloads currently in progress.  New
+	// downloads are added while holding mediaDownloadsMutex, which is held
+	// while closing shutdownCh as well, so that no download is added once
+	// the server is shutting down.
+	mediaDownloads      sync.WaitGroup
+	mediaDownloadsMutex sync.Mutex
+	// activeConnections is the amount of IRC connections currently active.
+	activeConnections int64
 )
 
+// the maximum time to wait for connections and media downloads to finish
+// when shutting down.
+const shutdownTimeout = 10 * time.Second
+
+// acquireConnection reserves a slot for a new connection, and returns false
+// when conf.MaxConnections connections are active already.
+func acquireConnection() bool {
+	n := atomic.AddInt64(&activeConnections, 1)
+	if conf.MaxConnections > 0 && n > int64(conf.MaxConnections) {
+		atomic.AddInt64(&activeConnections, -1)
+		return false
+	}
+	return true
+}
+
+// releaseConnection releases the slot of a connection that ended.
+func releaseConnection() {
+	atomic.AddInt64(&activeConnections, -1)
+}
+
+// rejectSocket sends an IRC ERROR with the given reason to the given socket,
+// and closes it.
+func rejectSocket(socket *net.TCPConn, reason string) {
+	socket.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := fmt.Fprintf(socket, "ERROR :Closing link: %s\r\n", reason)
+	util.LogIfErr("error while rejecting connection", err)
+	socket.Close()
+}
+
+// startMediaDownload registers a new media download, which has to call
+// mediaDownloads.Done when it's done.  It returns false, without registering
+// the download, when the server is shutting down.
+func startMediaDownload() bool {
+	mediaDownloadsMutex.Lock()
+	defer mediaDownloadsMutex.Unlock()
+
+	if shuttingDown() {
+		return false
+	}
+	mediaDownloads.Add(1)
+	return true
+}
+
+// shuttingDown returns whether or not the server is shutting down.
+func shuttingDown() bool {
+	select {
+	case <-shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// acceptConnections accepts and binds connections on the given listener until
+// the server is shutting down, every connection is added to connections.
+func acceptConnections(listener *net.TCPListener, connections *sync.WaitGroup) {
+	for {
+		socket, err := listener.AcceptTCP()
+		if err != nil {
+			if shuttingDown() {
+				return
+			}
+
+			log.Printf("error accepting TCP connection: %s", err)
+			continue
+		}
+
+		if !acquireConnection() {
+			log.Printf("rejecting connection from %s, server is full", socket.RemoteAddr())
+			rejectSocket(socket, "server is full")
+			continue
+		}
+
+		connections.Add(1)
+		go func() {
+			defer connections.Done()
+			defer releaseConnection()
+
+			if err := BindSocket(socket); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+}
+
 func main() {
 	var err error
 
@@ -30,6 +136,29 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	ircconnection.SetNickMode(conf.NickMode)
+	ircconnection.SetTimeFormat(conf.ServerTimeFormat)
+	ircconnection.SetStatusNick(conf.StatusNick)
+	ircconnection.SetKeepAlive(conf.TCPKeepAlive)
+	ircconnection.SetExternalAccounts(conf.SASLExternal)
+	if conf.IRCTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(conf.IRCTLSCert, conf.IRCTLSKey)
+		if err != nil {
+			panic(err)
+		}
+
+		// client certificates are requested but not verified, clients are
+		// identified by the fingerprint of their certificate instead.
+		ircconnection.SetTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequestClientCert,
+		})
+	}
+	types.SetContactAffixes(conf.ContactNickPrefix, conf.ContactNickSuffix)
+	types.SetPrivateChannels(conf.PrivateChannels)
+	types.SetIDSuffixes(conf.IDSuffixes)
+
+	go listenForMaintenanceToggle()
 
 	userDb, err = database.MakeDatabase("db/users")
 	if err != nil {
@@ -41,6 +170,7 @@ func main() {
 		conf.FileServerPort,
 		"files",
 		conf.FileServerHTTPS,
+		conf.FileServerKey,
 	)
 	if err != nil {
 		panic(err)
@@ -50,6 +180,9 @@ func main() {
 			log.Fatalf("error while serving fileserver: %s", err)
 		}
 	}()
+	if conf.FileServerHealthInterval > 0 {
+		go fs.MonitorHealth(conf.FileServerHealthInterval)
+	}
 
 	pool, err = func() (*chromedp.Pool, error) {
 		switch conf.LogLevel {
@@ -64,27 +197,59 @@ func main() {
 	}
 	defer pool.Shutdown()
 
-	addr, err := net.ResolveTCPAddr("tcp", ":"+conf.IRCPort)
-	if err != nil {
-		panic(err)
-	}
+	listeners := make([]*net.TCPListener, len(conf.IRCListenAddresses))
+	for i, a := range conf.IRCListenAddresses {
+		addr, err := net.ResolveTCPAddr("tcp", a)
+		if err != nil {
+			panic(err)
+		}
 
-	listener, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		panic(err)
+		listeners[i], err = net.ListenTCP("tcp", addr)
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("listening for IRC connections on %s", listeners[i].Addr())
 	}
 
-	for {
-		socket, err := listener.AcceptTCP()
-		if err != nil {
-			log.Printf("error accepting TCP connection: %s", err)
-			continue
+	// when we receive SIGINT or SIGTERM, stop accepting new connections and
+	// notify the current connections that we're shutting down.
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+		sig := <-sigCh
+		log.Printf("received %s, shutting down", sig)
+
+		mediaDownloadsMutex.Lock()
+		close(shutdownCh)
+		mediaDownloadsMutex.Unlock()
+		for _, listener := range listeners {
+			listener.Close()
 		}
+	}()
 
-		go func() {
-			if err := BindSocket(socket); err != nil {
-				log.Println(err)
-			}
-		}()
+	var connections, accepting sync.WaitGroup
+	for _, listener := range listeners {
+		accepting.Add(1)
+		go func(listener *net.TCPListener) {
+			defer accepting.Done()
+			acceptConnections(listener, &connections)
+		}(listener)
+	}
+	accepting.Wait()
+
+	// wait for the connections to save their state and for the in-flight media
+	// downloads to finish.
+	done := make(chan struct{})
+	go func() {
+		connections.Wait()
+		mediaDownloads.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		log.Printf("timed out waiting for connections to close")
 	}
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// maintenanceNotice is sent to the user instead of performing an action on
+// WhatsApp while the bridge is in maintenance mode.
+const maintenanceNotice = "-- bridge in maintenance, sending disabled --"
+
+// maintenance is 1 while the bridge is in maintenance mode, in which messages
+// from WhatsApp are still bridged, but nothing is sent to WhatsApp.
+var maintenance int32
+
+// inMaintenance returns whether or not the bridge is in maintenance mode.
+func inMaintenance() bool {
+	return atomic.LoadInt32(&maintenance) == 1
+}
+
+// toggleMaintenance toggles maintenance mode, and returns whether or not the
+// bridge is in maintenance mode now.
+func toggleMaintenance() bool {
+	for {
+		old := atomic.LoadInt32(&maintenance)
+		if atomic.CompareAndSwapInt32(&maintenance, old, 1-old) {
+			return old == 0
+		}
+	}
+}
+
+// listenForMaintenanceToggle toggles maintenance mode whenever SIGUSR1 is
+// received, and notifies every running session.  It never returns.
+func listenForMaintenanceToggle() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1)
+
+	for range sigCh {
+		str := "bridge left maintenance mode, sending enabled"
+		if toggleMaintenance() {
+			str = "bridge entered maintenance mode, sending disabled"
+		}
+		log.Println(str)
+
+		sessionsMutex.Lock()
+		for _, conn := range sessions {
+			conn.irc.Status(str)
+		}
+		sessionsMutex.Unlock()
+	}
+}
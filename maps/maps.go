@@ -1,6 +1,9 @@
 package maps
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+)
 
 // Provider is a provider for a map.
 type Provider int
@@ -31,6 +34,22 @@ func openStreetMap(latitude, longitude float64) string {
 	)
 }
 
+// ValidCoordinates returns whether or not the given latitude and longitude are
+// a valid location.  0,0 is considered invalid, since malformed location
+// messages have those coordinates.
+func ValidCoordinates(latitude, longitude float64) bool {
+	for _, f := range []float64{latitude, longitude} {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return false
+		}
+	}
+
+	if latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+		return false
+	}
+	return latitude != 0 || longitude != 0
+}
+
 // ByProvider returns an URL to the given latitude and longitude on the given
 // provider.
 func ByProvider(provider Provider, latitude, longitude float64) string {
@@ -0,0 +1,35 @@
+package maps
+
+import (
+	"math"
+	"testing"
+)
+
+func TestValidCoordinates(t *testing.T) {
+	tests := []struct {
+		name      string
+		latitude  float64
+		longitude float64
+		valid     bool
+	}{
+		{"amsterdam", 52.3676, 4.9041, true},
+		{"on the equator", 0, 4.9041, true},
+		{"on the prime meridian", 52.3676, 0, true},
+		{"north pole", 90, 0, true},
+		{"date line", -45, -180, true},
+
+		{"null island", 0, 0, false},
+		{"latitude too large", 90.5, 4.9041, false},
+		{"latitude too small", -91, 4.9041, false},
+		{"longitude too large", 52.3676, 180.1, false},
+		{"longitude too small", 52.3676, -200, false},
+		{"not a number", math.NaN(), 4.9041, false},
+		{"infinite", 52.3676, math.Inf(1), false},
+	}
+
+	for _, test := range tests {
+		if valid := ValidCoordinates(test.latitude, test.longitude); valid != test.valid {
+			t.Errorf("%s: ValidCoordinates(%g, %g) = %t, want %t", test.name, test.latitude, test.longitude, valid, test.valid)
+		}
+	}
+}
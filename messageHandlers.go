@@ -3,7 +3,8 @@ package main
 import (
 	"fmt"
 	"strings"
-	"time"
+	"whapp-irc/config"
+	"whapp-irc/ircconnection"
 	"whapp-irc/util"
 	"whapp-irc/whapp"
 )
@@ -14,6 +15,25 @@ type Message struct {
 	Body     string
 	IsReply  bool
 	Message  *whapp.Message
+
+	// IsTranslation is set when the body is the translation of the message,
+	// sent after the message itself.
+	IsTranslation bool
+}
+
+// Source returns the IRC source of the current message.  If configured, for
+// group messages the phone number of the sender is added as the user and host
+// part, so that clients can show the real identity of the sender.
+func (msg *Message) Source() string {
+	sender := msg.Message.Sender
+	if !conf.PhoneInSource ||
+		!(msg.Message.Chat.IsGroupChat || msg.Message.Chat.ID.IsBroadcast()) ||
+		msg.Message.IsSentByMe ||
+		sender == nil {
+		return msg.From
+	}
+
+	return fmt.Sprintf("%s!%s@%s", msg.From, sender.ID.User, sender.ID.Server)
 }
 
 // Quoted returns the quoted WhatsApp message.
@@ -21,6 +41,22 @@ func (msg *Message) Quoted() *whapp.Message {
 	return msg.Message.QuotedMessage
 }
 
+// Recipients returns the IRC clients the current message should be sent to.
+func (msg *Message) Recipients(conn *Connection) *Clients {
+	if msg.Message.IsSentByMeFromWeb && conf.WebMessages == config.WebMessagesEcho {
+		return conn.irc.WithCap("echo-message")
+	}
+
+	// messages sent from WhatsApp Web are handled by WEB_MESSAGES.
+	fromPhone := msg.Message.IsSentByMe && !msg.Message.IsSentByMeFromWeb
+	isGroup := msg.Message.Chat.IsGroupChat || msg.Message.Chat.ID.IsBroadcast()
+	if fromPhone && isGroup && conf.EchoOwnGroupMessages {
+		return conn.irc.WithCap("echo-message")
+	}
+
+	return conn.irc
+}
+
 // MessageHandler represents a handler for a WhatsApp message to be sent to an
 // IRC client.
 type MessageHandler func(conn *Connection, msg Message) error
@@ -28,25 +64,44 @@ type MessageHandler func(conn *Connection, msg Message) error
 var handlerNormal = func(conn *Connection, msg Message) error {
 	lines := strings.Split(msg.Body, "\n")
 	time := msg.Message.Time()
+	irc := msg.Recipients(conn)
 
-	if msg.IsReply {
-		line := "> " + lines[0]
-		if nRest := len(lines) - 1; nRest > 0 {
-			line = fmt.Sprintf(
-				"%s [and %d more %s]",
-				line,
-				nRest,
-				util.Plural(nRest, "line", "lines"),
-			)
-		}
+	// the chat ID allows clients to theme or filter messages per chat.
+	chatID := msg.Message.Chat.ID.String()
 
-		return conn.irc.PrivateMessage(time, msg.From, msg.To, line)
+	if msg.IsReply {
+		// the quoted message is a single line snippet.
+		line := "> " + msg.Body
+		tags := ircconnection.Tags{"+whapp-irc/chat-id": chatID}
+		return irc.PrivateMessageTags(time, tags, msg.Source(), msg.To, line)
 	}
 
+	// only the first line carries the msgid, since a msgid identifies a
+	// single IRC message.  Replying to any line of the message refers to the
+	// first one.  The tags are created per line, since they're kept to replay
+	// the line to reconnecting clients.
+	first := !msg.IsTranslation
 	for _, line := range lines {
-		if err := conn.irc.PrivateMessage(
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		tags := ircconnection.Tags{"+whapp-irc/chat-id": chatID}
+		if first {
+			tags["msgid"] = msg.Message.ID.Serialized
+			first = false
+		} else {
+			// the other lines, and translations, refer to the message.
+			tags["+draft/reply"] = msg.Message.ID.Serialized
+		}
+		if msg.Message.IsSentByMe {
+			tags[statusTag] = ackStatus(msg.Message.Ack)
+		}
+
+		if err := irc.PrivateMessageTags(
 			time,
-			msg.From,
+			tags,
+			msg.Source(),
 			msg.To,
 			line,
 		); err != nil {
@@ -62,19 +117,27 @@ var handlerAlternativeReplay = func(conn *Connection, msg Message) error {
 		return nil
 	}
 
+	// the replayed lines carry the original time of the message, so that
+	// clients supporting server-time order them correctly as well.
+	date := msg.Message.Time()
+	irc := msg.Recipients(conn)
 	for _, line := range strings.Split(msg.Body, "\n") {
-		util.LogMessage(msg.Message.Time(), msg.From, msg.To, line)
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		util.LogMessage(date, msg.From, msg.To, line)
 
 		msg := fmt.Sprintf(
 			"(%s) %s->%s: %s",
-			msg.Message.Time().Format("2006-01-02 15:04:05"),
+			date.Format("2006-01-02 15:04:05"),
 			msg.From,
 			msg.To,
 			line,
 		)
 
-		if err := conn.irc.PrivateMessage(
-			time.Now(),
+		if err := irc.PrivateMessage(
+			date,
 			"replay",
 			conn.irc.Nick(),
 			msg,
@@ -15,8 +15,9 @@ type MessageRes struct {
 type MessageQueue <-chan chan MessageRes
 
 // GetMessageQueue wraps around the given WhatsApp message channel and makes a
-// queue, queueing a maximum of queueSize items.
-func GetMessageQueue(ctx context.Context, ch <-chan whapp.Message, queueSize int) MessageQueue {
+// queue, queueing a maximum of queueSize items.  The media of every message is
+// downloaded using the given download function before it's dequeued.
+func GetMessageQueue(ctx context.Context, ch <-chan whapp.Message, queueSize int, download func(whapp.Message)) MessageQueue {
 	queue := make(chan chan MessageRes, queueSize)
 
 	go func() {
@@ -36,11 +37,8 @@ func GetMessageQueue(ctx context.Context, ch <-chan whapp.Message, queueSize int
 				queue <- ch
 
 				go func() {
-					err := downloadAndStoreMedia(msg)
-					ch <- MessageRes{
-						Err:     err,
-						Message: msg,
-					}
+					download(msg)
+					ch <- MessageRes{Message: msg}
 					close(ch)
 				}()
 			}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+	"whapp-irc/util"
+)
+
+// Metrics contains counters of the activity of a connection.  The counters are
+// updated atomically, so they can be used without locking.
+type Metrics struct {
+	messagesReceived  int64
+	messagesDelivered int64
+	mediaBytes        int64
+	mediaFailures     int64
+	reconnects        int64
+
+	// lastMessage is the time the last message was received, in nanoseconds
+	// since the unix epoch.
+	lastMessage int64
+}
+
+func (m *Metrics) messageReceived() {
+	atomic.AddInt64(&m.messagesReceived, 1)
+	atomic.StoreInt64(&m.lastMessage, time.Now().UnixNano())
+}
+func (m *Metrics) messageDelivered()           { atomic.AddInt64(&m.messagesDelivered, 1) }
+func (m *Metrics) mediaDownloaded(bytes int64) { atomic.AddInt64(&m.mediaBytes, bytes) }
+func (m *Metrics) mediaFailed()                { atomic.AddInt64(&m.mediaFailures, 1) }
+func (m *Metrics) reconnected()                { atomic.AddInt64(&m.reconnects, 1) }
+
+// lastMessageTime returns the time the last message was received, if any.
+func (m *Metrics) lastMessageTime() (time.Time, bool) {
+	nanos := atomic.LoadInt64(&m.lastMessage)
+	if nanos == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+func (m *Metrics) String() string {
+	return fmt.Sprintf(
+		"%d messages received, %d delivered, %s of media downloaded, %d media download failures, %d reconnects",
+		atomic.LoadInt64(&m.messagesReceived),
+		atomic.LoadInt64(&m.messagesDelivered),
+		util.FormatSize(atomic.LoadInt64(&m.mediaBytes)),
+		atomic.LoadInt64(&m.mediaFailures),
+		atomic.LoadInt64(&m.reconnects),
+	)
+}
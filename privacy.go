@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"whapp-irc/types"
+)
+
+// privacySetting is a piece of presence information the user can choose not
+// to share using the privacy status command.
+type privacySetting struct {
+	name  string
+	field func(privacy *types.Privacy) *bool
+}
+
+// privacySettings contains all the privacy settings, in the order they're
+// listed.
+var privacySettings = []privacySetting{
+	{"online", func(p *types.Privacy) *bool { return &p.HideOnline }},
+	{"typing", func(p *types.Privacy) *bool { return &p.HideTyping }},
+	{"receipts", func(p *types.Privacy) *bool { return &p.HideReceipts }},
+}
+
+// getPrivacy returns a copy of the privacy settings of the user.
+func (conn *Connection) getPrivacy() types.Privacy {
+	conn.privacyMutex.Lock()
+	defer conn.privacyMutex.Unlock()
+
+	return conn.privacy
+}
+
+// setPrivacy replaces the privacy settings of the user, as stored in the
+// database.
+func (conn *Connection) setPrivacy(privacy types.Privacy) {
+	conn.privacyMutex.Lock()
+	defer conn.privacyMutex.Unlock()
+
+	conn.privacy = privacy
+}
+
+// listPrivacy returns a line for every privacy setting of the user with
+// whether or not it's shared.
+func (conn *Connection) listPrivacy() []string {
+	current := conn.getPrivacy()
+
+	var res []string
+	for _, s := range privacySettings {
+		value := "on"
+		if *s.field(&current) {
+			value = "off"
+		}
+		res = append(res, fmt.Sprintf("%s: %s", s.name, value))
+	}
+	return res
+}
+
+// changePrivacy sets whether or not the presence information with the given
+// name is shared on WhatsApp, and queues a save of the user entry.  changed is
+// false when the online state isn't changed in observer or maintenance mode.
+func (conn *Connection) changePrivacy(ctx context.Context, name string, share bool) (changed bool, err error) {
+	for _, s := range privacySettings {
+		if s.name != name {
+			continue
+		}
+
+		if name == "online" {
+			action := "hiding online state"
+			if share {
+				action = "sharing online state"
+			}
+			if conn.observed(action) {
+				return false, nil
+			}
+
+			if err := conn.WI.SetOnline(ctx, share); err != nil {
+				return false, err
+			}
+		}
+
+		conn.privacyMutex.Lock()
+		*s.field(&conn.privacy) = !share
+		conn.privacyMutex.Unlock()
+
+		conn.queueDatabaseSave()
+		return true, nil
+	}
+
+	return false, fmt.Errorf("unknown privacy setting %s", name)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"whapp-irc/types"
+	"whapp-irc/whapp"
+)
+
+// reactionSummaryDelay is the time waited after a reaction before the summary
+// of the reactions on its message is sent, so that a burst of reactions results
+// in a single summary.
+const reactionSummaryDelay = 5 * time.Second
+
+// maxTrackedReactions is the maximum amount of messages whose reactions are
+// tracked, the reactions on older messages are forgotten.
+const maxTrackedReactions = 500
+
+// reaction is the reaction of a single sender on a message.
+type reaction struct {
+	sender string
+	emoji  string
+}
+
+// messageReactions contains the current reactions on a message, in the order
+// they were first made.
+type messageReactions struct {
+	item      types.ChatListItem
+	snippet   string
+	reactions []reaction
+
+	date  time.Time
+	timer *time.Timer
+}
+
+// set sets the reaction of the given sender to emoji, or removes it if emoji
+// is empty.
+func (r *messageReactions) set(sender, emoji string) {
+	for i, x := range r.reactions {
+		if x.sender != sender {
+			continue
+		}
+
+		if emoji == "" {
+			r.reactions = append(r.reactions[:i], r.reactions[i+1:]...)
+		} else {
+			r.reactions[i].emoji = emoji
+		}
+		return
+	}
+
+	if emoji != "" {
+		r.reactions = append(r.reactions, reaction{sender, emoji})
+	}
+}
+
+// summary returns the summary line of the current reactions, with the most
+// used emoji first.
+func (r *messageReactions) summary() string {
+	var emojis []string
+	counts := make(map[string]int)
+	for _, x := range r.reactions {
+		if counts[x.emoji] == 0 {
+			emojis = append(emojis, x.emoji)
+		}
+		counts[x.emoji]++
+	}
+	sort.SliceStable(emojis, func(i, j int) bool {
+		return counts[emojis[i]] > counts[emojis[j]]
+	})
+
+	parts := make([]string, len(emojis))
+	for i, emoji := range emojis {
+		parts[i] = fmt.Sprintf("%s×%d", emoji, counts[emoji])
+	}
+	str := strings.Join(parts, " ")
+	if str == "" {
+		str = "none"
+	}
+
+	if r.snippet != "" {
+		return fmt.Sprintf("reactions: %s on \"%s\"", str, r.snippet)
+	}
+	return "reactions: " + str
+}
+
+// handleReaction handles the given reaction in the chat of the given item,
+// either by sending it as a line right away or by updating the summary of the
+// reactions on its message, as configured.
+func (conn *Connection) handleReaction(ctx context.Context, item types.ChatListItem, msg whapp.Message) error {
+	author := conn.senderName(msg)
+	if !item.Chat.IsChannel() && !msg.IsSentByMe {
+		author = item.Identifier
+	}
+
+	if conf.ReactionSummaries {
+		conn.trackReaction(ctx, item, msg, author)
+		return nil
+	}
+
+	snippet, ok := conn.messageSnippet(ctx, item, msg.ReactionParentID)
+
+	var line string
+	switch {
+	case msg.ReactionText == "" && ok:
+		line = fmt.Sprintf("* %s removed their reaction on \"%s\"", author, snippet)
+	case msg.ReactionText == "":
+		line = fmt.Sprintf("* %s removed their reaction on a message", author)
+	case ok:
+		line = fmt.Sprintf("* %s reacted %s on \"%s\"", author, msg.ReactionText, snippet)
+	default:
+		line = fmt.Sprintf("* %s reacted %s on a message", author, msg.ReactionText)
+	}
+	return conn.chatNotice(item, msg.Time(), line)
+}
+
+// trackReaction updates the reactions on the message the given reaction by
+// author is on, and (re)schedules sending their summary.
+func (conn *Connection) trackReaction(ctx context.Context, item types.ChatListItem, msg whapp.Message, author string) {
+	id := msg.ReactionParentID
+
+	conn.reactionsMutex.Lock()
+	r, has := conn.reactions[id]
+	conn.reactionsMutex.Unlock()
+
+	if !has {
+		// fetch the snippet without holding the lock, since it requires a
+		// round trip to WhatsApp.
+		snippet, _ := conn.messageSnippet(ctx, item, id)
+		r = &messageReactions{
+			item:    item,
+			snippet: snippet,
+		}
+	}
+
+	conn.reactionsMutex.Lock()
+	defer conn.reactionsMutex.Unlock()
+
+	if conn.reactions == nil {
+		conn.reactions = make(map[string]*messageReactions)
+	}
+	if existing, has := conn.reactions[id]; has {
+		r = existing
+	} else {
+		conn.reactions[id] = r
+		conn.reactionsOrder = append(conn.reactionsOrder, id)
+		if len(conn.reactionsOrder) > maxTrackedReactions {
+			// a pending summary of the forgotten message is still sent.
+			delete(conn.reactions, conn.reactionsOrder[0])
+			conn.reactionsOrder = conn.reactionsOrder[1:]
+		}
+	}
+
+	r.set(author, msg.ReactionText)
+	r.date = msg.Time()
+
+	if r.timer != nil {
+		r.timer.Reset(reactionSummaryDelay)
+		return
+	}
+	r.timer = time.AfterFunc(reactionSummaryDelay, func() {
+		conn.sendReactionSummary(r)
+	})
+}
+
+// sendReactionSummary sends the summary of the given reactions to their chat.
+func (conn *Connection) sendReactionSummary(r *messageReactions) {
+	conn.reactionsMutex.Lock()
+	r.timer = nil
+	item, date, line := r.item, r.date, r.summary()
+	conn.reactionsMutex.Unlock()
+
+	if err := conn.chatNotice(item, date, line); err != nil {
+		log.Printf("error while sending reaction summary: %s\n", err)
+	}
+}
+
+// stopReactionSummaries cancels all scheduled reaction summaries.
+func (conn *Connection) stopReactionSummaries() {
+	conn.reactionsMutex.Lock()
+	defer conn.reactionsMutex.Unlock()
+
+	for _, r := range conn.reactions {
+		if r.timer != nil {
+			r.timer.Stop()
+			r.timer = nil
+		}
+	}
+}
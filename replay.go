@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+	"whapp-irc/types"
 	"whapp-irc/whapp"
 )
 
 func (conn *Connection) hasReplay() bool {
-	return conn.irc.Caps.Has("whapp-irc/replay") || conf.AlternativeReplay
+	return conn.irc.HasCap("whapp-irc/replay") || conf.AlternativeReplay
 }
 
 func (conn *Connection) handleWhappMessageReplay(ctx context.Context, msg whapp.Message) error {
@@ -15,5 +19,84 @@ func (conn *Connection) handleWhappMessageReplay(ctx context.Context, msg whapp.
 		fn = handlerAlternativeReplay
 	}
 
+	// replayed messages of the user are attributed to the configured nick,
+	// instead of to the nick used by the client now.
+	if conf.ReplaySelfNick != "" {
+		inner := fn
+		fn = func(conn *Connection, msg Message) error {
+			if msg.Message.IsSentByMe {
+				msg.From = conf.ReplaySelfNick
+			}
+			return inner(conn, msg)
+		}
+	}
+
+	conn.downloadMessageMedia(msg)
 	return conn.handleWhappMessage(ctx, msg, fn)
 }
+
+// splitReplay splits the given messages of a chat into the messages to replay
+// and the messages older than the given cutoff, which are marked as seen
+// without replaying them.  Messages not newer than the given previous
+// timestamp of the chat have been delivered already, and are left out
+// entirely.
+func splitReplay(messages []whapp.Message, prevTimestamp, cutoff int64) (replay, old []whapp.Message) {
+	for _, msg := range messages {
+		if msg.Timestamp <= prevTimestamp {
+			continue
+		} else if msg.Timestamp < cutoff {
+			old = append(old, msg)
+			continue
+		}
+
+		replay = append(replay, msg)
+	}
+	return replay, old
+}
+
+// quietMembership returns whether or not the given membership notification, of
+// another participant, is old enough not to be sent as configured by
+// conf.ReplayMembershipThreshold.  If so, the chat of the given item is
+// registered to have its names sent after the replay instead.
+func (conn *Connection) quietMembership(item types.ChatListItem, msg whapp.Message) bool {
+	threshold := conf.ReplayMembershipThreshold
+	if threshold == 0 || time.Since(msg.Time()) <= threshold {
+		return false
+	}
+
+	conn.quietMembershipMutex.Lock()
+	defer conn.quietMembershipMutex.Unlock()
+
+	if conn.quietMembershipIDs == nil {
+		conn.quietMembershipIDs = make(map[whapp.ID]bool)
+	}
+	conn.quietMembershipIDs[item.ID] = true
+	return true
+}
+
+// sendQuietMembership sends the current names of the joined chats whose
+// membership notifications weren't sent during the replay.
+func (conn *Connection) sendQuietMembership() error {
+	conn.quietMembershipMutex.Lock()
+	ids := conn.quietMembershipIDs
+	conn.quietMembershipIDs = nil
+	conn.quietMembershipMutex.Unlock()
+
+	for id := range ids {
+		item, has := conn.Chats.ByID(id, false)
+		if !has || !item.Chat.IsChannel() || !item.Chat.Joined {
+			continue
+		}
+
+		if err := sendNames(conn.irc, item, time.Now()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// credentialsKey returns the key identifying the given nickname and password.
+func credentialsKey(nick, pass string) string {
+	hash := sha256.Sum256([]byte(nick + "\x00" + pass))
+	return hex.EncodeToString(hash[:8])
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"whapp-irc/whapp"
+)
+
+// messagesAt returns messages with the given timestamps.
+func messagesAt(timestamps ...int64) []whapp.Message {
+	res := make([]whapp.Message, len(timestamps))
+	for i, ts := range timestamps {
+		res[i] = whapp.Message{Timestamp: ts}
+	}
+	return res
+}
+
+// timestamps returns the timestamps of the given messages.
+func timestamps(messages []whapp.Message) []int64 {
+	res := make([]int64, len(messages))
+	for i, msg := range messages {
+		res[i] = msg.Timestamp
+	}
+	return res
+}
+
+func equalTimestamps(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSplitReplay(t *testing.T) {
+	// the messages of the chat straddle the cutoff at 100.
+	messages := messagesAt(80, 90, 99, 100, 110, 120)
+
+	tests := []struct {
+		name                string
+		prev, cutoff        int64
+		wantReplay, wantOld []int64
+	}{
+		{"straddling the cutoff", 0, 100, []int64{100, 110, 120}, []int64{80, 90, 99}},
+		{"no cutoff", 0, -1 << 63, []int64{80, 90, 99, 100, 110, 120}, nil},
+		{"seen before the cutoff", 90, 100, []int64{100, 110, 120}, []int64{99}},
+		{"seen after the cutoff", 110, 100, []int64{120}, nil},
+		{"all seen", 120, 100, nil, nil},
+	}
+
+	for _, test := range tests {
+		replay, old := splitReplay(messages, test.prev, test.cutoff)
+		if got := timestamps(replay); !equalTimestamps(got, test.wantReplay) {
+			t.Errorf("%s: replayed %v, want %v", test.name, got, test.wantReplay)
+		}
+		if got := timestamps(old); !equalTimestamps(got, test.wantOld) {
+			t.Errorf("%s: marked as seen %v, want %v", test.name, got, test.wantOld)
+		}
+	}
+}
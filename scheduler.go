@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+	"whapp-irc/whapp"
+)
+
+// scheduledMessage is a message waiting to be delivered by the scheduler.
+type scheduledMessage struct {
+	msg   Message
+	lines int
+}
+
+// handlerScheduled is a message handler that queues messages per chat, to be
+// delivered by the scheduler.
+var handlerScheduled = func(conn *Connection, msg Message) error {
+	return conn.deliver(msg)
+}
+
+// deliver sends the given message to IRC.  When conf.MaxLineRate is set, the
+// message is queued to be sent by the scheduler instead.
+func (conn *Connection) deliver(msg Message) error {
+	if conf.MaxLineRate == 0 {
+		return handlerNormal(conn, msg)
+	}
+
+	lines := 0
+	for _, line := range strings.Split(msg.Body, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines++
+		}
+	}
+	if msg.IsReply {
+		lines = 1
+	}
+
+	chatID := msg.Message.Chat.ID
+
+	conn.schedulerMutex.Lock()
+	conn.initScheduler()
+	if len(conn.scheduled[chatID]) == 0 {
+		conn.scheduledOrder = append(conn.scheduledOrder, chatID)
+	}
+	conn.scheduled[chatID] = append(conn.scheduled[chatID], scheduledMessage{msg, lines})
+	wake := conn.schedulerWake
+	conn.schedulerMutex.Unlock()
+
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// initScheduler creates the state of the scheduler, if it doesn't exist yet.
+// conn.schedulerMutex has to be held.
+func (conn *Connection) initScheduler() {
+	if conn.scheduled == nil {
+		conn.scheduled = make(map[whapp.ID][]scheduledMessage)
+		conn.schedulerWake = make(chan struct{}, 1)
+	}
+}
+
+// nextScheduled removes and returns the first queued message of the chat whose
+// turn it is.  Chats take turns, so that a busy chat can't hold up the
+// messages of other chats.
+func (conn *Connection) nextScheduled() (scheduledMessage, bool) {
+	conn.schedulerMutex.Lock()
+	defer conn.schedulerMutex.Unlock()
+
+	if len(conn.scheduledOrder) == 0 {
+		return scheduledMessage{}, false
+	}
+
+	chatID := conn.scheduledOrder[0]
+	conn.scheduledOrder = conn.scheduledOrder[1:]
+
+	queue := conn.scheduled[chatID]
+	res := queue[0]
+	if len(queue) > 1 {
+		conn.scheduled[chatID] = queue[1:]
+		conn.scheduledOrder = append(conn.scheduledOrder, chatID)
+	} else {
+		delete(conn.scheduled, chatID)
+	}
+
+	return res, true
+}
+
+// runScheduler delivers the queued messages, sending at most conf.MaxLineRate
+// lines per second, until the given context is done.
+func (conn *Connection) runScheduler(ctx context.Context) {
+	conn.schedulerMutex.Lock()
+	conn.initScheduler()
+	wake := conn.schedulerWake
+	conn.schedulerMutex.Unlock()
+
+	for {
+		next, ok := conn.nextScheduled()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-wake:
+				continue
+			}
+		}
+
+		if err := handlerNormal(conn, next.msg); err != nil {
+			log.Printf("error while sending scheduled message: %s\n", err)
+		}
+
+		delay := time.Duration(next.lines) * time.Second / time.Duration(conf.MaxLineRate)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// flushScheduled sends all queued messages right away.
+func (conn *Connection) flushScheduled() {
+	for {
+		next, ok := conn.nextScheduled()
+		if !ok {
+			return
+		}
+
+		if err := handlerNormal(conn, next.msg); err != nil {
+			log.Printf("error while sending scheduled message: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"whapp-irc/config"
+	"whapp-irc/ircconnection"
+	"whapp-irc/util"
+)
+
+// sessions contains the running WhatsApp sessions by nickname, so that
+// multiple IRC clients of the same user can attach to the same session.
+var (
+	sessionsMutex sync.Mutex
+	sessions      = make(map[string]*Connection)
+)
+
+// getSession returns the running session of the user with the given nickname.
+func getSession(nick string) (conn *Connection, has bool) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	conn, has = sessions[nick]
+	return conn, has
+}
+
+// setSession registers the given session as the running session of the user
+// with the given nickname.
+func setSession(nick string, conn *Connection) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	sessions[nick] = conn
+}
+
+// removeSession removes the given session of the user with the given nickname,
+// if it's still the registered one.
+func removeSession(nick string, conn *Connection) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	if sessions[nick] == conn {
+		delete(sessions, nick)
+	}
+}
+
+// reconnectWindow is the maximum time between a client disconnecting and
+// reconnecting with the same credentials for the recently delivered messages to
+// be replayed to it.
+const reconnectWindow = 2 * time.Minute
+
+// ircClient is implemented by a single IRC client, as well as by all the
+// clients attached to a session.
+type ircClient interface {
+	Nick() string
+	Write(time time.Time, msg string) error
+	WriteNow(msg string) error
+	Status(body string) error
+}
+
+// Clients contains the IRC clients attached to a session.  Writing to it
+// writes to every attached client.  While no client is attached, writes are
+// buffered until a client attaches.
+type Clients struct {
+	nick string
+
+	mutex   sync.RWMutex
+	clients []*ircconnection.Connection
+
+	bufferSize int
+	buffer     []func(client *ircconnection.Connection) error
+	dropped    int
+
+	// recent contains the last messages delivered to the attached clients,
+	// detached contains the time clients were detached by their credentials
+	// key.
+	recentSize int
+	recent     []func(client *ircconnection.Connection) error
+	detached   map[string]time.Time
+}
+
+// NewClients returns a new Clients instance containing the given first client.
+func NewClients(first *ircconnection.Connection) *Clients {
+	return &Clients{
+		nick:    first.Nick(),
+		clients: []*ircconnection.Connection{first},
+
+		bufferSize: conf.SessionBufferSize,
+		recentSize: conf.ReconnectBufferSize,
+	}
+}
+
+// Attach attaches the given client.  Before any other write reaches it, the
+// given catchUp function is called with it (such as to join its channels), the
+// recently delivered messages are replayed to it if it reconnected shortly
+// after being detached, and the writes buffered while no client was attached
+// are flushed to it, in that order.  Writes to other clients wait meanwhile.
+func (c *Clients) Attach(client *ircconnection.Connection, catchUp func(client *ircconnection.Connection) error) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := catchUp(client); err != nil {
+		return err
+	} else if err := c.replayRecent(client); err != nil {
+		return err
+	} else if err := c.flush(client); err != nil {
+		return err
+	}
+
+	c.clients = append(c.clients, client)
+	return nil
+}
+
+// Remove detaches the given client, and returns the amount of clients still
+// attached.
+func (c *Clients) Remove(client *ircconnection.Connection) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i, x := range c.clients {
+		if x == client {
+			c.clients = append(c.clients[:i], c.clients[i+1:]...)
+			break
+		}
+	}
+
+	if c.recentSize > 0 {
+		if c.detached == nil {
+			c.detached = make(map[string]time.Time)
+		}
+		c.detached[credentialsKey(client.Nick(), client.Pass())] = time.Now()
+	}
+
+	return len(c.clients)
+}
+
+// each calls fn for every attached client.  An error is only returned when fn
+// failed for every client, since a client that failed will be detached soon.
+func (c *Clients) each(fn func(client *ircconnection.Connection) error) error {
+	c.mutex.Lock()
+	clients := append([]*ircconnection.Connection{}, c.clients...)
+	if len(clients) == 0 && c.bufferSize > 0 {
+		if len(c.buffer) >= c.bufferSize {
+			c.buffer = c.buffer[1:]
+			c.dropped++
+		}
+		c.buffer = append(c.buffer, fn)
+	}
+	c.mutex.Unlock()
+
+	var res error
+	failed := 0
+	for _, client := range clients {
+		if err := fn(client); err != nil {
+			res = err
+			failed++
+		}
+	}
+
+	if failed < len(clients) {
+		return nil
+	}
+	return res
+}
+
+// eachMessage is like each, but fn delivers a message, which is kept to be
+// replayed to clients reconnecting shortly after their connection dropped.
+func (c *Clients) eachMessage(fn func(client *ircconnection.Connection) error) error {
+	c.mutex.Lock()
+	if len(c.clients) > 0 && c.recentSize > 0 {
+		if len(c.recent) >= c.recentSize {
+			c.recent = c.recent[1:]
+		}
+		c.recent = append(c.recent, fn)
+	}
+	c.mutex.Unlock()
+
+	return c.each(fn)
+}
+
+// flush sends the writes buffered while no client was attached to the given
+// client.  c.mutex has to be held.
+func (c *Clients) flush(client *ircconnection.Connection) error {
+	buffer, dropped := c.buffer, c.dropped
+	c.buffer, c.dropped = nil, 0
+
+	if dropped > 0 {
+		str := fmt.Sprintf(
+			"%d older %s dropped while no client was attached",
+			dropped,
+			util.Plural(dropped, "line was", "lines were"),
+		)
+		if err := client.Status(str); err != nil {
+			return err
+		}
+	}
+
+	for _, fn := range buffer {
+		if err := fn(client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayRecent sends the recently delivered messages to the given client, if
+// it reconnected with the same credentials within reconnectWindow of being
+// detached, to cover the messages it may have missed meanwhile.  c.mutex has to
+// be held.
+func (c *Clients) replayRecent(client *ircconnection.Connection) error {
+	key := credentialsKey(client.Nick(), client.Pass())
+
+	detachedAt, has := c.detached[key]
+	delete(c.detached, key)
+	recent := c.recent
+
+	if !has || time.Since(detachedAt) > reconnectWindow || len(recent) == 0 {
+		return nil
+	}
+
+	str := fmt.Sprintf(
+		"replaying %d recent %s",
+		len(recent),
+		util.Plural(len(recent), "message", "messages"),
+	)
+	if err := client.Status(str); err != nil {
+		return err
+	}
+
+	for _, fn := range recent {
+		if err := fn(client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Nick returns the nickname of the user.
+func (c *Clients) Nick() string {
+	return c.nick
+}
+
+// Pass returns the password provided by the first attached client.
+func (c *Clients) Pass() string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if len(c.clients) == 0 {
+		return ""
+	}
+	return c.clients[0].Pass()
+}
+
+// HasCap returns whether or not any of the attached clients negotiated the
+// given capability.
+func (c *Clients) HasCap(capability string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for _, client := range c.clients {
+		if client.Caps.Has(capability) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write writes the given message with the given timestamp to every attached
+// client.
+func (c *Clients) Write(time time.Time, msg string) error {
+	return c.each(func(client *ircconnection.Connection) error {
+		return client.Write(time, msg)
+	})
+}
+
+// WriteNow writes the given message with a timestamp of now to every attached
+// client.
+func (c *Clients) WriteNow(msg string) error {
+	return c.Write(time.Now(), msg)
+}
+
+// PrivateMessage sends the given line as a private message from from, to to,
+// on the given date to every attached client.
+func (c *Clients) PrivateMessage(date time.Time, from, to, line string) error {
+	return c.PrivateMessageTags(date, nil, from, to, line)
+}
+
+// PrivateMessageTags sends the given line as a private message from from, to
+// to, on the given date, with the given message tags to every attached client.
+func (c *Clients) PrivateMessageTags(date time.Time, tags ircconnection.Tags, from, to, line string) error {
+	return c.eachMessage(func(client *ircconnection.Connection) error {
+		return client.PrivateMessageTags(date, tags, from, to, line)
+	})
+}
+
+// TagMessage sends a TAGMSG with the given message tags from from, to to, on
+// the given date to every attached client that negotiated message-tags.
+func (c *Clients) TagMessage(date time.Time, tags ircconnection.Tags, from, to string) error {
+	return c.each(func(client *ircconnection.Connection) error {
+		return client.TagMessage(date, tags, from, to)
+	})
+}
+
+// Notice sends the given line as a notice from from, to to, on the given date
+// to every attached client.
+func (c *Clients) Notice(date time.Time, from, to, line string) error {
+	return c.eachMessage(func(client *ircconnection.Connection) error {
+		return client.Notice(date, from, to, line)
+	})
+}
+
+// Status writes the given message as if sent by 'status' to every attached
+// client.
+func (c *Clients) Status(body string) error {
+	return c.each(func(client *ircconnection.Connection) error {
+		return client.Status(body)
+	})
+}
+
+// StatusList writes the given messages as if sent by 'status' to every
+// attached client.
+func (c *Clients) StatusList(bodies []string) error {
+	return c.each(func(client *ircconnection.Connection) error {
+		return client.StatusList(bodies)
+	})
+}
+
+// SetName notifies every attached client that the realname of the user changed
+// to the given name.
+func (c *Clients) SetName(name string) error {
+	return c.each(func(client *ircconnection.Connection) error {
+		return client.SetName(name)
+	})
+}
+
+// Echo sends the given line, sent by the given client to to, to the other
+// attached clients, and to the sending client as well if it negotiated
+// echo-message.  Clients that receive the message when WhatsApp reports it as
+// sent from WhatsApp Web, as configured by WEB_MESSAGES, are skipped.  The
+// line is replayed to clients reconnecting shortly after, like other
+// messages.
+func (c *Clients) Echo(sender *ircconnection.Connection, date time.Time, to, line string) error {
+	return c.eachMessage(func(client *ircconnection.Connection) error {
+		hasEcho := client.Caps.Has("echo-message")
+
+		switch {
+		case client == sender && !hasEcho:
+			return nil
+		case conf.WebMessages == config.WebMessagesDeliver:
+			return nil
+		case conf.WebMessages == config.WebMessagesEcho && hasEcho:
+			return nil
+		}
+		return client.PrivateMessage(date, c.nick, to, line)
+	})
+}
+
+// WithCap returns the attached clients that negotiated the given capability.
+func (c *Clients) WithCap(capability string) *Clients {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	res := &Clients{nick: c.nick}
+	for _, client := range c.clients {
+		if client.Caps.Has(capability) {
+			res.clients = append(res.clients, client)
+		}
+	}
+	return res
+}
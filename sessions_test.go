@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+	"whapp-irc/config"
+	"whapp-irc/ircconnection"
+)
+
+func TestEchoReplayed(t *testing.T) {
+	defer withConfig(config.Config{ReconnectBufferSize: 10})()
+
+	conn, sender, cancel := newTestConnection(t)
+	defer cancel()
+
+	ctx, cancelClients := context.WithCancel(context.Background())
+	defer cancelClients()
+	catchUp := func(*ircconnection.Connection) error { return nil }
+
+	// another client of the session drops its connection, and the sending
+	// client sends a message meanwhile.
+	irc, other := dialTestClient(ctx, t)
+	if err := conn.irc.Attach(irc, catchUp); err != nil {
+		t.Fatal(err)
+	}
+	conn.irc.Remove(irc)
+	other.socket.Close()
+
+	line := ":me PRIVMSG #friends :while you were away"
+	if err := conn.irc.Echo(conn.irc.clients[0], time.Now(), "#friends", "while you were away"); err != nil {
+		t.Fatal(err)
+	}
+	if lines := sender.lines(conn); len(lines) != 0 {
+		t.Errorf("sending client without echo-message got %q", lines)
+	}
+
+	// the client reconnects and gets the message replayed.
+	irc, other = dialTestClient(ctx, t)
+	if err := conn.irc.Attach(irc, catchUp); err != nil {
+		t.Fatal(err)
+	}
+	lines := other.lines(conn)
+	if len(lines) != 2 || !strings.Contains(lines[0], "replaying 1 recent message") || lines[1] != line {
+		t.Errorf("reconnecting client got %q, expected the replayed %q", lines, line)
+	}
+	other.socket.Close()
+}
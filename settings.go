@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"whapp-irc/config"
+	"whapp-irc/formatting"
+	"whapp-irc/maps"
+	"whapp-irc/types"
+)
+
+// setting is a setting of the user which can be changed using the settings
+// status command.
+type setting struct {
+	name  string
+	field func(settings *types.Settings) *string
+	check func(value string) error
+}
+
+// userSettings contains all the settings of the user, in the order they're
+// listed.
+var userSettings = []setting{
+	{
+		name:  "map-provider",
+		field: func(s *types.Settings) *string { return &s.MapProvider },
+		check: func(value string) error {
+			_, err := config.ParseMapProvider(value)
+			return err
+		},
+	},
+	{
+		name:  "formatting",
+		field: func(s *types.Settings) *string { return &s.Formatting },
+		check: func(value string) error {
+			_, err := config.ParseFormatting(value)
+			return err
+		},
+	},
+}
+
+// getSettings returns a copy of the settings of the user.
+func (conn *Connection) getSettings() types.Settings {
+	conn.settingsMutex.Lock()
+	defer conn.settingsMutex.Unlock()
+
+	return conn.settings
+}
+
+// setSettings replaces the settings of the user, as stored in the database.
+func (conn *Connection) setSettings(settings types.Settings) {
+	conn.settingsMutex.Lock()
+	defer conn.settingsMutex.Unlock()
+
+	conn.settings = settings
+}
+
+// listSettings returns a line for every setting of the user with its current
+// value.
+func (conn *Connection) listSettings() []string {
+	current := conn.getSettings()
+
+	var res []string
+	for _, s := range userSettings {
+		value := *s.field(&current)
+		if value == "" {
+			value = "default"
+		}
+		res = append(res, fmt.Sprintf("%s: %s", s.name, value))
+	}
+	return res
+}
+
+// changeSetting sets the setting with the given name to the given value, or
+// resets it to the configured value if value is "default", and queues a save
+// of the user entry.
+func (conn *Connection) changeSetting(name, value string) error {
+	value = strings.ToLower(value)
+
+	for _, s := range userSettings {
+		if s.name != name {
+			continue
+		}
+
+		if value == "default" {
+			value = ""
+		} else if err := s.check(value); err != nil {
+			return err
+		}
+
+		conn.settingsMutex.Lock()
+		*s.field(&conn.settings) = value
+		conn.settingsMutex.Unlock()
+
+		conn.queueDatabaseSave()
+		return nil
+	}
+
+	return fmt.Errorf("unknown setting %s", name)
+}
+
+// mapProvider returns the map provider of the user.
+func (conn *Connection) mapProvider() maps.Provider {
+	if value := conn.getSettings().MapProvider; value != "" {
+		if provider, err := config.ParseMapProvider(value); err == nil {
+			return provider
+		}
+	}
+	return conf.MapProvider
+}
+
+// formattingMode returns the message formatting mode of the user.
+func (conn *Connection) formattingMode() formatting.Mode {
+	if value := conn.getSettings().Formatting; value != "" {
+		if mode, err := config.ParseFormatting(value); err == nil {
+			return mode
+		}
+	}
+	return conf.Formatting
+}
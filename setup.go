@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 	"whapp-irc/bridge"
+	"whapp-irc/files"
 	"whapp-irc/ircconnection"
 	"whapp-irc/timestampmap"
 	"whapp-irc/types"
@@ -27,9 +28,21 @@ func setupConnection(ctx context.Context, irc *ircconnection.Connection) (*Conne
 		WI:    wi,
 		Chats: &types.ChatList{},
 
-		irc: irc,
+		irc: NewClients(irc),
 
 		timestampMap: timestampmap.New(),
+		metrics:      &Metrics{},
+		started:      time.Now(),
+
+		reconnectBackoff: &util.Backoff{
+			InitialDelay: conf.ReconnectInitialDelay,
+			MaxDelay:     conf.ReconnectMaxDelay,
+			Multiplier:   conf.ReconnectMultiplier,
+			MaxAttempts:  conf.ReconnectMaxAttempts,
+		},
+
+		translations:     make(chan Message, translateQueueSize),
+		translateBackoff: newTranslateBackoff(),
 	}
 
 	// if we have the current user in the database, try to relogin using the
@@ -41,6 +54,9 @@ func setupConnection(ctx context.Context, irc *ircconnection.Connection) (*Conne
 	} else if found {
 		conn.timestampMap.Swap(user.LastReceivedReceipts)
 		conn.Chats = types.ChatListFromSlice(user.Chats)
+		conn.setSettings(user.Settings)
+		conn.setWatchwords(user.Watchwords)
+		conn.setPrivacy(user.Privacy)
 
 		conn.irc.Status("logging in using stored session")
 
@@ -74,7 +90,9 @@ func setupConnection(ctx context.Context, irc *ircconnection.Connection) (*Conne
 		}
 
 		timestamp := strconv.FormatInt(time.Now().UnixNano(), 10)
-		qrFile, err := fs.AddBlob("qr-"+timestamp, "png", bytes)
+		qrFile, err := fs.AddBlob("qr-"+timestamp, "png", bytes, files.Metadata{
+			MimeType: "image/png",
+		})
 		if err != nil {
 			return nil, err
 		}
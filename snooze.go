@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"whapp-irc/ircconnection"
+	"whapp-irc/types"
+	"whapp-irc/util"
+)
+
+// snoozeCheckInterval is the interval at which expired snoozes are looked for.
+const snoozeCheckInterval = 30 * time.Second
+
+// snoozeChat snoozes the chat of the given item for the given duration, or
+// unsnoozes it if the duration is zero, and reports the result to the given
+// client.
+func (conn *Connection) snoozeChat(client *ircconnection.Connection, item types.ChatListItem, d time.Duration) error {
+	if d == 0 {
+		if !item.Snoozed(time.Now()) {
+			return client.Status(item.Identifier + " isn't snoozed")
+		}
+
+		conn.Chats.SetSnoozedUntil(item.ID, 0)
+		conn.queueDatabaseSave()
+		return client.Status("unsnoozed " + item.Identifier)
+	}
+
+	until := time.Now().Add(d)
+	conn.Chats.SetSnoozedUntil(item.ID, until.Unix())
+	conn.queueDatabaseSave()
+
+	str := fmt.Sprintf(
+		"snoozed %s until %s",
+		item.Identifier,
+		until.Format("2006-01-02 15:04"),
+	)
+	return client.Status(str)
+}
+
+// endSnoozes unsnoozes the chats whose snooze has expired, notifying the user
+// of every one of them.
+func (conn *Connection) endSnoozes() error {
+	now := time.Now()
+
+	var ended []types.ChatListItem
+	for _, item := range conn.Chats.List(true) {
+		if item.SnoozedUntil == 0 || item.Snoozed(now) {
+			continue
+		}
+
+		conn.Chats.SetSnoozedUntil(item.ID, 0)
+		ended = append(ended, item)
+	}
+	if len(ended) == 0 {
+		return nil
+	}
+	conn.queueDatabaseSave()
+
+	for _, item := range ended {
+		line := fmt.Sprintf("-- snooze ended for %s --", item.Identifier)
+		if err := conn.irc.Notice(now, ircconnection.StatusNick(), conn.irc.Nick(), line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchSnoozes ends expired snoozes every snoozeCheckInterval, until the
+// given context is done.  Snoozes that expired while whapp-irc wasn't running
+// are ended right away.
+func (conn *Connection) watchSnoozes(ctx context.Context) {
+	ticker := time.NewTicker(snoozeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		err := conn.endSnoozes()
+		util.LogIfErr("error while ending snoozes", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
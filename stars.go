@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"whapp-irc/ircconnection"
+	"whapp-irc/types"
+	"whapp-irc/whapp"
+)
+
+// maxListedStarred is the maximum amount of starred messages listed by the
+// starred command, only the most recent ones are listed.
+const maxListedStarred = 50
+
+// setStarred stars or unstars the message with the given serialized ID on
+// WhatsApp, and reports the result to the given client.
+func (conn *Connection) setStarred(ctx context.Context, client *ircconnection.Connection, id string, starred bool) error {
+	action := "star"
+	if !starred {
+		action = "unstar"
+	}
+
+	item, has := conn.chatByMessageID(id)
+	if !has {
+		return client.Status("unknown message")
+	}
+
+	if conn.observed(fmt.Sprintf("%sring message %s", action, id)) {
+		return nil
+	}
+
+	if err := item.Chat.RawChat.SetStarred(ctx, conn.WI, id, starred); err != nil {
+		str := fmt.Sprintf("error while %sring message: %s", action, err)
+		log.Println(str)
+		return client.Status(str)
+	}
+
+	return client.Status(fmt.Sprintf("%sred message in %s", action, item.Identifier))
+}
+
+// listStarred sends the starred messages in the chat of the given item, or in
+// all chats if item is nil, to the given client.  Only messages loaded by
+// WhatsApp Web are listed.
+func (conn *Connection) listStarred(ctx context.Context, client *ircconnection.Connection, item *types.ChatListItem) error {
+	var messages []whapp.Message
+	var err error
+	if item == nil {
+		messages, err = conn.WI.GetStarredMessages(ctx)
+	} else {
+		messages, err = item.Chat.RawChat.GetStarredMessages(ctx, conn.WI)
+	}
+	if err != nil {
+		str := fmt.Sprintf("error while retrieving starred messages: %s", err)
+		log.Println(str)
+		return client.Status(str)
+	} else if len(messages) == 0 {
+		return client.Status("no starred messages")
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Timestamp < messages[j].Timestamp
+	})
+	if len(messages) > maxListedStarred {
+		messages = messages[len(messages)-maxListedStarred:]
+	}
+
+	lines := []string{"-- starred messages --"}
+	for _, msg := range messages {
+		chat, has := conn.Chats.ByID(msg.Chat.ID, false)
+		if !has {
+			continue
+		}
+
+		body := snippet(conn.getMessageBody(msg, chat.Chat.Participants, client.Nick()))
+
+		line := fmt.Sprintf(
+			"%s <%s> in %s: %s (%s)",
+			msg.Time().Format("2006-01-02 15:04"),
+			conn.senderName(msg),
+			chat.Identifier,
+			body,
+			msg.ID.Serialized,
+		)
+		if f, has := fs.GetFileByHash(msg.MediaFileHash); has && msg.IsMMS {
+			line += " " + f.URL
+		}
+		lines = append(lines, line)
+	}
+
+	return client.StatusList(lines)
+}
@@ -0,0 +1,1010 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+	"whapp-irc/config"
+	"whapp-irc/files"
+	"whapp-irc/ircconnection"
+	"whapp-irc/types"
+	"whapp-irc/util"
+	"whapp-irc/whapp"
+)
+
+// the default and maximum amount of media items listed by the media command.
+const (
+	defaultMediaCount = 5
+	maxMediaCount     = 50
+)
+
+// maxPushnameLength is the maximum length, in characters, of a pushname on
+// WhatsApp.
+const maxPushnameLength = 25
+
+// maxExportMessages is the maximum amount of messages exported by the export
+// command, only the most recent messages are exported.
+const maxExportMessages = 10000
+
+// handleStatusCommand handles the given body sent by the user using the given
+// client to the status user as a command.
+func (conn *Connection) handleStatusCommand(ctx context.Context, client *ircconnection.Connection, body string) error {
+	status := client.Status
+
+	fields := strings.Fields(body)
+	if len(fields) == 0 {
+		return nil
+	}
+	cmd := strings.TrimPrefix(strings.ToLower(fields[0]), "!")
+	args := fields[1:]
+
+	switch cmd {
+	case "debug":
+		if len(args) == 0 {
+			return client.StatusList([]string{
+				"-- debug info for the connection --",
+				fmt.Sprintf("chats: %d", len(conn.Chats.List(false))),
+				fmt.Sprintf("active connections: %s", connectionsString()),
+				fmt.Sprintf("reconnect backoff: %s", conn.reconnectBackoff),
+				fmt.Sprintf("metrics: %s", conn.metrics),
+			})
+		} else if len(args) != 1 {
+			return status("usage: debug [chat]")
+		}
+
+		item, has := conn.Chats.ByIdentifier(args[0], false)
+		if !has {
+			return status("unknown chat")
+		}
+		chat := item.Chat
+
+		timestamp := "none"
+		if t, found := conn.timestampMap.Get(chat.ID); found {
+			timestamp = fmt.Sprintf("%d", t)
+		}
+
+		nParticipants := len(chat.Participants)
+		if chat.IsPrivate() {
+			nParticipants = 2
+		}
+
+		return client.StatusList([]string{
+			fmt.Sprintf("-- debug info for %s --", item.Identifier),
+			fmt.Sprintf(
+				"id: %s, group chat: %t, broadcast list: %t",
+				chat.ID,
+				chat.IsGroupChat,
+				chat.IsBroadcast,
+			),
+			fmt.Sprintf(
+				"joined: %t, %d %s",
+				chat.Joined,
+				nParticipants,
+				util.Plural(nParticipants, "participant", "participants"),
+			),
+			fmt.Sprintf("last timestamp: %s", timestamp),
+			fmt.Sprintf("known message IDs: %d", len(chat.MessageIDs)),
+		})
+
+	case "version":
+		version := commit
+		if version == "" {
+			version = "unknown"
+		}
+
+		return client.StatusList([]string{
+			"whapp-irc commit " + version,
+			fmt.Sprintf("built with %s for %s/%s", runtime.Version(), runtime.GOOS, runtime.GOARCH),
+		})
+
+	case "uptime":
+		lastMessage := "none yet"
+		if t, ok := conn.metrics.lastMessageTime(); ok {
+			lastMessage = fmt.Sprintf("%s ago", time.Since(t).Round(time.Second))
+		}
+
+		return client.StatusList([]string{
+			fmt.Sprintf(
+				"server up for %s, since %s",
+				time.Since(startTime).Round(time.Second),
+				startTime.Format("2006-01-02 15:04:05"),
+			),
+			fmt.Sprintf(
+				"session up for %s, since %s",
+				time.Since(conn.started).Round(time.Second),
+				conn.started.Format("2006-01-02 15:04:05"),
+			),
+			"last WhatsApp message received: " + lastMessage,
+		})
+
+	case "media":
+		if len(args) != 1 && len(args) != 2 {
+			return status("usage: media <chat> [count]")
+		}
+
+		item, has := conn.Chats.ByIdentifier(args[0], false)
+		if !has {
+			return status("unknown chat")
+		}
+
+		count := defaultMediaCount
+		if len(args) == 2 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n <= 0 || n > maxMediaCount {
+				str := fmt.Sprintf("count has to be between 1 and %d", maxMediaCount)
+				return status(str)
+			}
+			count = n
+		}
+
+		return conn.listMedia(ctx, client, item, count)
+
+	case "show":
+		if len(args) != 1 {
+			return status("usage: show <msgid>")
+		}
+
+		item, has := conn.chatByMessageID(args[0])
+		if !has {
+			return status("unknown message")
+		}
+
+		return conn.showMessage(ctx, client, item, args[0])
+
+	case "sendloc":
+		if len(args) < 3 {
+			return status("usage: sendloc <chat> <latitude> <longitude> [name]")
+		}
+
+		item, has := conn.Chats.ByIdentifier(args[0], false)
+		if !has {
+			return status("unknown chat")
+		}
+
+		name := strings.Join(args[3:], " ")
+		return conn.sendLocation(ctx, client, item, args[1], args[2], name)
+
+	case "fetch":
+		if len(args) != 1 {
+			return status("usage: fetch <msgid>")
+		}
+
+		item, has := conn.chatByMessageID(args[0])
+		if !has {
+			return status("unknown message")
+		}
+
+		return conn.fetchMedia(ctx, client, item, args[0])
+
+	case "star", "unstar":
+		if len(args) != 1 {
+			return status(fmt.Sprintf("usage: %s <msgid>", cmd))
+		}
+		return conn.setStarred(ctx, client, args[0], cmd == "star")
+
+	case "starred":
+		switch len(args) {
+		case 0:
+			return conn.listStarred(ctx, client, nil)
+		case 1:
+			item, has := conn.Chats.ByIdentifier(args[0], false)
+			if !has {
+				return status("unknown chat")
+			}
+			return conn.listStarred(ctx, client, &item)
+		default:
+			return status("usage: starred [chat]")
+		}
+
+	case "watch":
+		if len(args) == 0 {
+			words := conn.getWatchwords()
+			if len(words) == 0 {
+				return status("no watchwords")
+			}
+			return status("watchwords: " + strings.Join(words, ", "))
+		} else if len(args) != 2 {
+			return status("usage: watch [add|remove <word>]")
+		}
+
+		switch strings.ToLower(args[0]) {
+		case "add":
+			if !conn.addWatchword(args[1]) {
+				return status("already watching " + args[1])
+			}
+		case "remove":
+			if !conn.removeWatchword(args[1]) {
+				return status("not watching " + args[1])
+			}
+		default:
+			return status("usage: watch [add|remove <word>]")
+		}
+
+		conn.queueDatabaseSave()
+		return status("watchwords: " + strings.Join(conn.getWatchwords(), ", "))
+
+	case "setname":
+		name := strings.Join(args, " ")
+		if name == "" {
+			return status("usage: setname <name>")
+		}
+		return conn.setPushname(ctx, client, name)
+
+	case "export":
+		if len(args) != 1 {
+			return status("usage: export <chat>")
+		}
+
+		item, has := conn.Chats.ByIdentifier(args[0], false)
+		if !has {
+			return status("unknown chat")
+		}
+
+		return conn.exportChat(ctx, client, item)
+
+	case "seticon":
+		if len(args) != 2 {
+			return status("usage: seticon <chat> <image url>")
+		}
+
+		item, has := conn.Chats.ByIdentifier(args[0], false)
+		if !has || !item.Chat.IsGroupChat {
+			return status("unknown group chat")
+		}
+
+		if !isAdmin(item.Chat) {
+			str := fmt.Sprintf("you have to be an admin of %s to set its icon", item.Identifier)
+			return status(str)
+		}
+
+		if conn.observed("setting the icon of " + item.Identifier) {
+			return nil
+		}
+
+		img, err := downloadImage(ctx, args[1])
+		if err != nil {
+			return status("error while downloading image: " + err.Error())
+		}
+
+		if err := item.Chat.RawChat.SetIcon(ctx, conn.WI, img); err != nil {
+			str := fmt.Sprintf("error while setting icon of %s: %s", item.Identifier, err)
+			log.Println(str)
+			return status(str)
+		}
+
+		return status("icon of " + item.Identifier + " set")
+
+	case "settings":
+		switch len(args) {
+		case 0:
+			return client.StatusList(append(
+				[]string{"-- settings --"},
+				conn.listSettings()...,
+			))
+		case 2:
+			if err := conn.changeSetting(strings.ToLower(args[0]), args[1]); err != nil {
+				return status(err.Error())
+			}
+			return status(fmt.Sprintf("%s set to %s", args[0], args[1]))
+		default:
+			return status("usage: settings [<name> <value>]")
+		}
+
+	case "privacy":
+		switch len(args) {
+		case 0:
+			return client.StatusList(append(
+				[]string{"-- privacy --"},
+				conn.listPrivacy()...,
+			))
+		case 2:
+			var share bool
+			switch strings.ToLower(args[1]) {
+			case "on":
+				share = true
+			case "off":
+				share = false
+			default:
+				return status("usage: privacy [online|typing|receipts on|off]")
+			}
+
+			name := strings.ToLower(args[0])
+			if changed, err := conn.changePrivacy(ctx, name, share); err != nil {
+				return status(err.Error())
+			} else if !changed {
+				return nil
+			}
+			return status(fmt.Sprintf("%s set to %s", name, strings.ToLower(args[1])))
+		default:
+			return status("usage: privacy [online|typing|receipts on|off]")
+		}
+
+	case "partall":
+		ircOnly := len(args) > 0 && args[0] == "--irc-only"
+		if ircOnly {
+			args = args[1:]
+		}
+
+		action := "partall"
+		if ircOnly {
+			action += " --irc-only"
+		}
+
+		switch len(args) {
+		case 0:
+			token, err := conn.requestConfirmation(action)
+			if err != nil {
+				return status("error while creating confirmation token: " + err.Error())
+			}
+
+			str := fmt.Sprintf(
+				"this leaves all group chats, send `%s %s` within %s to confirm",
+				action,
+				token,
+				confirmationTimeout,
+			)
+			if ircOnly {
+				str = fmt.Sprintf(
+					"this parts all group chats on IRC only, send `%s %s` within %s to confirm",
+					action,
+					token,
+					confirmationTimeout,
+				)
+			}
+			return status(str)
+
+		case 1:
+			if !conn.confirm(action, args[0]) {
+				return status("invalid or expired confirmation token")
+			}
+			return conn.partAll(ctx, client, ircOnly)
+
+		default:
+			return status("usage: partall [--irc-only] [confirmation token]")
+		}
+
+	case "markread", "markunread":
+		if len(args) != 1 {
+			return status(fmt.Sprintf("usage: %s <chat>", cmd))
+		}
+
+		item, has := conn.Chats.ByIdentifier(args[0], false)
+		if !has {
+			return status("unknown chat")
+		}
+
+		read := cmd == "markread"
+		state := "read"
+		if !read {
+			state = "unread"
+		}
+
+		if conn.observed(fmt.Sprintf("marking %s as %s", item.Identifier, state)) {
+			return nil
+		}
+
+		if err := item.Chat.RawChat.SetRead(ctx, conn.WI, read); err != nil {
+			str := fmt.Sprintf("error while marking %s as %s: %s", item.Identifier, state, err)
+			log.Println(str)
+			return status(str)
+		}
+
+		return status(fmt.Sprintf("marked %s as %s", item.Identifier, state))
+
+	case "notify":
+		if len(args) != 1 && len(args) != 2 {
+			return status("usage: notify <chat> [all|mentions|none]")
+		}
+
+		item, has := conn.Chats.ByIdentifier(args[0], true)
+		if !has {
+			return status("unknown chat")
+		}
+
+		if len(args) == 1 {
+			str := fmt.Sprintf(
+				"notification level of %s is %s",
+				item.Identifier,
+				item.Notifications(),
+			)
+			return status(str)
+		}
+
+		level := types.NotificationLevel(strings.ToLower(args[1]))
+		switch level {
+		case types.NotifyAll, types.NotifyMentions, types.NotifyNone:
+		default:
+			return status("unknown notification level: " + args[1])
+		}
+
+		conn.Chats.SetNotificationLevel(item.ID, level)
+		conn.queueDatabaseSave()
+
+		str := fmt.Sprintf("notification level of %s set to %s", item.Identifier, level)
+		return status(str)
+
+	case "snooze":
+		if len(args) != 1 && len(args) != 2 {
+			return status("usage: snooze <chat> [duration|off]")
+		}
+
+		item, has := conn.Chats.ByIdentifier(args[0], true)
+		if !has {
+			return status("unknown chat")
+		}
+
+		if len(args) == 1 {
+			if !item.Snoozed(time.Now()) {
+				return status(item.Identifier + " isn't snoozed")
+			}
+			str := fmt.Sprintf(
+				"%s is snoozed until %s",
+				item.Identifier,
+				time.Unix(item.SnoozedUntil, 0).Format("2006-01-02 15:04"),
+			)
+			return status(str)
+		}
+
+		var d time.Duration
+		if strings.ToLower(args[1]) != "off" {
+			var err error
+			d, err = time.ParseDuration(args[1])
+			if err != nil || d <= 0 {
+				return status("invalid duration: " + args[1])
+			}
+		}
+		return conn.snoozeChat(client, item, d)
+
+	case "refresh":
+		switch len(args) {
+		case 0:
+			return conn.refreshChats(ctx, client, nil)
+		case 1:
+			item, has := conn.Chats.ByIdentifier(args[0], false)
+			if !has {
+				return status("unknown chat")
+			}
+			return conn.refreshChats(ctx, client, &item)
+		default:
+			return status("usage: refresh [chat]")
+		}
+
+	case "block", "unblock":
+		if len(args) != 1 {
+			return status(fmt.Sprintf("usage: %s <nick>", cmd))
+		}
+		return conn.setBlocked(ctx, client, args[0], cmd == "block")
+
+	case "blocked":
+		return conn.listBlocked(ctx, client)
+
+	case "channels":
+		kind := "all"
+		if len(args) > 0 {
+			kind = strings.ToLower(args[0])
+		}
+
+		switch kind {
+		case "all", "joined", "available", "private":
+			if len(args) <= 1 {
+				return conn.listChannels(client, kind)
+			}
+		}
+		return status("usage: channels [joined|available|private]")
+
+	default:
+		return status("unknown command: " + cmd)
+	}
+}
+
+// setPushname sets the pushname of the user on WhatsApp to the given name, and
+// reports the result to the given client.
+func (conn *Connection) setPushname(ctx context.Context, client *ircconnection.Connection, name string) error {
+	if n := utf8.RuneCountInString(name); n > maxPushnameLength {
+		str := fmt.Sprintf("name too long (%d characters, at most %d allowed)", n, maxPushnameLength)
+		return client.Status(str)
+	}
+
+	if conn.observed("setting name to " + name) {
+		return nil
+	}
+
+	if err := conn.WI.SetPushname(ctx, name); err != nil {
+		str := fmt.Sprintf("error while setting name: %s", err)
+		log.Println(str)
+		return client.Status(str)
+	}
+
+	conn.setMePushname(name)
+	err := conn.irc.SetName(name)
+	util.LogIfErr("error sending SETNAME", err)
+
+	return client.Status("name set to " + name)
+}
+
+// setMePushname sets the pushname of the user as known by the bridge to the
+// given name, returning whether or not it changed.
+func (conn *Connection) setMePushname(name string) (changed bool) {
+	conn.pushnameMutex.Lock()
+	defer conn.pushnameMutex.Unlock()
+
+	if conn.me.Pushname == name {
+		return false
+	}
+	conn.me.Pushname = name
+	return true
+}
+
+// listChannels sends the chats of the given kind to the given client as
+// notices: joined chats, group chats that can be joined, private chats, or all
+// of these.
+func (conn *Connection) listChannels(client *ircconnection.Connection, kind string) error {
+	var joined, available, private []string
+	for _, item := range conn.Chats.List(false) {
+		chat := item.Chat
+
+		switch {
+		case chat.IsChannel() && chat.Joined:
+			n := len(chat.Participants)
+			joined = append(joined, fmt.Sprintf(
+				"%s (%d %s)",
+				item.Identifier,
+				n,
+				util.Plural(n, "member", "members"),
+			))
+		case !chat.IsPrivate() && !chat.Left:
+			available = append(available, item.Identifier)
+		}
+
+		if chat.IsPrivate() {
+			private = append(private, item.Identifier)
+		}
+	}
+
+	sections := []struct {
+		kind, title string
+		lines       []string
+	}{
+		{"joined", "joined chats", joined},
+		{"available", "available group chats", available},
+		{"private", "private chats", private},
+	}
+
+	notice := func(line string) error {
+		return client.Notice(time.Now(), ircconnection.StatusNick(), client.Nick(), line)
+	}
+
+	for _, section := range sections {
+		if kind != "all" && kind != section.kind {
+			continue
+		}
+
+		sort.Strings(section.lines)
+		if err := notice(fmt.Sprintf("-- %s (%d) --", section.title, len(section.lines))); err != nil {
+			return err
+		}
+		for _, line := range section.lines {
+			if err := notice(line); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// listMedia sends the last count media items of the given chat to the given
+// client, downloading them first when they haven't been stored yet.
+func (conn *Connection) listMedia(ctx context.Context, client *ircconnection.Connection, item types.ChatListItem, count int) error {
+	messages, err := item.Chat.RawChat.GetMessagesFromChatTillDate(
+		ctx,
+		conn.WI,
+		0,
+	)
+	if err != nil {
+		return client.Status("error while retrieving messages: " + err.Error())
+	}
+
+	var media []whapp.Message
+	for i := len(messages) - 1; i >= 0 && len(media) < count; i-- {
+		if messages[i].IsMMS {
+			media = append(media, messages[i])
+		}
+	}
+	if len(media) == 0 {
+		return client.Status("no media found in " + item.Identifier)
+	}
+
+	lines := []string{fmt.Sprintf("-- recent media in %s --", item.Identifier)}
+	for i := len(media) - 1; i >= 0; i-- {
+		msg := media[i]
+
+		url := "--file--"
+		if conf.MediaMode != config.MediaDownload {
+			url = mediaPlaceholder(msg)
+		} else if err := conn.downloadAndStoreMedia(msg); err != nil {
+			log.Printf("error while downloading media: %s\n", err)
+		} else if f, has := fs.GetFileByHash(msg.MediaFileHash); has {
+			url = f.URL
+		}
+
+		name := msg.MediaFilename
+		if name == "" {
+			name = "-"
+		}
+
+		lines = append(lines, fmt.Sprintf(
+			"%s <%s> %s (%s, %s) %s: %s",
+			msg.Time().Format("2006-01-02 15:04"),
+			conn.senderName(msg),
+			msg.Type,
+			msg.MimeType,
+			util.FormatSize(msg.MediaData.Size),
+			name,
+			url,
+		))
+	}
+
+	return client.StatusList(lines)
+}
+
+// exportChat stores the message history of the given chat, as far as it's
+// known by WhatsApp Web, as a plain text file on the file server and sends its
+// URL to the given client.
+func (conn *Connection) exportChat(ctx context.Context, client *ircconnection.Connection, item types.ChatListItem) error {
+	messages, err := item.Chat.RawChat.GetMessagesFromChatTillDate(
+		ctx,
+		conn.WI,
+		0,
+	)
+	if err != nil {
+		return client.Status("error while retrieving messages: " + err.Error())
+	}
+
+	capped := len(messages) > maxExportMessages
+	if capped {
+		messages = messages[len(messages)-maxExportMessages:]
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "-- history of %s (%s) --\n", item.Identifier, item.Chat.Name)
+	if capped {
+		fmt.Fprintf(&buf, "-- capped to the last %d messages --\n", maxExportMessages)
+	}
+
+	participants := item.Chat.Participants
+	nick := conn.irc.Nick()
+	n := 0
+	for _, msg := range messages {
+		if msg.IsNotification {
+			continue
+		}
+
+		body := conn.getMessageBody(msg, participants, nick)
+		if strings.TrimSpace(body) == "" {
+			continue
+		}
+
+		fmt.Fprintf(
+			&buf,
+			"[%s] <%s> %s\n",
+			msg.Time().Format("2006-01-02 15:04:05"),
+			conn.senderName(msg),
+			strings.Replace(body, "\n", "\n\t", -1),
+		)
+		n++
+	}
+	if n == 0 {
+		return client.Status("no messages found in " + item.Identifier)
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return client.Status("error while creating export: " + err.Error())
+	}
+
+	f, err := fs.AddBlob("export-"+hex.EncodeToString(token), "txt", buf.Bytes(), files.Metadata{
+		MimeType: "text/plain; charset=utf-8",
+		Filename: strings.TrimPrefix(item.Identifier, "#") + ".txt",
+	})
+	if err != nil {
+		return client.Status("error while storing export: " + err.Error())
+	}
+
+	str := fmt.Sprintf(
+		"exported %d %s of %s: %s",
+		n,
+		util.Plural(n, "message", "messages"),
+		item.Identifier,
+		f.URL,
+	)
+	return client.Status(str)
+}
+
+// chatByMessageID returns the chat containing the message with the given
+// serialized ID.
+func (conn *Connection) chatByMessageID(id string) (types.ChatListItem, bool) {
+	for _, item := range conn.Chats.List(false) {
+		if item.Chat.HasMessageID(id) {
+			return item, true
+		}
+	}
+	return types.ChatListItem{}, false
+}
+
+// showMessage sends the full body of the message with the given serialized ID
+// in the given chat to the given client, refetching it from WhatsApp.
+func (conn *Connection) showMessage(ctx context.Context, client *ircconnection.Connection, item types.ChatListItem, id string) error {
+	msg, err := item.Chat.RawChat.GetMessage(ctx, conn.WI, id)
+	if err != nil {
+		return client.Status("error while retrieving message: " + err.Error())
+	}
+
+	participants := item.Chat.Participants
+	nick := client.Nick()
+
+	lines := []string{fmt.Sprintf(
+		"-- %s <%s> in %s --",
+		msg.Time().Format("2006-01-02 15:04"),
+		conn.senderName(msg),
+		item.Identifier,
+	)}
+	if quoted := msg.QuotedMessage; quoted != nil {
+		body := conn.getMessageBody(*quoted, participants, nick)
+		for _, line := range strings.Split(body, "\n") {
+			lines = append(lines, fmt.Sprintf("> <%s> %s", conn.senderName(*quoted), line))
+		}
+	}
+	for _, line := range strings.Split(conn.getMessageBody(msg, participants, nick), "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return client.StatusList(lines)
+}
+
+// sendLocation sends a location message with the given coordinates and name to
+// the chat of the given item.  Failures are reported to the given client as
+// notices.
+func (conn *Connection) sendLocation(ctx context.Context, client *ircconnection.Connection, item types.ChatListItem, latRaw, lngRaw, name string) error {
+	notice := func(line string) error {
+		return client.Notice(time.Now(), ircconnection.StatusNick(), client.Nick(), line)
+	}
+
+	lat, err := strconv.ParseFloat(latRaw, 64)
+	if err != nil || math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return notice("invalid latitude, it should be between -90 and 90")
+	}
+	lng, err := strconv.ParseFloat(lngRaw, 64)
+	if err != nil || math.IsNaN(lng) || lng < -180 || lng > 180 {
+		return notice("invalid longitude, it should be between -180 and 180")
+	}
+
+	if item.Chat != nil && isReadOnly(item.Chat) {
+		return notice("can't send to " + item.Identifier + " (announcements only)")
+	} else if conn.observed("sending location to " + item.Identifier) {
+		return nil
+	}
+
+	if err := item.Chat.RawChat.SendLocation(ctx, conn.WI, lat, lng, name); err != nil {
+		str := fmt.Sprintf("error while sending location: %s", err)
+		log.Println(str)
+		return notice(str)
+	}
+
+	return client.Status("location sent to " + item.Identifier)
+}
+
+// fetchMedia downloads the media of the message with the given serialized ID in
+// the given chat, if it hasn't been stored yet, and sends its URL to the given
+// client.
+func (conn *Connection) fetchMedia(ctx context.Context, client *ircconnection.Connection, item types.ChatListItem, id string) error {
+	if conf.MediaMode != config.MediaDownload {
+		return client.Status("media downloading is disabled by MEDIA_MODE")
+	}
+
+	msg, err := item.Chat.RawChat.GetMessage(ctx, conn.WI, id)
+	if err != nil {
+		return client.Status("error while retrieving message: " + err.Error())
+	} else if !msg.IsMMS {
+		return client.Status("message has no media")
+	}
+
+	if err := conn.downloadAndStoreMedia(msg); err != nil {
+		str := fmt.Sprintf("error while downloading media: %s", err)
+		log.Println(str)
+		return client.Status(str)
+	}
+
+	f, has := fs.GetFileByHash(msg.MediaFileHash)
+	if !has {
+		return client.Status("media could not be stored")
+	}
+	conn.setMediaFailed(id, false)
+
+	return client.Status(fmt.Sprintf("media of %s in %s: %s", id, item.Identifier, f.URL))
+}
+
+// partAll parts all joined group chats on IRC and, unless ircOnly is set,
+// leaves them on WhatsApp as well.  A summary is sent to the given client.
+func (conn *Connection) partAll(ctx context.Context, client *ircconnection.Connection, ircOnly bool) error {
+	if !ircOnly && conn.observed("leaving all group chats") {
+		ircOnly = true
+	}
+
+	left, failed := 0, 0
+	for _, item := range conn.Chats.List(false) {
+		chat := item.Chat
+		if !chat.IsGroupChat || !chat.Joined {
+			continue
+		}
+
+		if !ircOnly {
+			if err := chat.RawChat.Leave(ctx, conn.WI); err != nil {
+				log.Printf("error while leaving %s: %s\n", item.Identifier, err)
+				failed++
+				continue
+			}
+		}
+
+		str := fmt.Sprintf(":%s PART %s", conn.irc.Nick(), item.Identifier)
+		if err := conn.irc.WriteNow(str); err != nil {
+			return err
+		}
+		chat.Joined = false
+		left++
+	}
+
+	str := fmt.Sprintf("left %d group %s", left, util.Plural(left, "chat", "chats"))
+	if ircOnly {
+		str = fmt.Sprintf("parted %d group %s on IRC", left, util.Plural(left, "chat", "chats"))
+	}
+	if failed > 0 {
+		str += fmt.Sprintf(", failed to leave %d", failed)
+	}
+	return client.Status(str)
+}
+
+// connectionsString returns the amount of active connections of the server,
+// and the maximum amount if configured.
+func connectionsString() string {
+	n := atomic.LoadInt64(&activeConnections)
+	if conf.MaxConnections == 0 {
+		return fmt.Sprintf("%d", n)
+	}
+	return fmt.Sprintf("%d of %d", n, conf.MaxConnections)
+}
+
+// refreshChats refetches the metadata and participants of the chat of the
+// given item, or of all chats if item is nil, from WhatsApp.  The stored chats
+// are updated and participant nick and topic changes are sent to the clients.
+func (conn *Connection) refreshChats(ctx context.Context, client *ircconnection.Connection, item *types.ChatListItem) error {
+	rawChats, err := conn.WI.GetAllChats(ctx)
+	if err != nil {
+		return client.Status("error while retrieving chats: " + err.Error())
+	}
+
+	renamed := make(map[whapp.ID]bool)
+	refreshed, failed := 0, 0
+	for _, raw := range rawChats {
+		if item != nil && raw.ID != item.ID {
+			continue
+		}
+
+		participants, err := raw.Participants(ctx, conn.WI)
+		if err != nil {
+			log.Printf("error while refreshing participants of %s: %s\n", raw.ID, err)
+			failed++
+			continue
+		}
+
+		if err := conn.refreshChat(conn.convertChat(raw, participants), renamed); err != nil {
+			return err
+		}
+		refreshed++
+	}
+
+	if item != nil && refreshed == 0 && failed == 0 {
+		return client.Status(item.Identifier + " not found on WhatsApp")
+	}
+
+	str := fmt.Sprintf("refreshed %d %s", refreshed, util.Plural(refreshed, "chat", "chats"))
+	if failed > 0 {
+		str += fmt.Sprintf(", failed to refresh %d", failed)
+	}
+	return client.Status(str)
+}
+
+// renameParticipant updates the contact of the given participant of the chat
+// with the given ID in all other channels containing them, so that they have
+// the same nick in every channel.
+func (conn *Connection) renameParticipant(chatID whapp.ID, participant types.Participant) {
+	for _, item := range conn.Chats.ChannelsWith(participant.ID) {
+		if item.ID != chatID {
+			item.Chat.SetParticipantContact(participant.ID, participant.Contact)
+		}
+	}
+}
+
+// refreshChat replaces the stored chat with the same ID as the given one,
+// keeping its state, and sends the changes to the clients if the chat is
+// joined.  renamed contains the participants a NICK has already been sent for.
+func (conn *Connection) refreshChat(chat *types.Chat, renamed map[whapp.ID]bool) error {
+	old, has := conn.Chats.ByID(chat.ID, false)
+	if !has {
+		conn.addChat(chat)
+		return nil
+	}
+
+	chat.Joined = old.Chat.Joined
+	chat.MessageIDs = old.Chat.MessageIDs
+	item, _ := conn.Chats.Add(chat)
+
+	if !chat.IsChannel() || !chat.Joined {
+		return nil
+	}
+
+	oldNames := make(map[whapp.ID]string)
+	for _, p := range old.Chat.Participants {
+		oldNames[p.ID] = p.SafeName()
+	}
+
+	for _, p := range chat.Participants {
+		if p.ID == conn.me.SelfID {
+			continue
+		}
+
+		name := p.SafeName()
+		oldName, had := oldNames[p.ID]
+		delete(oldNames, p.ID)
+
+		var str string
+		if !had {
+			str = fmt.Sprintf(":%s JOIN %s", name, item.Identifier)
+		} else if oldName != name && !renamed[p.ID] {
+			// a NICK applies to every channel, so the participant is renamed
+			// in the other channels containing them as well.
+			renamed[p.ID] = true
+			conn.renameParticipant(chat.ID, p)
+			str = fmt.Sprintf(":%s NICK %s", oldName, name)
+		} else {
+			continue
+		}
+
+		if err := conn.irc.WriteNow(str); err != nil {
+			return err
+		}
+	}
+
+	for id, name := range oldNames {
+		if id == conn.me.SelfID {
+			continue
+		}
+
+		conn.rememberParticipant(old, id, name)
+
+		str := fmt.Sprintf(":%s PART %s", name, item.Identifier)
+		if err := conn.irc.WriteNow(str); err != nil {
+			return err
+		}
+	}
+
+	if topic := chatTopic(chat); topic != chatTopic(old.Chat) {
+		str := fmt.Sprintf(":whapp-irc TOPIC %s :%s", item.Identifier, topic)
+		return conn.irc.WriteNow(str)
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"whapp-irc/translate"
+	"whapp-irc/util"
+)
+
+// translateQueueSize is the maximum amount of messages waiting to be
+// translated, newer messages aren't translated when the queue is full.
+const translateQueueSize = 50
+
+// newTranslateBackoff returns the backoff used to pause translating after the
+// translation endpoint failed, so that a failing endpoint isn't hammered with
+// requests.
+func newTranslateBackoff() *util.Backoff {
+	return &util.Backoff{
+		InitialDelay: 10 * time.Second,
+		MaxDelay:     10 * time.Minute,
+		Multiplier:   2,
+	}
+}
+
+// translatable returns whether or not the given message should be translated,
+// which is the case for incoming text messages when translation is enabled.
+func translatable(msg Message) bool {
+	return conf.Translate &&
+		!msg.IsReply &&
+		!msg.IsTranslation &&
+		!msg.Message.IsSentByMe &&
+		!msg.Message.IsMMS &&
+		msg.Message.Type == "chat"
+}
+
+// withTranslation returns a message handler that handles messages using the
+// given handler, and queues them to have their translation sent on lines after
+// them.  Translating is done asynchronously, so that the translation endpoint
+// never holds up the delivery of messages.  It's only used for new messages,
+// replayed messages aren't translated.
+func withTranslation(fn MessageHandler) MessageHandler {
+	if !conf.Translate {
+		return fn
+	}
+
+	return func(conn *Connection, msg Message) error {
+		if err := fn(conn, msg); err != nil {
+			return err
+		} else if !translatable(msg) {
+			return nil
+		}
+
+		select {
+		case conn.translations <- msg:
+		default:
+			log.Printf("translation queue is full, not translating message %s\n", msg.Message.ID.Serialized)
+		}
+		return nil
+	}
+}
+
+// translateMessages translates the messages queued by withTranslation and
+// sends their translation using the given handler, until the given context is
+// done.  After the translation endpoint fails, messages aren't translated for
+// the delay given by conn.translateBackoff.
+func (conn *Connection) translateMessages(ctx context.Context, fn MessageHandler) {
+	var pausedUntil time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case msg := <-conn.translations:
+			if time.Now().Before(pausedUntil) {
+				continue
+			}
+
+			translated, err := conn.translateMessage(ctx, msg)
+			if err != nil {
+				delay, _ := conn.translateBackoff.Next()
+				pausedUntil = time.Now().Add(delay)
+				log.Printf("error while translating message, pausing translation for %s: %s\n", delay, err)
+				continue
+			}
+			conn.translateBackoff.Reset()
+
+			if translated.Body == "" {
+				continue
+			}
+			err = fn(conn, translated)
+			util.LogIfErr("error while sending translation", err)
+		}
+	}
+}
+
+// translateMessage returns the translation of the given message, with every
+// line prefixed with the configured language.  The body of the returned
+// message is empty when the message is in the configured language already.
+func (conn *Connection) translateMessage(ctx context.Context, msg Message) (Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, conf.TranslateTimeout)
+	defer cancel()
+
+	translation, err := translate.Translate(ctx, conf.TranslateURL, conf.TranslateLanguage, msg.Body)
+	if err != nil {
+		return Message{}, err
+	}
+
+	res := msg
+	res.Body = ""
+	res.IsTranslation = true
+	if strings.EqualFold(translation.Source, conf.TranslateLanguage) ||
+		strings.TrimSpace(translation.Text) == strings.TrimSpace(msg.Body) {
+		return res, nil
+	}
+
+	var lines []string
+	for _, line := range strings.Split(translation.Text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("[%s] %s", conf.TranslateLanguage, line))
+	}
+	res.Body = strings.Join(lines, "\n")
+	return res, nil
+}
@@ -0,0 +1,55 @@
+package translate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// request is the body of a request to a translation endpoint.
+type request struct {
+	Text   string `json:"text"`
+	Target string `json:"target"`
+}
+
+// Translation is the response of a translation endpoint.
+type Translation struct {
+	// Text is the translated text.
+	Text string `json:"text"`
+	// Source is the detected language of the original text, it's empty if the
+	// endpoint doesn't detect languages.
+	Source string `json:"source"`
+}
+
+// Translate translates the given text to the given target language using the
+// translation endpoint at the given URL.  The text is POSTed as a JSON object
+// with `text` and `target` fields, the endpoint responds with a JSON object
+// with `text` and optionally `source` fields.
+func Translate(ctx context.Context, url, target, text string) (Translation, error) {
+	body, err := json.Marshal(request{text, target})
+	if err != nil {
+		return Translation{}, err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return Translation{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return Translation{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return Translation{}, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	var translation Translation
+	err = json.NewDecoder(res.Body).Decode(&translation)
+	return translation, err
+}
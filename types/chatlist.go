@@ -1,12 +1,45 @@
 package types
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"strings"
 	"sync"
+	"time"
+	"whapp-irc/ircconnection"
 	"whapp-irc/whapp"
 )
 
+// reservedIdentifiers contains the identifiers used by whapp-irc itself, which
+// can't be used by chats.  The status nick is reserved as well, as is the nick
+// of WhatsApp itself so that no contact can pretend to be WhatsApp.
+var reservedIdentifiers = []string{
+	"whapp-irc",
+	"#unknown",
+	"#calls",
+	"#highlights",
+	"#whatsapp",
+	"whatsapp",
+}
+
+// idSuffixLength is the length of the hash suffix appended to colliding
+// identifiers when suffixes are derived from chat IDs.
+const idSuffixLength = 4
+
+func isReservedIdentifier(identifier string) bool {
+	if strings.EqualFold(identifier, ircconnection.StatusNick()) {
+		return true
+	}
+
+	for _, reserved := range reservedIdentifiers {
+		if strings.ToLower(identifier) == reserved {
+			return true
+		}
+	}
+	return false
+}
+
 // getIdentifierPrefix returns the given identifier, but stripping the last _
 // and everything after it. This is useful to strip the number from the
 // identifier and thus getting the original identifier.
@@ -22,15 +55,49 @@ func getIdentifierPrefix(identifier string) string {
 	return identifier
 }
 
+// NotificationLevel is the level of notifications the user wants to receive
+// for a chat.
+type NotificationLevel string
+
+const (
+	// NotifyAll delivers all messages in the chat.
+	NotifyAll NotificationLevel = "all"
+	// NotifyMentions only delivers messages mentioning the user, or quoting a
+	// message of the user.
+	NotifyMentions NotificationLevel = "mentions"
+	// NotifyNone delivers no messages in the chat at all.
+	NotifyNone NotificationLevel = "none"
+)
+
 // ChatListItem is the struct stored in a connection per chat item. It is also
-// used to persist the Identifier<->ID mapping on disk.
+// used to persist the Identifier<->ID mapping and per chat settings on disk.
 type ChatListItem struct {
 	Identifier string   `json:"identifier"`
 	ID         whapp.ID `json:"id"`
 
+	NotificationLevel NotificationLevel `json:"notificationLevel,omitempty"`
+
+	// SnoozedUntil is the unix timestamp until which no messages of the chat
+	// are delivered, zero when the chat isn't snoozed.
+	SnoozedUntil int64 `json:"snoozedUntil,omitempty"`
+
 	Chat *Chat `json:"-"`
 }
 
+// Notifications returns the notification level of the current item.
+func (item ChatListItem) Notifications() NotificationLevel {
+	if item.NotificationLevel == "" {
+		return NotifyAll
+	}
+	return item.NotificationLevel
+}
+
+// Snoozed returns whether or not the current item is snoozed at the given
+// time.
+func (item ChatListItem) Snoozed(now time.Time) bool {
+	return item.SnoozedUntil != 0 && now.Unix() < item.SnoozedUntil
+}
+
 // ChatList is a list of chats with some info.
 type ChatList struct {
 	mu    sync.RWMutex
@@ -44,21 +111,32 @@ func ChatListFromSlice(chats []ChatListItem) *ChatList {
 	}
 }
 
-// Add adds the given chat to the current list.
+// Add adds the given chat to the current list.  isNew is also true when the
+// chat was known already, but it got a new identifier because it switched
+// between being shown as a channel and as a query.
 func (l *ChatList) Add(chat *Chat) (res ChatListItem, isNew bool) {
 	identifier := chat.Identifier()
 	identifierLower := strings.ToLower(identifier)
 	n := 0 // number of other chats with the same identifier
+	if isReservedIdentifier(identifier) {
+		n++
+	}
 
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	existing := -1
 	for i, item := range l.chats {
 		// same chat as we already have, overwrite
 		if item.ID == chat.ID {
-			item.Chat = chat
-			l.chats[i] = item
-			return item, false
+			if strings.HasPrefix(item.Identifier, "#") == chat.IsChannel() {
+				item.Chat = chat
+				l.chats[i] = item
+				return item, false
+			}
+
+			existing = i
+			continue
 		}
 
 		ident := getIdentifierPrefix(item.Identifier)
@@ -68,9 +146,15 @@ func (l *ChatList) Add(chat *Chat) (res ChatListItem, isNew bool) {
 	}
 
 	// if there's another chat with the same identifier, append an unique
-	// number.
+	// suffix.
 	if n > 0 {
-		identifier = fmt.Sprintf("%s_%d", identifier, n+1)
+		identifier = l.uniqueIdentifier(identifier, chat.ID, n)
+	}
+
+	if existing > -1 {
+		l.chats[existing].Identifier = identifier
+		l.chats[existing].Chat = chat
+		return l.chats[existing], true
 	}
 
 	// chat is new, append it to the list
@@ -85,6 +169,44 @@ func (l *ChatList) Add(chat *Chat) (res ChatListItem, isNew bool) {
 	return item, true
 }
 
+// uniqueIdentifier returns the given identifier of the chat with the given ID,
+// with a suffix appended that isn't used by any other chat.  The suffix is
+// derived from the ID if configured, and otherwise it's the first free number
+// starting at n+1.  l.mu has to be held.
+func (l *ChatList) uniqueIdentifier(identifier string, id whapp.ID, n int) string {
+	taken := func(candidate string) bool {
+		if isReservedIdentifier(candidate) {
+			return true
+		}
+		for _, item := range l.chats {
+			if item.ID != id && strings.EqualFold(item.Identifier, candidate) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if idSuffixes {
+		sum := sha1.Sum([]byte(id.String()))
+		hash := hex.EncodeToString(sum[:])
+
+		// only lengthen the hash in the unlikely case of a collision.
+		for length := idSuffixLength; length <= len(hash); length++ {
+			candidate := identifier + "_" + hash[:length]
+			if !taken(candidate) {
+				return candidate
+			}
+		}
+	}
+
+	for i := n + 1; ; i++ {
+		candidate := fmt.Sprintf("%s_%d", identifier, i)
+		if !taken(candidate) {
+			return candidate
+		}
+	}
+}
+
 // List returns a slice containing all the chats in the current list, if
 // includeNil is true also items where the chat instance is nil will be
 // returned.
@@ -120,6 +242,28 @@ func (l *ChatList) ByID(id whapp.ID, allowNil bool) (item ChatListItem, found bo
 	return ChatListItem{}, false
 }
 
+// ChannelsWith returns the chats shown as channels on IRC of which the user with
+// the given ID is a participant.
+func (l *ChatList) ChannelsWith(id whapp.ID) []ChatListItem {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var res []ChatListItem
+	for _, item := range l.chats {
+		if item.Chat == nil || !item.Chat.IsChannel() {
+			continue
+		}
+
+		for _, p := range item.Chat.Participants {
+			if p.ID == id {
+				res = append(res, item)
+				break
+			}
+		}
+	}
+	return res
+}
+
 // ByIdentifier returns the chat with the given identifier, if any.
 func (l *ChatList) ByIdentifier(identifier string, allowNil bool) (item ChatListItem, found bool) {
 	identifier = strings.ToLower(identifier)
@@ -138,3 +282,33 @@ func (l *ChatList) ByIdentifier(identifier string, allowNil bool) (item ChatList
 	}
 	return ChatListItem{}, false
 }
+
+// SetNotificationLevel sets the notification level of the chat with the given
+// ID, returns whether or not the chat was found.
+func (l *ChatList) SetNotificationLevel(id whapp.ID, level NotificationLevel) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, item := range l.chats {
+		if item.ID == id {
+			l.chats[i].NotificationLevel = level
+			return true
+		}
+	}
+	return false
+}
+
+// SetSnoozedUntil sets the unix timestamp until which the chat with the given
+// ID is snoozed, zero unsnoozes it.  Returns whether or not the chat was found.
+func (l *ChatList) SetSnoozedUntil(id whapp.ID, until int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, item := range l.chats {
+		if item.ID == id {
+			l.chats[i].SnoozedUntil = until
+			return true
+		}
+	}
+	return false
+}
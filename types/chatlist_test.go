@@ -0,0 +1,63 @@
+package types
+
+import (
+	"strings"
+	"testing"
+	"whapp-irc/whapp"
+)
+
+func group(user, name string) *Chat {
+	return &Chat{
+		ID:          whapp.ID{Server: "g.us", User: user},
+		Name:        name,
+		IsGroupChat: true,
+	}
+}
+
+func TestAddSameNamedGroups(t *testing.T) {
+	defer SetIDSuffixes(idSuffixes)
+
+	for _, ids := range []bool{false, true} {
+		SetIDSuffixes(ids)
+
+		l := &ChatList{}
+		a, _ := l.Add(group("1", "Friends"))
+		b, _ := l.Add(group("2", "Friends"))
+
+		if a.Identifier != "#Friends" {
+			t.Errorf("id suffixes %t: first group got %s, expected #Friends", ids, a.Identifier)
+		}
+		if strings.EqualFold(a.Identifier, b.Identifier) {
+			t.Errorf("id suffixes %t: both groups got %s", ids, a.Identifier)
+		} else if !strings.HasPrefix(b.Identifier, "#Friends_") {
+			t.Errorf("id suffixes %t: second group got %s, expected a suffix", ids, b.Identifier)
+		}
+
+		// renaming the groups doesn't change their identifiers, so that their
+		// messages never end up in the same channel.
+		renamed, _ := l.Add(group("2", "Buddies"))
+		if renamed.Identifier != b.Identifier {
+			t.Errorf("id suffixes %t: second group changed from %s to %s", ids, b.Identifier, renamed.Identifier)
+		}
+	}
+}
+
+func TestIDSuffixIndependentOfCount(t *testing.T) {
+	defer SetIDSuffixes(idSuffixes)
+	SetIDSuffixes(true)
+
+	// the suffix of a chat only depends on its ID, not on how many other
+	// chats use the same name.
+	l1 := &ChatList{}
+	l1.Add(group("1", "Friends"))
+	x1, _ := l1.Add(group("3", "Friends"))
+
+	l2 := &ChatList{}
+	l2.Add(group("1", "Friends"))
+	l2.Add(group("2", "Friends"))
+	x2, _ := l2.Add(group("3", "Friends"))
+
+	if x1.Identifier != x2.Identifier {
+		t.Errorf("identifier depends on other chats: %s and %s", x1.Identifier, x2.Identifier)
+	}
+}
@@ -13,6 +13,31 @@ var (
 	nonNumberRegex = regexp.MustCompile(`[^\d]`)
 )
 
+var contactPrefix, contactSuffix string
+
+var privateChannels bool
+
+var idSuffixes bool
+
+// SetContactAffixes sets the prefix and suffix added to the identifiers of
+// private chats.
+func SetContactAffixes(prefix, suffix string) {
+	contactPrefix = prefix
+	contactSuffix = suffix
+}
+
+// SetPrivateChannels sets whether or not private chats are shown as channels
+// on IRC, instead of as queries.
+func SetPrivateChannels(enabled bool) {
+	privateChannels = enabled
+}
+
+// SetIDSuffixes sets whether or not the suffix appended to colliding
+// identifiers is derived from the ID of the chat, instead of being a number.
+func SetIDSuffixes(enabled bool) {
+	idSuffixes = enabled
+}
+
 // A Participant is an user on WhatsApp.
 type Participant whapp.Participant
 
@@ -41,11 +66,16 @@ type Chat struct {
 	Name string
 
 	IsGroupChat  bool
+	IsBroadcast  bool
 	Participants []Participant
 
 	Joined     bool
 	MessageIDs []string
 
+	// Left is true for group chats the user left or was removed from, which
+	// aren't joined again when a message arrives in them.
+	Left bool
+
 	RawChat whapp.Chat
 }
 
@@ -54,21 +84,75 @@ func (c *Chat) SafeName() string {
 	return ircconnection.SafeString(c.Name)
 }
 
+// IsPrivate returns whether or not the current chat is a private chat with a
+// single contact.
+func (c *Chat) IsPrivate() bool {
+	return !c.IsGroupChat && !c.IsBroadcast
+}
+
+// IsChannel returns whether or not the current chat is shown as a channel on
+// IRC, which is the case for group chats and broadcast lists, and for private
+// chats if configured.
+func (c *Chat) IsChannel() bool {
+	return !c.IsPrivate() || privateChannels
+}
+
 // Identifier returns the safe IRC identifier for the current chat.
+// Broadcast lists are prefixed with `broadcast-`, so that they can't be
+// confused with group chats.
 func (c *Chat) Identifier() string {
 	prefix := ""
-	if c.IsGroupChat {
+	if c.IsBroadcast {
+		prefix = "#broadcast-"
+	} else if c.IsChannel() {
 		prefix = "#"
 	}
 
 	name := c.SafeName()
-	if !c.IsGroupChat && len(name) > 0 && name[0] == '+' {
+	if c.IsPrivate() && len(name) > 0 && name[0] == '+' {
 		name = name[1:]
 	}
+	if c.IsPrivate() {
+		name = contactPrefix + name + contactSuffix
+	}
 
 	return prefix + name
 }
 
+// AddParticipant adds the given participant to the current chat, if it isn't a
+// participant already.
+func (c *Chat) AddParticipant(participant Participant) {
+	for _, p := range c.Participants {
+		if p.ID == participant.ID {
+			return
+		}
+	}
+	c.Participants = append(c.Participants, participant)
+}
+
+// RemoveParticipant removes the participant with the given id from the current
+// chat.
+func (c *Chat) RemoveParticipant(id whapp.ID) {
+	for i, p := range c.Participants {
+		if p.ID == id {
+			c.Participants = append(c.Participants[:i], c.Participants[i+1:]...)
+			return
+		}
+	}
+}
+
+// SetParticipantContact sets the contact of the participant with the given id
+// of the current chat, returns false if there is no such participant.
+func (c *Chat) SetParticipantContact(id whapp.ID, contact whapp.Contact) bool {
+	for i, p := range c.Participants {
+		if p.ID == id {
+			c.Participants[i].Contact = contact
+			return true
+		}
+	}
+	return false
+}
+
 // AddMessageID adds the given id to the chat, so that it's known as
 // received/sent.
 func (c *Chat) AddMessageID(id string) {
@@ -95,4 +179,26 @@ type User struct {
 	LocalStorage         map[string]string `json:"localStorage"`
 	LastReceivedReceipts map[string]int64  `json:"lastReceivedReceipts"`
 	Chats                []ChatListItem    `json:"chats"`
+
+	Settings Settings `json:"settings"`
+
+	// Watchwords contains the words the user is highlighted on in all chats.
+	Watchwords []string `json:"watchwords,omitempty"`
+
+	Privacy Privacy `json:"privacy"`
+}
+
+// Privacy contains the presence information the user doesn't share on
+// WhatsApp.  The zero value shares everything.
+type Privacy struct {
+	HideOnline   bool `json:"hideOnline,omitempty"`
+	HideTyping   bool `json:"hideTyping,omitempty"`
+	HideReceipts bool `json:"hideReceipts,omitempty"`
+}
+
+// Settings contains the settings of a user, overriding the configuration.  An
+// empty value means the configured value is used.
+type Settings struct {
+	MapProvider string `json:"mapProvider,omitempty"`
+	Formatting  string `json:"formatting,omitempty"`
 }
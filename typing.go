@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"time"
+	"whapp-irc/ircconnection"
+	"whapp-irc/types"
+	"whapp-irc/whapp"
+)
+
+// the minimum time between two typing notifications with the same state sent
+// to the same WhatsApp chat.  IRC clients resend their typing state every few
+// seconds, WhatsApp shows the state for a lot longer.
+const typingInterval = 10 * time.Second
+
+type typingState struct {
+	active bool
+	sent   time.Time
+}
+
+// getTyping returns the typing state set by the given tags, and whether or not
+// a typing state was set at all.
+func getTyping(tags ircconnection.Tags) (active, ok bool) {
+	for _, key := range []string{"+draft/typing", "+typing"} {
+		switch tags[key] {
+		case "active":
+			return true, true
+		case "paused", "done":
+			return false, true
+		}
+	}
+
+	return false, false
+}
+
+// sendTyping forwards the given typing state to the chat of the given item,
+// unless the same state has been sent to it recently.
+func (conn *Connection) sendTyping(ctx context.Context, item types.ChatListItem, active bool) error {
+	if item.Chat == nil || conf.ObserverMode || inMaintenance() {
+		return nil
+	} else if conn.getPrivacy().HideTyping {
+		return nil
+	}
+
+	conn.typingMutex.Lock()
+	if conn.typingStates == nil {
+		conn.typingStates = make(map[whapp.ID]typingState)
+	}
+	prev, has := conn.typingStates[item.ID]
+	if !has && !active {
+		conn.typingMutex.Unlock()
+		return nil
+	} else if has && prev.active == active && time.Since(prev.sent) < typingInterval {
+		conn.typingMutex.Unlock()
+		return nil
+	}
+	if active {
+		conn.typingStates[item.ID] = typingState{active, time.Now()}
+	} else {
+		delete(conn.typingStates, item.ID)
+	}
+	conn.typingMutex.Unlock()
+
+	return item.Chat.RawChat.SetTyping(ctx, conn.WI, active)
+}
+
+// resetTyping forgets the typing state of the chat with the given ID, which
+// WhatsApp resets itself when a message is sent.
+func (conn *Connection) resetTyping(id whapp.ID) {
+	conn.typingMutex.Lock()
+	delete(conn.typingStates, id)
+	conn.typingMutex.Unlock()
+}
@@ -0,0 +1,73 @@
+package util
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Backoff keeps track of the delays between subsequent attempts of an
+// operation, multiplying the delay after every attempt.
+type Backoff struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	MaxAttempts  int // 0 means unlimited
+
+	mutex   sync.Mutex
+	attempt int
+	delay   time.Duration
+}
+
+// Next returns the delay to wait before the next attempt, or false if the
+// maximum amount of attempts has been reached.
+func (b *Backoff) Next() (time.Duration, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.MaxAttempts > 0 && b.attempt >= b.MaxAttempts {
+		return 0, false
+	}
+
+	if b.attempt == 0 {
+		b.delay = b.InitialDelay
+	} else {
+		b.delay = time.Duration(float64(b.delay) * b.Multiplier)
+	}
+	if b.delay > b.MaxDelay {
+		b.delay = b.MaxDelay
+	}
+
+	b.attempt++
+	return b.delay, true
+}
+
+// Reset resets the current backoff, so that the next attempt uses the initial
+// delay again.
+func (b *Backoff) Reset() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.attempt = 0
+	b.delay = 0
+}
+
+func (b *Backoff) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	maxAttempts := "unlimited"
+	if b.MaxAttempts > 0 {
+		maxAttempts = fmt.Sprintf("%d", b.MaxAttempts)
+	}
+
+	return fmt.Sprintf(
+		"attempt %d of %s, current delay %s (initial %s, max %s, multiplier %g)",
+		b.attempt,
+		maxAttempts,
+		b.delay,
+		b.InitialDelay,
+		b.MaxDelay,
+		b.Multiplier,
+	)
+}
@@ -1,8 +1,10 @@
 package util
 
 import (
+	"fmt"
 	"log"
 	"mime"
+	"strings"
 	"time"
 
 	"github.com/h2non/filetype"
@@ -47,6 +49,45 @@ func Plural(count int, singular, plural string) string {
 	return plural
 }
 
+// FormatSize returns the given amount of bytes as a human readable string.
+func FormatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// Truncate returns the given string cut off after max runes, with an ellipsis
+// appended when it has been cut off.
+func Truncate(str string, max int) string {
+	return TruncateWith(str, max, "…")
+}
+
+// TruncateWith returns the given string cut off after max runes, with the
+// given ellipsis appended when it has been cut off.
+func TruncateWith(str string, max int, ellipsis string) string {
+	runes := []rune(str)
+	if len(runes) <= max {
+		return str
+	}
+	return string(runes[:max]) + ellipsis
+}
+
+// Snippet returns the given text on a single line, with all whitespace
+// (including newlines) collapsed, cut off after max runes with the given
+// ellipsis appended.
+func Snippet(text string, max int, ellipsis string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	return TruncateWith(text, max, ellipsis)
+}
+
 // LogMessage logs the given chat message to the log.
 func LogMessage(time time.Time, from, to, message string) {
 	timeStr := time.Format("2006-01-02 15:04:05")
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// virtualChannel is a channel that doesn't correspond to a WhatsApp chat, but
+// aggregates messages of multiple chats.
+type virtualChannel struct {
+	name  string
+	topic string
+}
+
+var (
+	// unknownChannel is the channel messages from unknown senders are sent
+	// to, if configured.
+	unknownChannel = virtualChannel{
+		name:  "#unknown",
+		topic: "Messages from senders not in your contacts",
+	}
+
+	// callsChannel is the channel call events are sent to, if configured.
+	callsChannel = virtualChannel{
+		name:  "#calls",
+		topic: "Calls of all chats",
+	}
+
+	// whatsappChannel is the channel messages from WhatsApp itself are sent
+	// to.
+	whatsappChannel = virtualChannel{
+		name:  "#whatsapp",
+		topic: "Messages from WhatsApp itself",
+	}
+
+	// highlightsChannel is the channel highlights of watchwords are sent to,
+	// if configured.
+	highlightsChannel = virtualChannel{
+		name:  "#highlights",
+		topic: "Messages containing your watchwords",
+	}
+)
+
+// sendJoin sends the JOIN and topic of the current channel to the given
+// client, on the given date.
+func (ch virtualChannel) sendJoin(client ircClient, date time.Time) error {
+	str := fmt.Sprintf(":%s JOIN %s", client.Nick(), ch.name)
+	if err := client.Write(date, str); err != nil {
+		return err
+	}
+
+	topic := fmt.Sprintf(":whapp-irc 332 %s %s :%s", client.Nick(), ch.name, ch.topic)
+	client.Write(date, topic)
+
+	return client.Write(date, fmt.Sprintf(
+		":whapp-irc 366 %s %s :End of /NAMES list.",
+		client.Nick(),
+		ch.name,
+	))
+}
+
+// joinVirtualChannel joins the given channel on the given date, if it hasn't
+// been joined yet.  The lock isn't held while sending the join, since clients
+// attaching list the joined channels while writes wait for them.
+func (conn *Connection) joinVirtualChannel(ch virtualChannel, date time.Time) error {
+	conn.virtualChannelsMutex.Lock()
+	for _, joined := range conn.virtualChannels {
+		if joined == ch {
+			conn.virtualChannelsMutex.Unlock()
+			return nil
+		}
+	}
+	conn.virtualChannels = append(conn.virtualChannels, ch)
+	conn.virtualChannelsMutex.Unlock()
+
+	return ch.sendJoin(conn.irc, date)
+}
+
+// joinedVirtualChannels returns the virtual channels that have been joined.
+func (conn *Connection) joinedVirtualChannels() []virtualChannel {
+	conn.virtualChannelsMutex.Lock()
+	defer conn.virtualChannelsMutex.Unlock()
+
+	return append([]virtualChannel{}, conn.virtualChannels...)
+}
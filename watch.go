@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+	"whapp-irc/ircconnection"
+	"whapp-irc/types"
+	"whapp-irc/util"
+	"whapp-irc/whapp"
+)
+
+// maxHighlightLength is the maximum length of the message body in a highlight.
+const maxHighlightLength = 300
+
+// containsWord returns whether or not the given text contains the given word,
+// case-insensitively, not as part of a longer word.
+func containsWord(text, word string) bool {
+	text = strings.ToLower(text)
+	word = strings.ToLower(word)
+
+	isWordRune := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	}
+
+	for offset := 0; ; {
+		i := strings.Index(text[offset:], word)
+		if i == -1 {
+			return false
+		}
+		start := offset + i
+		end := start + len(word)
+
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if (start == 0 || !isWordRune(before)) && (end == len(text) || !isWordRune(after)) {
+			return true
+		}
+
+		_, size := utf8.DecodeRuneInString(text[start:])
+		offset = start + size
+	}
+}
+
+// getWatchwords returns a copy of the watchwords of the user.
+func (conn *Connection) getWatchwords() []string {
+	conn.watchMutex.Lock()
+	defer conn.watchMutex.Unlock()
+
+	return append([]string{}, conn.watchwords...)
+}
+
+// setWatchwords replaces the watchwords of the user, as stored in the
+// database.
+func (conn *Connection) setWatchwords(words []string) {
+	conn.watchMutex.Lock()
+	defer conn.watchMutex.Unlock()
+
+	conn.watchwords = words
+}
+
+// addWatchword adds the given word to the watchwords of the user, returns
+// false if it was watched already.
+func (conn *Connection) addWatchword(word string) bool {
+	conn.watchMutex.Lock()
+	defer conn.watchMutex.Unlock()
+
+	for _, w := range conn.watchwords {
+		if strings.EqualFold(w, word) {
+			return false
+		}
+	}
+	conn.watchwords = append(conn.watchwords, word)
+	return true
+}
+
+// removeWatchword removes the given word from the watchwords of the user,
+// returns false if it wasn't watched.
+func (conn *Connection) removeWatchword(word string) bool {
+	conn.watchMutex.Lock()
+	defer conn.watchMutex.Unlock()
+
+	for i, w := range conn.watchwords {
+		if strings.EqualFold(w, word) {
+			conn.watchwords = append(conn.watchwords[:i], conn.watchwords[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// checkWatchwords sends a highlight to the user if the given message, received
+// in the chat of the given item, contains any of the watchwords of the user.
+// Highlights are sent to the status user, or to the highlights channel if
+// configured.
+func (conn *Connection) checkWatchwords(item types.ChatListItem, msg whapp.Message) error {
+	words := conn.getWatchwords()
+	if len(words) == 0 || msg.IsSentByMe {
+		return nil
+	}
+
+	body := conn.getMessageBody(msg, item.Chat.Participants, conn.irc.Nick())
+	body = strings.Join(strings.Fields(body), " ")
+
+	var matched string
+	for _, word := range words {
+		if containsWord(body, word) {
+			matched = word
+			break
+		}
+	}
+	if matched == "" {
+		return nil
+	}
+
+	sender := conn.senderName(msg)
+	if !item.Chat.IsChannel() {
+		sender = item.Identifier
+	}
+	line := fmt.Sprintf(
+		"[%s] %s in %s: <%s> %s",
+		matched,
+		msg.Time().Format("15:04"),
+		item.Identifier,
+		sender,
+		util.Truncate(body, maxHighlightLength),
+	)
+
+	if !conf.HighlightsChannel {
+		return conn.irc.Notice(msg.Time(), ircconnection.StatusNick(), conn.irc.Nick(), line)
+	}
+
+	if err := conn.joinVirtualChannel(highlightsChannel, msg.Time()); err != nil {
+		return err
+	}
+	return conn.irc.Notice(msg.Time(), "whapp-irc", highlightsChannel.name, line)
+}
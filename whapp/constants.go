@@ -3,6 +3,9 @@ package whapp
 const url = "https://web.whatsapp.com"
 const userAgent = "Mozilla/5.0 (Windows NT 5.1) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/61.0.3163.100 Safari/537.36"
 
+// systemID is the ID of the chat WhatsApp itself sends messages from.
+var systemID = ID{User: "0", Server: "c.us"}
+
 var cryptKeys = map[string]string{
 	"image":    "576861747341707020496d616765204b657973",
 	"sticker":  "576861747341707020496d616765204b657973",
@@ -1,48 +1,126 @@
 package whapp
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"hash"
+	"io"
 
 	"golang.org/x/crypto/hkdf"
 )
 
-func decryptFile(fileBytes []byte, mediaKeyb64, cryptKey string) ([]byte, error) {
+// macLength is the length of the MAC appended to encrypted media.
+const macLength = 10
+
+// decryptChunkSize is the amount of bytes decrypted at once when streaming.
+const decryptChunkSize = 64 * aes.BlockSize
+
+// getDecrypter returns the decrypter of media encrypted with the given keys,
+// and the MAC of the media to be fed the encrypted bytes.
+func getDecrypter(mediaKeyb64, cryptKey string) (cipher.BlockMode, hash.Hash, error) {
 	mediaKey, err := base64.StdEncoding.DecodeString(mediaKeyb64)
 	if err != nil {
-		return []byte{}, err
+		return nil, nil, err
 	}
 
 	cryptKeyBytes, err := hex.DecodeString(cryptKey)
 	if err != nil {
-		return []byte{}, err
+		return nil, nil, err
 	}
 
-	hash := hkdf.New(sha256.New, mediaKey, nil, cryptKeyBytes)
+	kdf := hkdf.New(sha256.New, mediaKey, nil, cryptKeyBytes)
 	bytes := make([]byte, 112)
-	if _, err = hash.Read(bytes); err != nil {
-		return []byte{}, err
+	if _, err = kdf.Read(bytes); err != nil {
+		return nil, nil, err
 	}
 
 	iv := bytes[:16]
 	chiperKey := bytes[16 : 16+32]
-	eFile := fileBytes[:len(fileBytes)-10]
+	macKey := bytes[16+32 : 16+32+32]
 
 	block, err := aes.NewCipher(chiperKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(iv)
+
+	return cipher.NewCBCDecrypter(block, iv), mac, nil
+}
+
+func decryptFile(fileBytes []byte, mediaKeyb64, cryptKey string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := decryptFileTo(
+		&buf,
+		bytes.NewReader(fileBytes),
+		int64(len(fileBytes)),
+		mediaKeyb64,
+		cryptKey,
+	)
 	if err != nil {
 		return []byte{}, err
 	}
+	return buf.Bytes(), nil
+}
+
+// decryptFileTo decrypts the encrypted media of the given size read from r,
+// and writes the result to w, without keeping the whole file in memory.  When
+// the media doesn't match its MAC ErrMediaCorrupt is returned, after the
+// media has been written, and when r ends before size bytes ErrMediaTruncated
+// is returned.
+func decryptFileTo(w io.Writer, r io.Reader, size int64, mediaKeyb64, cryptKey string) error {
+	mode, mac, err := getDecrypter(mediaKeyb64, cryptKey)
+	if err != nil {
+		return err
+	}
+
+	remaining := size - macLength
+	if remaining < 0 {
+		return ErrMediaTruncated
+	}
+
+	buf := make([]byte, decryptChunkSize)
+	for remaining > 0 {
+		n := int64(len(buf))
+		if remaining < n {
+			n = remaining
+		}
+
+		chunk := buf[:n]
+		if _, err := io.ReadFull(r, chunk); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrMediaTruncated
+		} else if err != nil {
+			return err
+		}
+		remaining -= n
+		mac.Write(chunk)
 
-	rawSize := len(eFile)
-	for len(eFile)%aes.BlockSize != 0 {
-		eFile = append(eFile, 0)
+		// the last chunk is padded to a whole amount of blocks.
+		for len(chunk)%aes.BlockSize != 0 {
+			chunk = append(chunk, 0)
+		}
+		mode.CryptBlocks(chunk, chunk)
+
+		if _, err := w.Write(chunk[:n]); err != nil {
+			return err
+		}
 	}
 
-	mode := cipher.NewCBCDecrypter(block, iv)
-	mode.CryptBlocks(eFile, eFile)
+	expected := make([]byte, macLength)
+	if _, err := io.ReadFull(r, expected); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrMediaTruncated
+	} else if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac.Sum(nil)[:macLength], expected) {
+		return ErrMediaCorrupt
+	}
 
-	return eFile[:rawSize], nil
+	return nil
 }
@@ -0,0 +1,130 @@
+package whapp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// encryptMedia returns the given media encrypted like WhatsApp does, using a
+// new media key, and that media key.  The size of media has to be a multiple
+// of the AES block size.
+func encryptMedia(t *testing.T, media []byte, cryptKey string) (encrypted []byte, mediaKeyb64 string) {
+	mediaKey := make([]byte, 32)
+	if _, err := rand.Read(mediaKey); err != nil {
+		t.Fatal(err)
+	}
+	cryptKeyBytes, err := hex.DecodeString(cryptKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make([]byte, 112)
+	kdf := hkdf.New(sha256.New, mediaKey, nil, cryptKeyBytes)
+	if _, err := io.ReadFull(kdf, keys); err != nil {
+		t.Fatal(err)
+	}
+	iv, cipherKey, macKey := keys[:16], keys[16:48], keys[48:80]
+
+	block, err := aes.NewCipher(cipherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted = make([]byte, len(media))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, media)
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(iv)
+	mac.Write(encrypted)
+	encrypted = append(encrypted, mac.Sum(nil)[:macLength]...)
+
+	return encrypted, base64.StdEncoding.EncodeToString(mediaKey)
+}
+
+func TestDecryptShortReads(t *testing.T) {
+	media := bytes.Repeat([]byte("whapp-irc media!"), 8)
+	cryptKey := getCryptKey("image")
+	encrypted, mediaKey := encryptMedia(t, media, cryptKey)
+	size := int64(len(encrypted))
+
+	// reads returning less than asked for are fine.
+	var buf bytes.Buffer
+	r := iotest.OneByteReader(bytes.NewReader(encrypted))
+	if err := decryptFileTo(&buf, r, size, mediaKey, cryptKey); err != nil {
+		t.Errorf("short reads: got error %s", err)
+	} else if !bytes.Equal(buf.Bytes(), media) {
+		t.Errorf("short reads: decrypted media differs")
+	}
+
+	// a reader ending before the reported size is truncated, wherever it
+	// ends.
+	for _, n := range []int64{0, macLength - 1, size / 2, size - 1} {
+		r := io.LimitReader(bytes.NewReader(encrypted), n)
+		if err := decryptFileTo(ioutil.Discard, r, size, mediaKey, cryptKey); err != ErrMediaTruncated {
+			t.Errorf("reader ending after %d bytes: got %v, expected %s", n, err, ErrMediaTruncated)
+		}
+	}
+}
+
+func TestDownloadMediaTo(t *testing.T) {
+	media := bytes.Repeat([]byte("whapp-irc media!"), 8)
+	encrypted, mediaKey := encryptMedia(t, media, getCryptKey("image"))
+
+	dir, err := ioutil.TempDir("", "whapp-irc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name      string
+		served    []byte
+		mediaSize int64
+		err       error
+	}{
+		{"complete", encrypted, int64(len(media)), nil},
+		{"size unknown", encrypted, 0, nil},
+		{"empty", []byte{}, int64(len(media)), ErrMediaTruncated},
+		{"shorter than the MAC", encrypted[:macLength-1], 0, ErrMediaTruncated},
+		{"cut off", encrypted[:len(encrypted)/2], int64(len(media)), ErrMediaCorrupt},
+		{"smaller than reported", encrypted, int64(len(media)) + 1, ErrMediaTruncated},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(test.served)
+		}))
+
+		msg := Message{
+			Type:           "image",
+			IsMMS:          true,
+			MediaKey:       mediaKey,
+			MediaClientURL: server.URL,
+			MediaSize:      test.mediaSize,
+		}
+		var buf bytes.Buffer
+		err := msg.DownloadMediaTo(&buf, filepath.Join(dir, "media.part"))
+		server.Close()
+
+		if err != test.err {
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.err)
+		} else if err == nil && !bytes.Equal(buf.Bytes(), media) {
+			t.Errorf("%s: downloaded media differs", test.name)
+		}
+	}
+}
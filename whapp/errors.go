@@ -10,6 +10,18 @@ var ErrLoggedIn = errors.New("logged in, should be logged out")
 // expects you to be logged in, but you are logged out.
 var ErrLoggedOut = errors.New("logged out, should be logged in")
 
+// ErrMessageNotFound will be returned as an error when the requested message
+// couldn't be found.
+var ErrMessageNotFound = errors.New("message not found")
+
+// ErrMediaCorrupt will be returned as an error when downloaded media doesn't
+// match its MAC, such as when the download got cut off.
+var ErrMediaCorrupt = errors.New("media is corrupt")
+
+// ErrMediaTruncated will be returned as an error when downloaded media is
+// empty, or smaller than the size WhatsApp reported for it.
+var ErrMediaTruncated = errors.New("media is truncated")
+
 // ErrCDPUnknown will be returned in some cases as an error when the called
 // function/method encountered an unknown error with CDP.
 var ErrCDPUnknown = errors.New("unknown CDP error")
@@ -0,0 +1,45 @@
+package whapp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/jpeg"
+)
+
+// the sizes of the small and large versions of a chat icon, in pixels.
+const (
+	iconSmallSize = 96
+	iconLargeSize = 640
+)
+
+// makeIcon crops the given image to a square and scales it to the given size,
+// returning it as a JPEG data URL.
+func makeIcon(img image.Image, size int) (string, error) {
+	bounds := img.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	offset := image.Pt(
+		bounds.Min.X+(bounds.Dx()-side)/2,
+		bounds.Min.Y+(bounds.Dy()-side)/2,
+	)
+
+	// nearest-neighbour scaling, good enough for icons.
+	res := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			src := offset.Add(image.Pt(x*side/size, y*side/size))
+			res.Set(x, y, img.At(src.X, src.Y))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, res, nil); err != nil {
+		return "", err
+	}
+
+	str := base64.StdEncoding.EncodeToString(buf.Bytes())
+	return "data:image/jpeg;base64," + str, nil
+}
@@ -22,6 +22,10 @@ func (wi *Instance) inject(ctx context.Context) error {
 
 	var whappGo = {};
 
+	// messages that couldn't be decrypted yet, they're reported again once
+	// their content arrives.
+	whappGo.undecryptedMsgs = [];
+
 	whappGo.setupStore = async function () {
 		const fetchWebpack = function (id) {
 			return new Promise(function (resolve) {
@@ -68,6 +72,45 @@ func (wi *Instance) inject(ctx context.Context) error {
 		};
 	}
 
+	whappGo.interactiveToJSON = function (msg) {
+		var options = [];
+		var body = msg.body;
+		var header = msg.title;
+
+		if (msg.dynamicReplyButtons) {
+			options = msg.dynamicReplyButtons.map(function (b) {
+				return b.buttonText && b.buttonText.displayText;
+			});
+		} else if (msg.hydratedButtons) {
+			options = msg.hydratedButtons.map(function (b) {
+				var button = b.quickReplyButton || b.urlButton || b.callButton || {};
+				return button.displayText;
+			});
+		} else if (msg.list && msg.list.sections) {
+			header = header || msg.list.title;
+			body = body || msg.list.description;
+			msg.list.sections.forEach(function (section) {
+				(section.rows || []).forEach(function (row) {
+					options.push(row.title);
+				});
+			});
+		}
+
+		options = options.filter(function (o) {
+			return typeof o === 'string' && o !== '';
+		});
+		if (options.length === 0) {
+			return undefined;
+		}
+
+		return {
+			header: header || '',
+			body: typeof body === 'string' ? body : '',
+			footer: msg.footer || '',
+			options: options,
+		};
+	};
+
 	whappGo.msgToJSON = function (msg) {
 		if (msg == null) {
 			return msg;
@@ -95,6 +138,12 @@ func (wi *Instance) inject(ctx context.Context) error {
 		res.quotedMsgObj = whappGo.msgToJSON(msg.quotedMsgObj());
 		res.mediaData = msg.mediaData && msg.mediaData.toJSON();
 		res.recipients = msg.recipients;
+		res.ephemeralDuration = msg.ephemeralDuration;
+		res.pinMessageType = msg.pinMessageType;
+		res.pinnedMsgId = msg.parentMsgKey && msg.parentMsgKey.toString();
+		res.reactionText = msg.reactionText;
+		res.reactionParentId = msg.parentMsgKey && msg.parentMsgKey.toString();
+		res.interactive = whappGo.interactiveToJSON(msg);
 
 		if (res.lat != null || res.lng != null) {
 			res.location = {
@@ -142,6 +191,8 @@ func (wi *Instance) inject(ctx context.Context) error {
 
 			kind: chat.kind,
 			isGroup: chat.isGroup,
+			isCommunity: metadata != null && !!metadata.isParentGroup,
+			isAnnouncement: metadata != null && !!metadata.announce,
 			contact: whappGo.contactToJSON(chat.contact),
 			groupMetadata: metadata,
 			description: description,
@@ -156,6 +207,9 @@ func (wi *Instance) inject(ctx context.Context) error {
 
 		return {
 			timestamp: presence.chatstate && presence.chatstate.t,
+			lastSeen: presence.chatstate &&
+				presence.chatstate.type === 'unavailable' &&
+				presence.chatstate.t,
 			type: presence.type,
 			id: presence.id,
 			chatActive: presence.chatActive,
@@ -170,6 +224,14 @@ func (wi *Instance) inject(ctx context.Context) error {
 		const chats = Store.Chat.models;
 		let res = [];
 
+		whappGo.undecryptedMsgs = whappGo.undecryptedMsgs.filter(function (msg) {
+			if (msg.type === 'ciphertext') {
+				return true;
+			}
+			res.push(whappGo.msgToJSON(msg));
+			return false;
+		});
+
 		for (const chat of chats) {
 			if (chat == null) {
 				continue;
@@ -194,6 +256,10 @@ func (wi *Instance) inject(ctx context.Context) error {
 					continue;
 				}
 
+				if (msg.type === 'ciphertext') {
+					whappGo.undecryptedMsgs.push(msg);
+				}
+
 				res.unshift(whappGo.msgToJSON(msg));
 			}
 		}
@@ -202,22 +268,6 @@ func (wi *Instance) inject(ctx context.Context) error {
 	};
 
 	whappGo.sendMessage = function (id, message, replyID) {
-		/*
-		var splitted = replyID.split('_');
-		var replyObj = {
-			contextInfo: function () {
-				return {
-					"quotedMsg": {
-						"type": "gp2",
-						"subtype": "leave",
-					},
-					"quotedStanzaID": splitted[2],
-					"quotedRemoteJid": splitted[1],
-				}
-			},
-		};
-		*/
-
 		id = idFromString(id);
 
 		const chat = Store.Chat.models.find(c => ideq(c.id, id));
@@ -225,11 +275,19 @@ func (wi *Instance) inject(ctx context.Context) error {
 			throw new Error('no chat with id ' + id + ' found.');
 		}
 
+		let quotedMsg = undefined;
+		if (replyID != null) {
+			quotedMsg = chat.msgs.models.find(m => m.id._serialized === replyID);
+			if (quotedMsg == null) {
+				throw new Error('no message with id ' + replyID + ' found.');
+			}
+		}
+
 		function sleep (ms) {
 			return new Promise(resolve => setTimeout(resolve, ms));
 		}
 
-		chat.sendMessage(message/*, {}, replyObj*/).then(function () {
+		chat.sendMessage(message, {}, quotedMsg).then(function () {
 			var trials = 0;
 
 			function trySend() {
@@ -261,7 +319,10 @@ func (wi *Instance) inject(ctx context.Context) error {
 
 		// TODO: user should be able to just get the stale one and call
 		// .Update() in the go code.
-		if (res != null && res.stale) {
+		if (res == null) {
+			// broadcast lists don't always have metadata.
+			return [];
+		} else if (res.stale) {
 			await res.update();
 		}
 
@@ -283,6 +344,30 @@ func (wi *Instance) inject(ctx context.Context) error {
 		return Store.Stream.phoneActive;
 	};
 
+	whappGo.getOwnAcks = function (since) {
+		let res = [];
+
+		for (const chat of Store.Chat.models) {
+			if (chat == null) {
+				continue;
+			}
+
+			for (const msg of chat.msgs.models) {
+				if (msg == null || !msg.id.fromMe || msg.t < since) {
+					continue;
+				}
+
+				res.push({
+					id: msg.id._serialized,
+					chatId: chat.id,
+					ack: msg.ack,
+				});
+			}
+		}
+
+		return res;
+	};
+
 	whappGo.getMessagesFromChatTillDate = async function (chatId, timestamp) {
 		chatId = idFromString(chatId);
 		const chat = Store.Chat.models.find(c => ideq(c.id, chatId));
@@ -300,6 +385,62 @@ func (wi *Instance) inject(ctx context.Context) error {
 			.map(whappGo.msgToJSON);
 	};
 
+	whappGo.getMessage = function (chatId, msgId) {
+		chatId = idFromString(chatId);
+		const chat = Store.Chat.models.find(c => ideq(c.id, chatId));
+
+		const msg = chat.msgs.models.find(m => m.id._serialized === msgId);
+		if (msg == null) {
+			return null;
+		}
+		return whappGo.msgToJSON(msg);
+	};
+
+	whappGo.setStarred = async function (chatId, msgId, starred) {
+		chatId = idFromString(chatId);
+		const chat = Store.Chat.models.find(c => ideq(c.id, chatId));
+
+		const msg = chat && chat.msgs.models.find(m => m.id._serialized === msgId);
+		if (msg == null) {
+			throw new Error('no message with id ' + msgId + ' found.');
+		}
+		await chat.sendStarMsgs([msg], starred);
+	};
+
+	whappGo.sendLocation = async function (chatId, lat, lng, name) {
+		chatId = idFromString(chatId);
+		const chat = Store.Chat.models.find(c => ideq(c.id, chatId));
+		if (chat == null) {
+			throw new Error('no chat with id ' + chatId + ' found.');
+		}
+
+		await chat.sendMessage('', {
+			location: {
+				degreesLatitude: lat,
+				degreesLongitude: lng,
+				name: name || undefined,
+			},
+		});
+	};
+
+	whappGo.getStarredMessages = function (chatId) {
+		let chats = Store.Chat.models;
+		if (chatId != null) {
+			chatId = idFromString(chatId);
+			chats = chats.filter(c => ideq(c.id, chatId));
+		}
+
+		const res = [];
+		for (const chat of chats) {
+			for (const msg of chat.msgs.models) {
+				if (msg.star) {
+					res.push(whappGo.msgToJSON(msg));
+				}
+			}
+		}
+		return res;
+	};
+
 	whappGo.getCommonGroups = async function (contactId) {
 		contactId = idFromString(contactId);
 
@@ -321,12 +462,85 @@ func (wi *Instance) inject(ctx context.Context) error {
 		return Store.Wap[fn](chatId, userId);
 	}
 
+	whappGo.setIcon = async function (chatId, small, large) {
+		chatId = idFromString(chatId);
+
+		const res = await Store.Wap.sendSetPicture(chatId, small, large);
+		if (res == null || res.status !== 200) {
+			throw new Error('setting icon failed with status ' + (res && res.status));
+		}
+	}
+
+	whappGo.setRead = async function (chatId, read) {
+		chatId = idFromString(chatId);
+
+		const chat = Store.Chat.models.find(c => ideq(c.id, chatId));
+		if (chat == null) {
+			throw new Error('no chat with id ' + chatId + ' found.');
+		}
+
+		const fn = read ? 'sendConversationSeen' : 'sendConversationUnseen';
+		if (typeof Store.Wap[fn] !== 'function') {
+			throw new Error(fn + ' is not supported by this WhatsApp Web version');
+		}
+
+		await Store.Wap[fn](chat.id, chat.lastReceivedKey, chat.unreadCount);
+
+		// WhatsApp Web uses -1 for chats marked as unread by the user.
+		chat.unreadCount = read ? 0 : -1;
+	}
+
+	whappGo.setTyping = function (chatId, typing) {
+		chatId = idFromString(chatId);
+
+		const fn = typing ? 'sendChatstateComposing' : 'sendChatstatePaused';
+		return Store.Wap[fn](chatId);
+	}
+
+	whappGo.setOnline = function (online) {
+		const fn = online ? 'sendPresenceAvailable' : 'sendPresenceUnavailable';
+		if (typeof Store.Wap[fn] !== 'function') {
+			throw new Error(fn + ' is not supported by this WhatsApp Web version');
+		}
+		return Store.Wap[fn]();
+	}
+
 	whappGo.addParticipant = function (chatId, userId) {
 		chatId = idFromString(chatId);
 		userId = idFromString(userId);
 		return Store.Wap.addParticipant(chatId, userId);
 	}
 
+	whappGo.getAbout = async function () {
+		const res = await Store.Wap.statusFind(Store.Conn.me);
+		return (res && res.status) || '';
+	}
+
+	whappGo.setAbout = function (about) {
+		return Store.Wap.sendSetStatus(about);
+	}
+
+	whappGo.setPushname = function (name) {
+		return Store.Wap.setPushname(name);
+	}
+
+	whappGo.setBlocked = function (contactId, blocked) {
+		contactId = idFromString(contactId);
+		return Store.Wap.blockContact(contactId, blocked);
+	}
+
+	whappGo.getBlockedContacts = function () {
+		return Store.Blocklist.models.map(b => {
+			const contact = Store.Contact.models.find(c => ideq(c.id, b.id));
+			return whappGo.contactToJSON(contact) || { id: b.id };
+		});
+	}
+
+	whappGo.leaveGroup = function (chatId) {
+		chatId = idFromString(chatId);
+		return Store.Wap.leaveGroup(chatId);
+	}
+
 	whappGo.removeParticipant = function (chatId, userId) {
 		chatId = idFromString(chatId);
 		userId = idFromString(userId);
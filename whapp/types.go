@@ -2,7 +2,11 @@ package whapp
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
+	"image"
+	"io"
+	"os"
 	"regexp"
 	"sort"
 	"strconv"
@@ -44,6 +48,18 @@ func (id ID) String() string {
 	return id.User + "@" + id.Server
 }
 
+// IsSystem returns whether or not the current ID is the ID of WhatsApp itself,
+// which sends service announcements and verification messages.
+func (id ID) IsSystem() bool {
+	return id == systemID
+}
+
+// IsBroadcast returns whether or not the current ID is the ID of a broadcast
+// list, or of the status broadcast.
+func (id ID) IsBroadcast() bool {
+	return id.Server == "broadcast"
+}
+
 // PhoneInfo contains info about the connected phone.
 type PhoneInfo struct {
 	WhatsAppVersion    string `json:"wa_version"`
@@ -127,6 +143,12 @@ func (c Contact) GetCommonGroups(ctx context.Context, wi *Instance) ([]Chat, err
 	return res, err
 }
 
+// SetBlocked blocks the contact c if blocked is true, or unblocks it otherwise.
+func (c Contact) SetBlocked(ctx context.Context, wi *Instance, blocked bool) error {
+	str := fmt.Sprintf("whappGo.setBlocked(%s, %t)", strconv.Quote(c.ID.String()), blocked)
+	return runLoggedinWithoutRes(ctx, wi, str, true)
+}
+
 // Participant represents a participants in a group chat.
 type Participant struct {
 	ID           ID      `json:"id"`
@@ -180,6 +202,32 @@ func (loc LocationData) String() string {
 	return loc.InfoString
 }
 
+// InteractiveData contains the text and options of an interactive message, as
+// sent by business accounts (button, list and template messages).
+type InteractiveData struct {
+	Header  string   `json:"header"`
+	Body    string   `json:"body"`
+	Footer  string   `json:"footer"`
+	Options []string `json:"options"`
+}
+
+// The acknowledgement states of a message sent by the user.
+const (
+	AckError     = -1
+	AckPending   = 0
+	AckSent      = 1
+	AckDelivered = 2
+	AckRead      = 3
+	AckPlayed    = 4
+)
+
+// MessageAck is the acknowledgement state of a message sent by the user.
+type MessageAck struct {
+	ID     string `json:"id"`
+	ChatID ID     `json:"chatId"`
+	Ack    int    `json:"ack"`
+}
+
 // Message represents any kind of message on Whatsapp.
 // This also means the stuff like notifications (in the sense of e2e
 // notifications, for example) are also represented by this struct.
@@ -202,6 +250,21 @@ type Message struct {
 	RecipientIDs []ID `json:"recipients"`
 	MentionedIDs []ID `json:"mentionedJidList"`
 
+	// EphemeralDuration is the disappearing messages timer in seconds set by
+	// an ephemeral setting notification, 0 means it has been turned off.
+	EphemeralDuration int64 `json:"ephemeralDuration"`
+
+	// PinType and PinnedMessageID are set on pin messages, PinType is 1 when
+	// the message with PinnedMessageID got pinned, and 2 when it got unpinned.
+	PinType         int    `json:"pinMessageType"`
+	PinnedMessageID string `json:"pinnedMsgId"`
+
+	// ReactionText and ReactionParentID are set on reaction messages,
+	// ReactionText is the emoji the message with ReactionParentID got reacted
+	// with, or empty when the reaction got removed.
+	ReactionText     string `json:"reactionText"`
+	ReactionParentID string `json:"reactionParentId"`
+
 	IsGIF          bool `json:"isGif"`
 	IsLive         bool `json:"isLive"`
 	IsNewMessage   bool `json:"isNewMsg"`
@@ -221,10 +284,13 @@ type Message struct {
 	MediaClientURL string    `json:"clientUrl"`
 	MediaFileHash  string    `json:"filehash"`
 	MediaFilename  string    `json:"filename"`
+	MediaSize      int64     `json:"size"`
 	Caption        string    `json:"caption"`
 
 	Location *LocationData `json:"location"`
 
+	Interactive *InteractiveData `json:"interactive"`
+
 	PDFPageCount uint `json:"pageCount"`
 
 	QuotedMessage *Message `json:"quotedMsgObj"`
@@ -243,7 +309,65 @@ func (msg Message) DownloadMedia() ([]byte, error) {
 		return []byte{}, err
 	}
 
-	return decryptFile(fileBytes, msg.MediaKey, getCryptKey(msg.Type))
+	res, err := decryptFile(fileBytes, msg.MediaKey, getCryptKey(msg.Type))
+	if err != nil {
+		return []byte{}, err
+	}
+	return res, msg.checkMediaSize(int64(len(res)))
+}
+
+// checkMediaSize returns ErrMediaTruncated if the given size of the decrypted
+// media of the current message is zero, or smaller than the size reported by
+// WhatsApp.
+func (msg Message) checkMediaSize(size int64) error {
+	if size == 0 || size < msg.MediaSize {
+		return ErrMediaTruncated
+	}
+	return nil
+}
+
+// DownloadMediaTo downloads the media included in this message, if any, and
+// writes it decrypted to w.  The encrypted media is first stored in the file at
+// partialPath, when that file already exists the download is resumed from
+// where it was interrupted.  The file is removed when the media has been
+// written, or turned out to be corrupt or truncated.
+func (msg Message) DownloadMediaTo(w io.Writer, partialPath string) error {
+	if !msg.IsMMS {
+		return nil
+	}
+
+	if err := downloadFileResumable(msg.MediaClientURL, partialPath); err != nil {
+		return err
+	}
+
+	f, err := os.Open(partialPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partialPath)
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	cw := &countingWriter{w: w}
+	err = decryptFileTo(cw, f, info.Size(), msg.MediaKey, getCryptKey(msg.Type))
+	if err != nil {
+		return err
+	}
+	return msg.checkMediaSize(cw.n)
+}
+
+// Thumbnail returns the decoded thumbnail of the media included in this
+// message, if any.
+func (msg Message) Thumbnail() ([]byte, error) {
+	if !msg.IsMMS || msg.MediaData.Preview.Base64 == "" {
+		return []byte{}, nil
+	}
+
+	return base64.StdEncoding.DecodeString(msg.MediaData.Preview.Base64)
 }
 
 // FormatBody returns the body of the current message, with mentions correctly
@@ -292,16 +416,45 @@ func (msg Message) Content(participants []Participant, ownName string) string {
 	return msg.FormatBody(participants, ownName)
 }
 
+// Mentions returns whether or not the user with the given id is mentioned in
+// the current message.
+func (msg Message) Mentions(id ID) bool {
+	for _, x := range msg.MentionedIDs {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
+
 // Time returns the timestamp of the current message converted to a time.Time
-// instance.
+// instance.  Messages without a timestamp are considered to be sent now,
+// instead of at the Unix epoch.
 func (msg Message) Time() time.Time {
+	if msg.Timestamp == 0 {
+		return time.Now()
+	}
 	return time.Unix(msg.Timestamp, 0)
 }
 
+// IsEphemeralSetting returns whether or not the current message is a
+// notification of a change of the disappearing messages timer of its chat.
+func (msg Message) IsEphemeralSetting() bool {
+	return msg.Subtype == "ephemeral" || msg.Subtype == "ephemeral_setting"
+}
+
+// IsUndecrypted returns whether or not the current message is a placeholder
+// for a message WhatsApp couldn't decrypt yet.  The message is reported again
+// once its content arrives.
+func (msg Message) IsUndecrypted() bool {
+	return msg.Type == "ciphertext"
+}
+
 // Presence contains information about the presence of a contact of the user.
 type Presence struct {
 	ID        ID     `json:"id"`
 	Timestamp int64  `json:"timestamp"`
+	LastSeen  int64  `json:"lastSeen"` // 0 if hidden or unknown
 	Type      string `json:"type"`
 
 	ChatActive bool `json:"chatActive"`
@@ -317,6 +470,15 @@ func (p Presence) Time() time.Time {
 	return time.Unix(p.Timestamp, 0)
 }
 
+// LastSeenTime returns the time the contact was last seen online, if it's
+// known.  Contacts can hide this using their privacy settings.
+func (p Presence) LastSeenTime() (time.Time, bool) {
+	if p.IsOnline || p.LastSeen <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(p.LastSeen, 0), true
+}
+
 // A Description tells more about a group chat.
 type Description struct {
 	ID          string `json:"id"`
@@ -364,6 +526,13 @@ type Chat struct {
 	Presence Presence `json:"presence"`
 
 	IsGroupChat bool `json:"isGroup"`
+
+	// IsCommunity is true for the parent chat of a WhatsApp Community, which
+	// isn't a group chat in which messages can be sent.
+	IsCommunity bool `json:"isCommunity"`
+	// IsAnnouncement is true for group chats in which only admins can send
+	// messages, such as the announcement group of a community.
+	IsAnnouncement bool `json:"isAnnouncement"`
 }
 
 // Title returns the name of the current chat, with support for contacts without
@@ -386,11 +555,11 @@ func (c Chat) PinTime() (pinTime time.Time, set bool) {
 }
 
 // Participants retrieves and returns a slice containing all participants of the
-// current group chat.
+// current group chat or broadcast list.
 func (c Chat) Participants(ctx context.Context, wi *Instance) ([]Participant, error) {
 	var res []Participant
 
-	if !c.IsGroupChat {
+	if !c.IsGroupChat && !c.ID.IsBroadcast() {
 		return res, nil
 	}
 
@@ -448,6 +617,46 @@ func (c Chat) SetAdmin(ctx context.Context, wi *Instance, userID ID, setAdmin bo
 	return runLoggedinWithoutRes(ctx, wi, str, false) // TODO: true?
 }
 
+// SetIcon sets the icon of the current group chat to the given image.
+func (c Chat) SetIcon(ctx context.Context, wi *Instance, img image.Image) error {
+	small, err := makeIcon(img, iconSmallSize)
+	if err != nil {
+		return err
+	}
+	large, err := makeIcon(img, iconLargeSize)
+	if err != nil {
+		return err
+	}
+
+	str := fmt.Sprintf(
+		"whappGo.setIcon(%s, %s, %s)",
+		strconv.Quote(c.ID.String()),
+		strconv.Quote(small),
+		strconv.Quote(large),
+	)
+	return runLoggedinWithoutRes(ctx, wi, str, true)
+}
+
+// SetRead marks the current chat as read or unread.
+func (c Chat) SetRead(ctx context.Context, wi *Instance, read bool) error {
+	str := fmt.Sprintf(
+		"whappGo.setRead(%s, %t)",
+		strconv.Quote(c.ID.String()),
+		read,
+	)
+	return runLoggedinWithoutRes(ctx, wi, str, true)
+}
+
+// SetTyping sets whether or not the user is typing in the current chat.
+func (c Chat) SetTyping(ctx context.Context, wi *Instance, typing bool) error {
+	str := fmt.Sprintf(
+		"whappGo.setTyping(%s, %t)",
+		strconv.Quote(c.ID.String()),
+		typing,
+	)
+	return runLoggedinWithoutRes(ctx, wi, str, false)
+}
+
 // AddParticipant adds the user with the given userID to the current chat.
 func (c Chat) AddParticipant(ctx context.Context, wi *Instance, userID ID) error {
 	str := fmt.Sprintf(
@@ -469,6 +678,12 @@ func (c Chat) RemoveParticipant(ctx context.Context, wi *Instance, userID ID) er
 	return runLoggedinWithoutRes(ctx, wi, str, false) // TODO: true?
 }
 
+// Leave leaves the current group chat.
+func (c Chat) Leave(ctx context.Context, wi *Instance) error {
+	str := fmt.Sprintf("whappGo.leaveGroup(%s)", strconv.Quote(c.ID.String()))
+	return runLoggedinWithoutRes(ctx, wi, str, true)
+}
+
 // GetMessagesFromChatTillDate returns messages in the current chat with a
 // timestamp equal to or greater than `timestamp`.
 func (c Chat) GetMessagesFromChatTillDate(
@@ -504,3 +719,61 @@ func (c Chat) GetMessagesFromChatTillDate(
 
 	return res, nil
 }
+
+// SetStarred stars the message with the given serialized ID in the current
+// chat if starred is true, or unstars it otherwise.
+func (c Chat) SetStarred(ctx context.Context, wi *Instance, id string, starred bool) error {
+	str := fmt.Sprintf(
+		"whappGo.setStarred(%s, %s, %t)",
+		strconv.Quote(c.ID.String()),
+		strconv.Quote(id),
+		starred,
+	)
+	return runLoggedinWithoutRes(ctx, wi, str, true)
+}
+
+// SendLocation sends a location message with the given coordinates and
+// (optional) name to the current chat.
+func (c Chat) SendLocation(ctx context.Context, wi *Instance, lat, lng float64, name string) error {
+	str := fmt.Sprintf(
+		"whappGo.sendLocation(%s, %s, %s, %s)",
+		strconv.Quote(c.ID.String()),
+		strconv.FormatFloat(lat, 'f', -1, 64),
+		strconv.FormatFloat(lng, 'f', -1, 64),
+		strconv.Quote(name),
+	)
+	return runLoggedinWithoutRes(ctx, wi, str, true)
+}
+
+// GetStarredMessages returns the loaded starred messages in the current chat.
+func (c Chat) GetStarredMessages(ctx context.Context, wi *Instance) ([]Message, error) {
+	str := fmt.Sprintf("whappGo.getStarredMessages(%s)", strconv.Quote(c.ID.String()))
+	return wi.getStarredMessages(ctx, str)
+}
+
+// GetMessage returns the message in the current chat with the given serialized
+// ID, or ErrMessageNotFound if it isn't loaded in the chat.
+func (c Chat) GetMessage(ctx context.Context, wi *Instance, id string) (Message, error) {
+	var res *Message
+
+	if wi.LoginState != Loggedin {
+		return Message{}, ErrLoggedOut
+	}
+
+	if err := wi.inject(ctx); err != nil {
+		return Message{}, err
+	}
+
+	str := fmt.Sprintf(
+		"whappGo.getMessage(%s, %s)",
+		strconv.Quote(c.ID.String()),
+		strconv.Quote(id),
+	)
+	if err := wi.cdp.Run(ctx, chromedp.Evaluate(str, &res)); err != nil {
+		return Message{}, err
+	} else if res == nil {
+		return Message{}, ErrMessageNotFound
+	}
+
+	return *res, nil
+}
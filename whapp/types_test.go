@@ -0,0 +1,20 @@
+package whapp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageTime(t *testing.T) {
+	msg := Message{Timestamp: 1500000000}
+	if res := msg.Time(); !res.Equal(time.Unix(1500000000, 0)) {
+		t.Errorf("got %s, expected the timestamp of the message", res)
+	}
+
+	// messages without a timestamp are considered to be sent now.
+	before := time.Now()
+	res := Message{}.Time()
+	if res.Before(before) || res.After(time.Now()) {
+		t.Errorf("got %s for a message without timestamp, expected now", res)
+	}
+}
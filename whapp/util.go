@@ -2,19 +2,30 @@ package whapp
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/chromedp/cdproto/runtime"
 	"github.com/chromedp/chromedp"
 )
 
+// downloadTimeout is the maximum duration of a single download.  Resumable
+// downloads that time out can be continued where they stopped.
+const downloadTimeout = 2 * time.Minute
+
+// httpClient is the client files are downloaded with.
+var httpClient = &http.Client{Timeout: downloadTimeout}
+
 func awaitPromise(params *runtime.EvaluateParams) *runtime.EvaluateParams {
 	return params.WithAwaitPromise(true)
 }
 
 func downloadFile(url string) ([]byte, error) {
-	res, err := http.Get(url)
+	res, err := httpClient.Get(url)
 	if err != nil {
 		return []byte{}, err
 	}
@@ -23,6 +34,60 @@ func downloadFile(url string) ([]byte, error) {
 	return ioutil.ReadAll(res.Body)
 }
 
+// downloadFileResumable downloads the file at the given url to the file at the
+// given path.  If the file at path already exists, it's treated as the start
+// of an earlier interrupted download, which is resumed using a Range request
+// if the server supports it, and restarted otherwise.
+func downloadFileResumable(url, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusPartialContent && offset > 0:
+		// resuming, append to what we already have.
+
+	case res.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// the earlier download was already complete.
+		return nil
+
+	case res.StatusCode == http.StatusOK:
+		// the server doesn't support ranges, start over.
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		} else if err := f.Truncate(0); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unexpected status while downloading file: %s", res.Status)
+	}
+
+	_, err = io.Copy(f, res.Body)
+	return err
+}
+
 func runLoggedinWithoutRes(ctx context.Context, wi *Instance, code string, await bool) error {
 	// REVIEW: find some better way than 'idc'
 
@@ -40,3 +105,15 @@ func runLoggedinWithoutRes(ctx context.Context, wi *Instance, code string, await
 	}
 	return wi.cdp.Run(ctx, chromedp.Evaluate(code, &idc))
 }
+
+// countingWriter is a writer that counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -343,6 +343,18 @@ func (wi *Instance) SendMessageToChatID(ctx context.Context, chatID ID, message
 	return runLoggedinWithoutRes(ctx, wi, str, false)
 }
 
+// SendReplyToChatID sends the given `message` to the chat with the given
+// `chatID`, as a reply to the message with the given serialized `quotedID`.
+func (wi *Instance) SendReplyToChatID(ctx context.Context, chatID ID, message, quotedID string) error {
+	str := fmt.Sprintf(
+		"whappGo.sendMessage(%s, %s, %s)",
+		strconv.Quote(chatID.String()),
+		strconv.Quote(message),
+		strconv.Quote(quotedID),
+	)
+	return runLoggedinWithoutRes(ctx, wi, str, false)
+}
+
 // GetAllChats returns a slice containing all the chats the user has
 // participated in.
 func (wi *Instance) GetAllChats(ctx context.Context) ([]Chat, error) {
@@ -388,6 +400,161 @@ func (wi *Instance) GetPhoneActive(ctx context.Context) (bool, error) {
 	return res, nil
 }
 
+// GetAbout returns the about text (status) of the user.
+func (wi *Instance) GetAbout(ctx context.Context) (string, error) {
+	var res string
+
+	if wi.LoginState != Loggedin {
+		return res, ErrLoggedOut
+	}
+
+	if err := wi.inject(ctx); err != nil {
+		return res, err
+	}
+
+	if err := wi.cdp.Run(
+		ctx,
+		chromedp.Evaluate("whappGo.getAbout()", &res, awaitPromise),
+	); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// SetAbout sets the about text (status) of the user to the given text.
+func (wi *Instance) SetAbout(ctx context.Context, about string) error {
+	str := fmt.Sprintf("whappGo.setAbout(%s)", strconv.Quote(about))
+	return runLoggedinWithoutRes(ctx, wi, str, true)
+}
+
+// SetPushname sets the pushname (display name) of the user to the given name.
+func (wi *Instance) SetPushname(ctx context.Context, name string) error {
+	str := fmt.Sprintf("whappGo.setPushname(%s)", strconv.Quote(name))
+	return runLoggedinWithoutRes(ctx, wi, str, true)
+}
+
+// SetOnline sets whether or not the user is shown as online to their contacts.
+func (wi *Instance) SetOnline(ctx context.Context, online bool) error {
+	str := fmt.Sprintf("whappGo.setOnline(%t)", online)
+	return runLoggedinWithoutRes(ctx, wi, str, true)
+}
+
+// GetBlockedContacts returns the contacts blocked by the user.
+func (wi *Instance) GetBlockedContacts(ctx context.Context) ([]Contact, error) {
+	var res []Contact
+
+	if wi.LoginState != Loggedin {
+		return res, ErrLoggedOut
+	}
+
+	if err := wi.inject(ctx); err != nil {
+		return res, err
+	}
+
+	if err := wi.cdp.Run(
+		ctx,
+		chromedp.Evaluate("whappGo.getBlockedContacts()", &res),
+	); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// GetStarredMessages returns the loaded starred messages in all chats.
+func (wi *Instance) GetStarredMessages(ctx context.Context) ([]Message, error) {
+	return wi.getStarredMessages(ctx, "whappGo.getStarredMessages(null)")
+}
+
+func (wi *Instance) getStarredMessages(ctx context.Context, code string) ([]Message, error) {
+	var res []Message
+
+	if wi.LoginState != Loggedin {
+		return res, ErrLoggedOut
+	}
+
+	if err := wi.inject(ctx); err != nil {
+		return res, err
+	}
+
+	if err := wi.cdp.Run(ctx, chromedp.Evaluate(code, &res)); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// GetOwnAcks returns the acknowledgement states of the loaded messages sent by
+// the user since the given timestamp.
+func (wi *Instance) GetOwnAcks(ctx context.Context, since int64) ([]MessageAck, error) {
+	var res []MessageAck
+
+	if wi.LoginState != Loggedin {
+		return res, ErrLoggedOut
+	}
+
+	if err := wi.inject(ctx); err != nil {
+		return res, err
+	}
+
+	str := fmt.Sprintf("whappGo.getOwnAcks(%d)", since)
+	if err := wi.cdp.Run(ctx, chromedp.Evaluate(str, &res)); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// ListenForAckChange listens for changes in the acknowledgement state of
+// messages sent by the user in the last `period`, by polling every
+// `interval`.
+func (wi *Instance) ListenForAckChange(ctx context.Context, interval, period time.Duration) (<-chan MessageAck, <-chan error) {
+	errCh := make(chan error)
+	resCh := make(chan MessageAck)
+
+	go func() {
+		defer close(errCh)
+		defer close(resCh)
+
+		prev := make(map[string]int)
+		first := true
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-time.After(interval):
+				since := time.Now().Add(-period).Unix()
+				res, err := wi.GetOwnAcks(ctx, since)
+				if err != nil {
+					errCh <- err
+					return
+				}
+
+				current := make(map[string]int)
+				for _, ack := range res {
+					current[ack.ID] = ack.Ack
+
+					if old, has := prev[ack.ID]; !first && (!has || old != ack.Ack) {
+						select {
+						case <-ctx.Done():
+							return
+						case resCh <- ack:
+						}
+					}
+				}
+
+				prev = current
+				first = false
+			}
+		}
+	}()
+
+	return resCh, errCh
+}
+
 // ListenForPhoneActiveChange listens for changes in the user's phone
 // activity.
 func (wi *Instance) ListenForPhoneActiveChange(ctx context.Context, interval time.Duration) (<-chan bool, <-chan error) {
@@ -429,6 +596,44 @@ func (wi *Instance) ListenForPhoneActiveChange(ctx context.Context, interval tim
 	return resCh, errCh
 }
 
+// ListenForPushnameChange listens for changes in the pushname of the user by
+// polling it every `interval`.
+func (wi *Instance) ListenForPushnameChange(ctx context.Context, interval time.Duration) (<-chan string, <-chan error) {
+	errCh := make(chan error)
+	resCh := make(chan string)
+
+	go func() {
+		defer close(errCh)
+		defer close(resCh)
+
+		prev := ""
+		first := true
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-time.After(interval):
+				me, err := wi.GetMe(ctx)
+				if err != nil {
+					errCh <- err
+					return
+				}
+
+				if me.Pushname != prev && !first {
+					resCh <- me.Pushname
+				}
+
+				prev = me.Pushname
+				first = false
+			}
+		}
+	}()
+
+	return resCh, errCh
+}
+
 // Shutdown shuts down the current Instance.
 func (wi *Instance) Shutdown(ctx context.Context) error {
 	return wi.unit.Shutdown(ctx)
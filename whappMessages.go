@@ -2,13 +2,26 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"whapp-irc/config"
+	"whapp-irc/files"
+	"whapp-irc/formatting"
 	"whapp-irc/maps"
 	"whapp-irc/types"
 	"whapp-irc/util"
 	"whapp-irc/whapp"
+
+	"github.com/wangii/emoji"
 )
 
 func formatContact(contact whapp.Contact) types.Participant {
@@ -18,49 +31,306 @@ func formatContact(contact whapp.Contact) types.Participant {
 	}
 }
 
-func getMessageBody(msg whapp.Message, participants []types.Participant, me whapp.Me) string {
+// mentionsMe returns whether or not the given message mentions the user, or
+// quotes a message sent by the user.
+func (conn *Connection) mentionsMe(msg whapp.Message) bool {
+	if msg.Mentions(conn.me.SelfID) {
+		return true
+	}
+
+	quoted := msg.QuotedMessage
+	return quoted != nil && quoted.IsSentByMe
+}
+
+// senderName returns the IRC nick of the sender of the given message.
+func (conn *Connection) senderName(msg whapp.Message) string {
+	if msg.IsSentByMe {
+		return conn.irc.Nick()
+	} else if msg.Sender == nil {
+		// the message may originate from another chat, such as a quoted
+		// message, so fall back to the private chat with the sender.
+		if item, has := conn.Chats.ByID(msg.From, false); has && item.Chat.IsPrivate() {
+			sender := formatContact(item.Chat.RawChat.Contact)
+			return sender.SafeName()
+		}
+		return msg.From.User
+	}
+
+	sender := formatContact(*msg.Sender)
+	return sender.SafeName()
+}
+
+// quoteParticipants returns the participants used to resolve the mentions in
+// the given message quoted in the given chat.  The quoted message may
+// originate from another chat, in which case the participants of that chat are
+// used if it's known.  Mentioned users that aren't participants are looked up
+// in the private chats.
+func (conn *Connection) quoteParticipants(chat *types.Chat, quoted whapp.Message) []types.Participant {
+	participants := chat.Participants
+	if origin := quoted.ID.ChatID; origin != (whapp.ID{}) && origin != chat.ID {
+		if item, has := conn.Chats.ByID(origin, false); has {
+			participants = item.Chat.Participants
+		}
+	}
+
+	res := append([]types.Participant{}, participants...)
+	for _, id := range quoted.MentionedIDs {
+		found := false
+		for _, p := range res {
+			if p.ID == id {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+
+		if item, has := conn.Chats.ByID(id, false); has && item.Chat.IsPrivate() {
+			res = append(res, types.Participant{ID: id, Contact: item.Chat.RawChat.Contact})
+		}
+	}
+	return res
+}
+
+func (conn *Connection) getMessageBody(msg whapp.Message, participants []types.Participant, ownName string) string {
 	whappParticipants := make([]whapp.Participant, len(participants))
 	for i, p := range participants {
 		whappParticipants[i] = whapp.Participant(p)
 	}
 
 	switch {
+	case msg.IsUndecrypted():
+		return "* (message could not be decrypted yet)"
+
 	case msg.Location != nil:
+		if !maps.ValidCoordinates(msg.Location.Latitude, msg.Location.Longitude) {
+			return "📍 (invalid location)"
+		}
 		return maps.ByProvider(
-			conf.MapProvider,
+			conn.mapProvider(),
 			msg.Location.Latitude,
 			msg.Location.Longitude,
 		)
 
+	case msg.Interactive != nil:
+		body := formatInteractive(*msg.Interactive)
+		return conn.convertText(body)
+
 	case msg.IsMMS:
-		res := "--file--"
+		caption := ""
+		if msg.Caption != "" {
+			caption = msg.FormatCaption(whappParticipants, ownName)
+			caption = conn.convertText(caption)
+		}
+
+		switch conf.MediaMode {
+		case config.MediaOff:
+			return caption
+		case config.MediaLinksOnly:
+			return placeCaption(mediaPlaceholder(msg), caption)
+		}
+
+		// don't send links to a file server that can't be reached.
+		if !fs.Available() {
+			unavailable := fmt.Sprintf("--media (%s) unavailable--", msg.Type)
+			return placeCaption(unavailable, caption)
+		}
+
+		url := "--file--"
 		if f, has := fs.GetFileByHash(msg.MediaFileHash); has {
-			res = f.URL
+			url = f.URL
+		} else if conn.mediaFailed(msg.ID.Serialized) {
+			url = "--media download failed--"
 		}
+		res := placeCaption(url, caption)
 
-		if msg.Caption != "" {
-			res += " " + msg.FormatCaption(whappParticipants, me.Pushname)
+		if hash, has := thumbnailHash(msg); has {
+			if f, has := fs.GetFileByHash(hash); has {
+				res = "thumbnail: " + f.URL + "\n" + res
+			}
 		}
 
 		return res
 
 	default:
-		return msg.FormatBody(whappParticipants, me.Pushname)
+		body := msg.FormatBody(whappParticipants, ownName)
+		return conn.convertText(body)
+	}
+}
+
+// convertText converts the formatting markup in the given text of a WhatsApp
+// message as configured by the user and, if configured, its emoji to
+// shortcodes.
+func (conn *Connection) convertText(text string) string {
+	text = formatting.Convert(text, conn.formattingMode())
+	if conf.EmojiShortcodes {
+		text = emoji.UnicodeToEmojiTag(text)
+	}
+	return text
+}
+
+// placeCaption returns the given media URL combined with the given caption, as
+// configured by conf.CaptionPlacement.  Multiline captions are split over
+// multiple messages by the message handlers.
+func placeCaption(url, caption string) string {
+	if caption == "" {
+		return url
+	}
+
+	switch conf.CaptionPlacement {
+	case config.CaptionBefore:
+		return caption + "\n" + url
+	case config.CaptionAfter:
+		return url + "\n" + caption
+	default:
+		return url + " " + caption
+	}
+}
+
+// mediaPlaceholder returns the text sent instead of the URL of the media of the
+// given message, when media isn't downloaded.
+func mediaPlaceholder(msg whapp.Message) string {
+	return fmt.Sprintf("--media (%s), open on phone--", msg.Type)
+}
+
+// fileTypeHeadSize is the amount of bytes at the start of a file used to detect
+// its type.
+const fileTypeHeadSize = 262
+
+// downloadMediaToTemp downloads the media of the given message to a temporary
+// file, and returns its path, its size and its first bytes.  The media is
+// streamed to disk, and an interrupted download is resumed on the next try.
+func downloadMediaToTemp(msg whapp.Message) (path string, size int64, head []byte, err error) {
+	partial, err := fs.TempPath(msg.MediaFileHash, "part")
+	if err != nil {
+		return "", 0, nil, err
+	}
+	path, err = fs.TempPath(msg.MediaFileHash, "tmp")
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	err = msg.DownloadMediaTo(f, partial)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
+	if err != nil {
+		os.Remove(path)
+		return "", 0, nil, err
+	}
+
+	f, err = os.Open(path)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	head = make([]byte, fileTypeHeadSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", 0, nil, err
+	}
+
+	return path, info.Size(), head[:n], nil
+}
+
+// mediaLock is a lock on the media with a certain hash.
+type mediaLock struct {
+	sync.Mutex
+	refs int
+}
+
+var (
+	mediaLocksMutex sync.Mutex
+	mediaLocks      = make(map[string]*mediaLock)
+)
+
+// lockMedia locks the media with the given hash and returns a function to
+// unlock it.  Messages with the same media (such as forwarded images) share
+// temporary files, so their downloads can't run at the same time.
+func lockMedia(hash string) (unlock func()) {
+	mediaLocksMutex.Lock()
+	lock, has := mediaLocks[hash]
+	if !has {
+		lock = &mediaLock{}
+		mediaLocks[hash] = lock
+	}
+	lock.refs++
+	mediaLocksMutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		mediaLocksMutex.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(mediaLocks, hash)
+		}
+		mediaLocksMutex.Unlock()
+	}
+}
+
+// mediaDownloadAttempts is the maximum amount of times the media of a message
+// is downloaded when it turns out to be corrupt or truncated.
+const mediaDownloadAttempts = 3
+
+// isRetryableMediaErr returns whether or not the given error, returned while
+// downloading media, is worth downloading the media again for.  Timed out
+// downloads are resumed where they stopped.
+func isRetryableMediaErr(err error) bool {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return err == whapp.ErrMediaCorrupt || err == whapp.ErrMediaTruncated
 }
 
-func downloadAndStoreMedia(msg whapp.Message) error {
-	if !msg.IsMMS {
+// downloadMessageMedia downloads and stores the media of the given message
+// before it's handled.  When that fails the message is delivered with a marker
+// instead of the URL, the download can be retried using the fetch command.
+func (conn *Connection) downloadMessageMedia(msg whapp.Message) {
+	if err := conn.downloadAndStoreMedia(msg); err != nil {
+		log.Printf("error while downloading media: %s\n", err)
+		conn.setMediaFailed(msg.ID.Serialized, true)
+	}
+}
+
+func (conn *Connection) downloadAndStoreMedia(msg whapp.Message) error {
+	if !msg.IsMMS || conf.MediaMode != config.MediaDownload {
 		return nil
 	}
 
+	if !startMediaDownload() {
+		return fmt.Errorf("not downloading media, server is shutting down")
+	}
+	defer mediaDownloads.Done()
+
+	unlock := lockMedia(msg.MediaFileHash)
+	defer unlock()
+
 	if _, has := fs.GetFileByHash(msg.MediaFileHash); !has {
-		bytes, err := msg.DownloadMedia()
+		path, size, head, err := downloadMediaToTemp(msg)
+		for attempt := 1; attempt < mediaDownloadAttempts && isRetryableMediaErr(err); attempt++ {
+			log.Printf("error while downloading media, retrying: %s\n", err)
+			path, size, head, err = downloadMediaToTemp(msg)
+		}
 		if err != nil {
+			conn.metrics.mediaFailed()
 			return err
 		}
+		conn.metrics.mediaDownloaded(size)
 
-		ext := util.GetExtensionByMimeOrBytes(msg.MimeType, bytes)
+		ext := util.GetExtensionByMimeOrBytes(msg.MimeType, head)
 		if ext == "" {
 			ext = filepath.Ext(msg.MediaFilename)
 			if ext != "" {
@@ -68,24 +338,52 @@ func downloadAndStoreMedia(msg whapp.Message) error {
 			}
 		}
 
-		if _, err := fs.AddBlob(
-			msg.MediaFileHash,
-			ext,
-			bytes,
-		); err != nil {
+		meta := files.Metadata{
+			MimeType: msg.MimeType,
+			Filename: msg.MediaFilename,
+		}
+		if _, err := fs.AddFile(msg.MediaFileHash, ext, path, meta); err != nil {
+			os.Remove(path)
 			return err
 		}
 	}
 
+	if hash, has := thumbnailHash(msg); has {
+		if _, has := fs.GetFileByHash(hash); !has {
+			bytes, err := msg.Thumbnail()
+			if err != nil {
+				return err
+			}
+
+			ext := util.GetExtensionByMimeOrBytes(msg.MediaData.Preview.Mimetype, bytes)
+			meta := files.Metadata{MimeType: msg.MediaData.Preview.Mimetype}
+			if _, err := fs.AddBlob(hash, ext, bytes, meta); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
-func (conn *Connection) handleWhappMessage(ctx context.Context, msg whapp.Message, fn MessageHandler) error {
-	// HACK
-	if msg.Type == "e2e_notification" {
-		return nil
+// thumbnailHash returns the hash of the thumbnail of the given message, if
+// thumbnails are enabled and the message is a video or document with a
+// thumbnail.
+func thumbnailHash(msg whapp.Message) (hash string, has bool) {
+	if !conf.MediaThumbnails || (msg.Type != "video" && msg.Type != "document") {
+		return "", false
 	}
 
+	bytes, err := msg.Thumbnail()
+	if err != nil || len(bytes) == 0 {
+		return "", false
+	}
+
+	sum := sha256.Sum256(bytes)
+	return base64.StdEncoding.EncodeToString(sum[:]), true
+}
+
+func (conn *Connection) handleWhappMessage(ctx context.Context, msg whapp.Message, fn MessageHandler) error {
 	item, has := conn.Chats.ByID(msg.Chat.ID, false)
 	if !has {
 		participants, err := msg.Chat.Participants(ctx, conn.WI)
@@ -96,65 +394,140 @@ func (conn *Connection) handleWhappMessage(ctx context.Context, msg whapp.Messag
 	}
 	chat := item.Chat
 
-	if chat.IsGroupChat && !chat.Joined {
-		if err := conn.joinChat(item); err != nil {
+	// channels parted because the user became their only participant are
+	// only joined again once someone else is added.
+	partedSole := conf.PartSoleMember && isSoleMember(chat)
+	if chat.IsChannel() && !chat.Joined && !chat.Left && !chat.ID.IsSystem() && !partedSole {
+		if err := conn.joinChat(item, msg.Time()); err != nil {
 			return err
 		}
 	}
 
 	if chat.HasMessageID(msg.ID.Serialized) {
 		return nil // already handled
+	} else if msg.IsUndecrypted() {
+		// the message is handled again when its content arrives, so it isn't
+		// marked as handled.  The placeholder is only sent once, however.
+		if !conn.addUndecrypted(msg.ID.Serialized) {
+			return nil
+		}
+	} else {
+		conn.removeUndecrypted(msg.ID.Serialized)
+		chat.AddMessageID(msg.ID.Serialized)
 	}
-	chat.AddMessageID(msg.ID.Serialized)
+	conn.metrics.messageReceived()
 
 	lastTimestamp, found := conn.timestampMap.Get(chat.ID)
 	if !found || msg.Timestamp > lastTimestamp {
 		conn.timestampMap.Set(chat.ID, msg.Timestamp)
-		go conn.saveDatabaseEntry()
+		conn.queueDatabaseSave()
 	}
 
-	if msg.IsSentByMeFromWeb {
+	if msg.IsSentByMeFromWeb && conf.WebMessages == config.WebMessagesDrop {
 		return nil
+	} else if msg.Type == "e2e_notification" {
+		return conn.handleUnhandledMessage(item, msg)
+	} else if msg.Type == "pin_message" {
+		return conn.handlePinMessage(ctx, item, msg)
+	} else if msg.Type == "reaction" {
+		return conn.handleReaction(ctx, item, msg)
 	} else if msg.IsNotification {
 		return conn.handleWhappNotification(item, msg)
 	}
 
-	sender := formatContact(*msg.Sender)
-	from := sender.SafeName()
-	if msg.IsSentByMe {
-		from = conn.irc.Nick()
+	// watchwords are checked in all chats, including the ones whose messages
+	// aren't delivered.
+	err := conn.checkWatchwords(item, msg)
+	util.LogIfErr("error while sending highlight", err)
+
+	if item.Snoozed(time.Now()) {
+		return nil
+	}
+
+	switch item.Notifications() {
+	case types.NotifyNone:
+		return nil
+	case types.NotifyMentions:
+		if !conn.mentionsMe(msg) {
+			return nil
+		}
+	}
+
+	from := conn.senderName(msg)
+	if !chat.IsChannel() && !msg.IsSentByMe {
+		// in private chats the sender is the chat itself, which makes
+		// replying work even if its identifier differs from the sender's
+		// name.
+		from = item.Identifier
 	}
 
 	var to string
-	if chat.IsGroupChat || msg.IsSentByMe {
+	if chat.IsChannel() || msg.IsSentByMe {
 		to = item.Identifier
 	} else {
 		to = conn.irc.Nick()
 	}
 
-	if err := downloadAndStoreMedia(msg); err != nil {
-		return err
+	quarantined := isQuarantined(chat)
+	if chat.ID.IsSystem() {
+		// messages of WhatsApp itself are never shown as coming from a
+		// contact, so they can't be spoofed.
+		if err := conn.joinVirtualChannel(whatsappChannel, msg.Time()); err != nil {
+			return err
+		}
+		from, to = systemNick, whatsappChannel.name
+		quarantined = false
+	} else if quarantined {
+		if err := conn.joinVirtualChannel(unknownChannel, msg.Time()); err != nil {
+			return err
+		}
+		to = unknownChannel.name
+	}
+
+	if msg.Interactive != nil {
+		conn.setInteractiveOptions(chat.ID, msg.ID.Serialized, msg.Interactive.Options)
+	}
+
+	// mentions of the user are resolved to their IRC nick, so that their
+	// client highlights the message.
+	nick := conn.irc.Nick()
+	body := conn.getMessageBody(msg, chat.Participants, nick)
+	if strings.TrimSpace(body) == "" {
+		// emitting a PRIVMSG without text is invalid, but we did handle the
+		// message.
+		return nil
+	}
+	if msg.Mentions(conn.me.SelfID) && !strings.Contains(body, nick) {
+		body = nick + ": " + body
+	}
+	if quarantined && msg.IsSentByMe {
+		// address the message, since the channel is shared by all unknown
+		// senders.
+		body = item.Identifier + ": " + body
 	}
 
-	if msg.QuotedMessage != nil {
-		body := getMessageBody(*msg.QuotedMessage, chat.Participants, conn.me)
-		message := Message{from, to, body, true, &msg}
+	if quoted := msg.QuotedMessage; quoted != nil {
+		participants := conn.quoteParticipants(chat, *quoted)
+		body := snippet(conn.getMessageBody(*quoted, participants, nick))
+		body = fmt.Sprintf("<%s> %s", conn.senderName(*quoted), body)
+		message := Message{from, to, body, true, &msg, false}
 		if err := fn(conn, message); err != nil {
 			return err
 		}
 	}
 
-	body := getMessageBody(msg, chat.Participants, conn.me)
-	return fn(conn, Message{from, to, body, false, &msg})
+	if err := fn(conn, Message{from, to, body, false, &msg, false}); err != nil {
+		return err
+	}
+	conn.metrics.messageDelivered()
+	return nil
 }
 
 func (conn *Connection) handleWhappNotification(chatItem types.ChatListItem, msg whapp.Message) error {
 	chat := chatItem.Chat
 
-	if msg.Type != "gp2" && msg.Type != "call_log" {
-		return fmt.Errorf("no idea what to do with notification type %s", msg.Type)
-	} else if len(msg.RecipientIDs) == 0 {
-		return nil
+	if msg.Type != "gp2" && msg.Type != "call_log" && !msg.IsEphemeralSetting() {
+		return conn.handleUnhandledMessage(chatItem, msg)
 	}
 
 	findName := func(id whapp.ID) string {
@@ -164,7 +537,7 @@ func (conn *Connection) handleWhappNotification(chatItem types.ChatListItem, msg
 			}
 		}
 
-		if info, has := conn.Chats.ByID(id, false); has && !info.Chat.IsGroupChat {
+		if info, has := conn.Chats.ByID(id, false); has && !info.Chat.IsChannel() {
 			return info.Identifier
 		}
 		return id.User
@@ -181,6 +554,23 @@ func (conn *Connection) handleWhappNotification(chatItem types.ChatListItem, msg
 		author = findName(msg.From)
 	}
 
+	if msg.IsEphemeralSetting() {
+		var line string
+		if msg.EphemeralDuration == 0 {
+			line = fmt.Sprintf("* %s turned off disappearing messages", author)
+		} else {
+			line = fmt.Sprintf(
+				"* %s set disappearing messages to %s",
+				author,
+				formatEphemeralDuration(msg.EphemeralDuration),
+			)
+		}
+		return conn.chatNotice(chatItem, msg.Time(), line)
+	} else if len(msg.RecipientIDs) == 0 {
+		return nil
+	}
+
+	membersChanged := false
 	for _, recipientID := range msg.RecipientIDs {
 		recipientSelf := recipientID == conn.me.SelfID
 		var recipient string
@@ -190,15 +580,37 @@ func (conn *Connection) handleWhappNotification(chatItem types.ChatListItem, msg
 			recipient = findName(recipientID)
 		}
 
+		// the participants have been fetched from WhatsApp already, so old
+		// membership changes of others are skipped entirely when configured.
+		switch msg.Subtype {
+		case "add", "invite", "leave", "remove":
+			if !recipientSelf && conn.quietMembership(chatItem, msg) {
+				continue
+			}
+		}
+
 		switch msg.Subtype {
 		case "create":
 			break
 
 		case "add", "invite":
+			participant := types.Participant{ID: recipientID}
+			if info, has := conn.Chats.ByID(recipientID, false); has {
+				participant.Contact = info.Chat.RawChat.Contact
+			}
+			chat.AddParticipant(participant)
+			membersChanged = true
+
 			if recipientSelf {
 				// We already handle the new chat JOIN in
-				// `Connection::handleWhappMessage` in a better way.
-				// So just skip this, since otherwise we JOIN double.
+				// `Connection::handleWhappMessage` in a better way, except
+				// when being added to a chat we left before.
+				chat.Left = false
+				if !chat.Joined {
+					if err := conn.joinChat(chatItem, msg.Time()); err != nil {
+						return err
+					}
+				}
 				break
 			}
 			str := fmt.Sprintf(":%s JOIN %s", recipient, chatItem.Identifier)
@@ -207,35 +619,249 @@ func (conn *Connection) handleWhappNotification(chatItem types.ChatListItem, msg
 			}
 
 		case "leave":
+			conn.rememberParticipant(chatItem, recipientID, recipient)
+			chat.RemoveParticipant(recipientID)
+			membersChanged = true
+
+			if recipientSelf && !chat.Joined {
+				// the channel has been parted already, such as when the
+				// user became its only participant.
+				break
+			}
 			str := fmt.Sprintf(":%s PART %s", recipient, chatItem.Identifier)
 			if err := conn.irc.Write(msg.Time(), str); err != nil {
 				return err
 			}
 
 		case "remove":
+			conn.rememberParticipant(chatItem, recipientID, recipient)
+			chat.RemoveParticipant(recipientID)
+			membersChanged = true
+
+			if recipientSelf && !chat.Joined {
+				break
+			}
 			str := fmt.Sprintf(":%s KICK %s %s", author, chatItem.Identifier, recipient)
 			if err := conn.irc.Write(msg.Time(), str); err != nil {
 				return err
 			}
 
 		case "miss":
-			if err := conn.irc.PrivateMessage(
-				msg.Time(),
-				author,
-				chatItem.Identifier,
-				"-- missed call --",
-			); err != nil {
+			if err := conn.sendCallEvent(chatItem, msg, author, "missed call"); err != nil {
 				return err
 			}
 
 		default:
-			log.Printf("no idea what to do with notification subtype %s\n", msg.Subtype)
+			return conn.handleUnhandledMessage(chatItem, msg)
 		}
 
 		if recipientSelf && (msg.Subtype == "leave" || msg.Subtype == "remove") {
 			chat.Joined = false
+			chat.Left = true
 		}
 	}
 
+	if membersChanged && isSoleMember(chat) && chat.Joined {
+		return conn.handleSoleMember(chatItem, msg.Time())
+	}
+
+	if membersChanged && conf.TopicMemberCount && chat.Joined {
+		str := fmt.Sprintf(":whapp-irc TOPIC %s :%s", chatItem.Identifier, chatTopic(chat))
+		return conn.irc.Write(msg.Time(), str)
+	}
+
 	return nil
 }
+
+// handleSoleMember handles the user becoming the only participant left in the
+// group chat of the given item, which is either marked in its topic or parted,
+// as configured.
+func (conn *Connection) handleSoleMember(item types.ChatListItem, date time.Time) error {
+	if conf.PartSoleMember {
+		item.Chat.Joined = false
+		str := fmt.Sprintf(":%s PART %s :only participant left", conn.irc.Nick(), item.Identifier)
+		return conn.irc.Write(date, str)
+	}
+
+	if err := conn.chatNotice(item, date, "you're the only participant left"); err != nil {
+		return err
+	}
+	str := fmt.Sprintf(":whapp-irc TOPIC %s :%s", item.Identifier, chatTopic(item.Chat))
+	return conn.irc.Write(date, str)
+}
+
+// snippet returns the snippet of the given message body used when the message
+// is referred to, such as by a reply, pin or reaction.
+func snippet(body string) string {
+	return util.Snippet(body, conf.SnippetLength, conf.SnippetEllipsis)
+}
+
+// messageSnippet returns a snippet of the body of the message with the given
+// serialized ID in the chat of the given item, fetched from WhatsApp.
+func (conn *Connection) messageSnippet(ctx context.Context, item types.ChatListItem, id string) (string, bool) {
+	if id == "" {
+		return "", false
+	}
+
+	msg, err := item.Chat.RawChat.GetMessage(ctx, conn.WI, id)
+	if err != nil {
+		if err != whapp.ErrMessageNotFound {
+			log.Printf("error while retrieving message %s: %s\n", id, err)
+		}
+		return "", false
+	}
+
+	body := conn.getMessageBody(msg, item.Chat.Participants, conn.irc.Nick())
+	return snippet(body), true
+}
+
+// handlePinMessage notifies the user about the given (un)pinning of a message
+// in the chat of the given item.
+func (conn *Connection) handlePinMessage(ctx context.Context, item types.ChatListItem, msg whapp.Message) error {
+	author := conn.senderName(msg)
+	if !item.Chat.IsChannel() && !msg.IsSentByMe {
+		author = item.Identifier
+	}
+
+	if msg.PinType == 2 {
+		line := fmt.Sprintf("* %s unpinned a message", author)
+		return conn.chatNotice(item, msg.Time(), line)
+	}
+
+	line := fmt.Sprintf("* %s pinned a message", author)
+	if snippet, ok := conn.messageSnippet(ctx, item, msg.PinnedMessageID); ok {
+		line = fmt.Sprintf("* %s pinned: \"%s\"", author, snippet)
+	}
+
+	return conn.chatNotice(item, msg.Time(), line)
+}
+
+// sendCallEvent sends the given call event, of a call by author in the chat of
+// the given item, to that chat or to the calls channel, as configured.
+func (conn *Connection) sendCallEvent(item types.ChatListItem, msg whapp.Message, author, event string) error {
+	if !conf.CallsChannel {
+		line := fmt.Sprintf("-- %s --", event)
+		return conn.irc.PrivateMessage(msg.Time(), author, item.Identifier, line)
+	}
+
+	if err := conn.joinVirtualChannel(callsChannel, msg.Time()); err != nil {
+		return err
+	}
+
+	line := fmt.Sprintf("-- %s in %s (%s) --", event, item.Identifier, item.Chat.Name)
+	return conn.irc.PrivateMessage(msg.Time(), author, callsChannel.name, line)
+}
+
+// formatEphemeralDuration formats the given disappearing messages timer, in
+// seconds, in the largest unit it's a whole multiple of.
+func formatEphemeralDuration(seconds int64) string {
+	units := []struct {
+		seconds          int64
+		singular, plural string
+	}{
+		{24 * 60 * 60, "day", "days"},
+		{60 * 60, "hour", "hours"},
+		{60, "minute", "minutes"},
+		{1, "second", "seconds"},
+	}
+
+	for _, unit := range units {
+		if seconds%unit.seconds == 0 {
+			n := int(seconds / unit.seconds)
+			return fmt.Sprintf("%d %s", n, util.Plural(n, unit.singular, unit.plural))
+		}
+	}
+	return "" // unreachable
+}
+
+// handleUnhandledMessage handles a message of a type or subtype we have no idea
+// what to do with.  It is logged and, if configured, reported to the user.
+func (conn *Connection) handleUnhandledMessage(chatItem types.ChatListItem, msg whapp.Message) error {
+	typ := msg.Type
+	if msg.Subtype != "" {
+		typ += "/" + msg.Subtype
+	}
+	log.Printf("no idea what to do with message type %s\n", typ)
+
+	if !conf.NotifyUnhandledMessages {
+		return nil
+	}
+
+	line := fmt.Sprintf("-- unhandled message type: %s --", typ)
+	return conn.chatNotice(chatItem, msg.Time(), line)
+}
+
+// rememberParticipant remembers the participant with the given ID and nick, who
+// is leaving the chat of the given item, for WHOWAS.
+func (conn *Connection) rememberParticipant(item types.ChatListItem, id whapp.ID, nick string) {
+	realname := nick
+	for _, p := range item.Chat.Participants {
+		if p.ID == id && p.FullName() != "" {
+			realname = p.FullName()
+		}
+	}
+	conn.rememberDeparture(nick, realname, item.Identifier)
+}
+
+// addUndecrypted registers that the placeholder of the undecrypted message
+// with the given serialized ID has been sent, returns false if it already was.
+func (conn *Connection) addUndecrypted(id string) bool {
+	conn.undecryptedMutex.Lock()
+	defer conn.undecryptedMutex.Unlock()
+
+	if conn.undecryptedIDs == nil {
+		conn.undecryptedIDs = make(map[string]bool)
+	} else if conn.undecryptedIDs[id] {
+		return false
+	}
+	conn.undecryptedIDs[id] = true
+	return true
+}
+
+// removeUndecrypted forgets the undecrypted message with the given serialized
+// ID, since its content arrived.
+func (conn *Connection) removeUndecrypted(id string) {
+	conn.undecryptedMutex.Lock()
+	defer conn.undecryptedMutex.Unlock()
+
+	delete(conn.undecryptedIDs, id)
+}
+
+// setMediaFailed sets whether or not downloading the media of the message with
+// the given serialized ID failed.
+func (conn *Connection) setMediaFailed(id string, failed bool) {
+	conn.failedMediaMutex.Lock()
+	defer conn.failedMediaMutex.Unlock()
+
+	if !failed {
+		delete(conn.failedMediaIDs, id)
+		return
+	}
+
+	if conn.failedMediaIDs == nil {
+		conn.failedMediaIDs = make(map[string]bool)
+	}
+	conn.failedMediaIDs[id] = true
+}
+
+// mediaFailed returns whether or not downloading the media of the message with
+// the given serialized ID failed.
+func (conn *Connection) mediaFailed(id string) bool {
+	conn.failedMediaMutex.Lock()
+	defer conn.failedMediaMutex.Unlock()
+
+	return conn.failedMediaIDs[id]
+}
+
+// systemNick is the nick messages of WhatsApp itself are sent from.
+const systemNick = "WhatsApp"
+
+// isQuarantined returns whether or not messages of the given chat should be
+// sent to the unknown channel instead of a query, which is the case for
+// private chats with senders that aren't in the user's contacts.
+func isQuarantined(chat *types.Chat) bool {
+	return conf.QuarantineUnknownSenders &&
+		chat.IsPrivate() &&
+		!chat.RawChat.Contact.IsMyContact &&
+		!chat.RawChat.Contact.IsMe
+}
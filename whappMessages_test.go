@@ -0,0 +1,457 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"whapp-irc/config"
+	"whapp-irc/types"
+	"whapp-irc/whapp"
+)
+
+func TestQuoteAttribution(t *testing.T) {
+	defer withConfig(config.Config{SnippetLength: 50})()
+
+	conn, client, cancel := newTestConnection(t)
+	defer cancel()
+
+	alice := testContact("31611111111", "alice")
+	bob := testContact("31622222222", "bob")
+	item := addTestGroup(conn, "1", "friends", alice, bob)
+
+	// bob replies to a message of alice, and then to one of the user.
+	quoted := testMessage(item, alice, "A", "original text")
+	reply := testMessage(item, bob, "B", "reply")
+	reply.QuotedMessage = &quoted
+	handleTestMessage(t, conn, reply)
+
+	own := testMessage(item, testContact(selfID.User, ""), "C", "my text")
+	reply = testMessage(item, bob, "D", "another reply")
+	reply.QuotedMessage = &own
+	handleTestMessage(t, conn, reply)
+
+	expected := []string{
+		":bob PRIVMSG #friends :> <alice> original text",
+		":bob PRIVMSG #friends :reply",
+		":bob PRIVMSG #friends :> <me> my text",
+		":bob PRIVMSG #friends :another reply",
+	}
+	if lines := client.lines(conn); !equalLines(lines, expected) {
+		t.Errorf("got %q, expected %q", lines, expected)
+	}
+}
+
+func TestEmptyBody(t *testing.T) {
+	conn, client, cancel := newTestConnection(t)
+	defer cancel()
+
+	alice := testContact("31611111111", "alice")
+	item := addTestGroup(conn, "1", "friends", alice)
+
+	msg := testMessage(item, alice, "A", " \n ")
+	handleTestMessage(t, conn, msg)
+
+	if lines := client.lines(conn); len(lines) > 0 {
+		t.Errorf("expected no lines for an empty body, got %q", lines)
+	}
+
+	// the message is handled nonetheless.
+	if !item.Chat.HasMessageID(msg.ID.Serialized) {
+		t.Error("message ID of the empty message isn't tracked")
+	}
+	if ts, _ := conn.timestampMap.Get(item.Chat.ID); ts != msg.Timestamp {
+		t.Errorf("chat timestamp is %d, expected %d", ts, msg.Timestamp)
+	}
+}
+
+func TestPlaceCaption(t *testing.T) {
+	defer withConfig(conf)()
+
+	url := "https://example.com/a.jpg"
+	tests := []struct {
+		placement config.CaptionPlacement
+		caption   string
+		expected  string
+	}{
+		{config.CaptionInline, "", url},
+		{config.CaptionInline, "look", url + " look"},
+		{config.CaptionBefore, "", url},
+		{config.CaptionBefore, "look", "look\n" + url},
+		{config.CaptionAfter, "", url},
+		{config.CaptionAfter, "look", url + "\nlook"},
+	}
+
+	for _, test := range tests {
+		conf.CaptionPlacement = test.placement
+		if res := placeCaption(url, test.caption); res != test.expected {
+			t.Errorf("placement %d, caption %q: got %q, expected %q", test.placement, test.caption, res, test.expected)
+		}
+	}
+}
+
+func TestMultilineCaption(t *testing.T) {
+	defer withConfig(config.Config{MediaMode: config.MediaLinksOnly})()
+
+	conn, client, cancel := newTestConnection(t)
+	defer cancel()
+
+	alice := testContact("31611111111", "alice")
+	item := addTestGroup(conn, "1", "friends", alice)
+
+	first := ":alice PRIVMSG #friends :first"
+	second := ":alice PRIVMSG #friends :second"
+	media := ":alice PRIVMSG #friends :--media (image), open on phone--"
+
+	// every line of the caption is a message of its own, inline captions
+	// continue on the line of the URL.
+	tests := []struct {
+		placement config.CaptionPlacement
+		expected  []string
+	}{
+		{config.CaptionInline, []string{media + " first", second}},
+		{config.CaptionBefore, []string{first, second, media}},
+		{config.CaptionAfter, []string{media, first, second}},
+	}
+
+	for i, test := range tests {
+		conf.CaptionPlacement = test.placement
+
+		msg := testMessage(item, alice, fmt.Sprint(i), "")
+		msg.Type = "image"
+		msg.IsMMS = true
+		msg.Caption = "first\n\nsecond"
+		handleTestMessage(t, conn, msg)
+
+		if lines := client.lines(conn); !equalLines(lines, test.expected) {
+			t.Errorf("placement %d: got %q, expected %q", test.placement, lines, test.expected)
+		}
+	}
+}
+
+func TestWebMessages(t *testing.T) {
+	line := ":me PRIVMSG #friends :from the web"
+	tests := []struct {
+		name  string
+		mode  config.WebMessagesMode
+		plain []string
+		echo  []string
+	}{
+		{"drop", config.WebMessagesDrop, nil, nil},
+		{"echo", config.WebMessagesEcho, nil, []string{line}},
+		{"deliver", config.WebMessagesDeliver, []string{line}, []string{line}},
+	}
+
+	for _, test := range tests {
+		restore := withConfig(config.Config{WebMessages: test.mode})
+		conn, plain, cancel := newTestConnection(t)
+		echo := attachTestClient(t, conn, "echo-message")
+
+		item := addTestGroup(conn, "1", "friends")
+		msg := testMessage(item, testContact(selfID.User, ""), "A", "from the web")
+		msg.IsSentByMeFromWeb = true
+		handleTestMessage(t, conn, msg)
+
+		if lines := plain.lines(conn); !equalLines(lines, test.plain) {
+			t.Errorf("%s: client without echo-message got %q, expected %q", test.name, lines, test.plain)
+		}
+		if lines := echo.lines(conn); !equalLines(lines, test.echo) {
+			t.Errorf("%s: client with echo-message got %q, expected %q", test.name, lines, test.echo)
+		}
+
+		echo.socket.Close()
+		cancel()
+		restore()
+	}
+}
+
+func TestWebMessagesEcho(t *testing.T) {
+	line := ":me PRIVMSG #friends :from irc"
+
+	// the message is sent by the client without echo-message, and WhatsApp
+	// reports it as sent from WhatsApp Web afterwards.  The client with
+	// echo-message receives it exactly once in every mode.
+	tests := []struct {
+		name  string
+		mode  config.WebMessagesMode
+		plain []string
+		echo  []string
+	}{
+		{"drop", config.WebMessagesDrop, nil, []string{line}},
+		{"echo", config.WebMessagesEcho, nil, []string{line}},
+		{"deliver", config.WebMessagesDeliver, []string{line}, []string{line}},
+	}
+
+	for _, test := range tests {
+		restore := withConfig(config.Config{WebMessages: test.mode})
+		conn, plain, cancel := newTestConnection(t)
+		echo := attachTestClient(t, conn, "echo-message")
+		sender := conn.irc.clients[0]
+
+		item := addTestGroup(conn, "1", "friends")
+		msg := testMessage(item, testContact(selfID.User, ""), "A", "from irc")
+		msg.IsSentByMeFromWeb = true
+
+		if err := conn.irc.Echo(sender, msg.Time(), item.Identifier, msg.Body); err != nil {
+			t.Fatal(err)
+		}
+		handleTestMessage(t, conn, msg)
+
+		if lines := plain.lines(conn); !equalLines(lines, test.plain) {
+			t.Errorf("%s: sending client got %q, expected %q", test.name, lines, test.plain)
+		}
+		if lines := echo.lines(conn); !equalLines(lines, test.echo) {
+			t.Errorf("%s: client with echo-message got %q, expected %q", test.name, lines, test.echo)
+		}
+
+		echo.socket.Close()
+		cancel()
+		restore()
+	}
+}
+
+func TestUndecryptedMessage(t *testing.T) {
+	conn, client, cancel := newTestConnection(t)
+	defer cancel()
+
+	alice := testContact("31611111111", "alice")
+	item := addTestGroup(conn, "1", "friends", alice)
+
+	placeholder := testMessage(item, alice, "A", "")
+	placeholder.Type = "ciphertext"
+	content := testMessage(item, alice, "A", "hello")
+
+	placeholderLine := ":alice PRIVMSG #friends :* (message could not be decrypted yet)"
+	contentLine := ":alice PRIVMSG #friends :hello"
+
+	// the placeholder is reported twice before the content arrives, which is
+	// reported twice as well.
+	steps := []struct {
+		msg      whapp.Message
+		expected []string
+	}{
+		{placeholder, []string{placeholderLine}},
+		{placeholder, nil},
+		{content, []string{contentLine}},
+		{content, nil},
+	}
+
+	for i, step := range steps {
+		handleTestMessage(t, conn, step.msg)
+		if lines := client.lines(conn); !equalLines(lines, step.expected) {
+			t.Errorf("step %d: got %q, expected %q", i, lines, step.expected)
+		}
+
+		// only the content marks the message as handled.
+		handled := step.msg.Type != "ciphertext"
+		if has := item.Chat.HasMessageID(content.ID.Serialized); has != handled {
+			t.Errorf("step %d: message marked as handled is %t, expected %t", i, has, handled)
+		}
+	}
+
+	if len(conn.undecryptedIDs) != 0 {
+		t.Errorf("undecrypted IDs left after the content arrived: %v", conn.undecryptedIDs)
+	}
+}
+
+func TestOwnGroupMessages(t *testing.T) {
+	me := testContact(selfID.User, "")
+	alice := testContact("31611111111", "alice")
+
+	for _, echoOwn := range []bool{false, true} {
+		restore := withConfig(config.Config{EchoOwnGroupMessages: echoOwn})
+		conn, plain, cancel := newTestConnection(t)
+		echo := attachTestClient(t, conn, "echo-message")
+
+		group := addTestGroup(conn, "1", "friends", alice)
+		private := addTestPrivateChat(conn, alice)
+
+		handleTestMessage(t, conn, testMessage(group, me, "A", "mine"))
+		handleTestMessage(t, conn, testMessage(group, alice, "B", "theirs"))
+		handleTestMessage(t, conn, testMessage(private, me, "C", "private"))
+
+		own := ":me PRIVMSG #friends :mine"
+		peer := ":alice PRIVMSG #friends :theirs"
+		query := ":me PRIVMSG " + private.Identifier + " :private"
+
+		// only own messages in groups are affected.
+		expected := []string{own, peer, query}
+		if echoOwn {
+			expected = []string{peer, query}
+		}
+		if lines := plain.lines(conn); !equalLines(lines, expected) {
+			t.Errorf("echo own %t: client without echo-message got %q, expected %q", echoOwn, lines, expected)
+		}
+
+		expected = []string{own, peer, query}
+		if lines := echo.lines(conn); !equalLines(lines, expected) {
+			t.Errorf("echo own %t: client with echo-message got %q, expected %q", echoOwn, lines, expected)
+		}
+
+		echo.socket.Close()
+		cancel()
+		restore()
+	}
+}
+
+func TestServerTime(t *testing.T) {
+	conn, client, cancel := newTestConnection(t, "server-time")
+	defer cancel()
+
+	alice := testContact("31611111111", "alice")
+	item := addTestGroup(conn, "1", "friends", alice)
+
+	// both messages and events are tagged with the time WhatsApp reports.
+	msg := testMessage(item, alice, "A", "hello")
+	handleTestMessage(t, conn, msg)
+
+	event := testMessage(item, alice, "B", "")
+	event.Type = "notification_template"
+	event.Subtype = "ephemeral"
+	event.IsNotification = true
+	handleTestMessage(t, conn, event)
+
+	expected := []string{
+		"@time=2017-07-14T02:40:00.000Z :alice PRIVMSG #friends :hello",
+		"@time=2017-07-14T02:40:00.000Z :whapp-irc NOTICE #friends :* alice turned off disappearing messages",
+	}
+	if lines := client.lines(conn); !equalLines(lines, expected) {
+		t.Errorf("got %q, expected %q", lines, expected)
+	}
+}
+
+// membershipEvent returns a notification of the given subtype by the given
+// author, concerning the given recipients, in the chat of the given item.
+func membershipEvent(item types.ChatListItem, author whapp.Contact, id, subtype string, recipients ...whapp.ID) whapp.Message {
+	msg := testMessage(item, author, id, "")
+	msg.Type = "gp2"
+	msg.Subtype = subtype
+	msg.IsNotification = true
+	msg.RecipientIDs = recipients
+	return msg
+}
+
+func TestSoleMember(t *testing.T) {
+	me := testContact(selfID.User, "")
+	alice := testContact("31611111111", "alice")
+
+	for _, part := range []bool{false, true} {
+		restore := withConfig(config.Config{PartSoleMember: part})
+		conn, client, cancel := newTestConnection(t)
+		item := addTestGroup(conn, "1", "friends", alice)
+
+		handleTestMessage(t, conn, membershipEvent(item, alice, "A", "leave", alice.ID))
+		if !isSoleMember(item.Chat) {
+			t.Errorf("part %t: user isn't the sole member after alice left", part)
+		}
+
+		expected := []string{
+			":alice PART #friends",
+			":whapp-irc NOTICE #friends :you're the only participant left",
+			":whapp-irc TOPIC #friends :[only you] friends",
+		}
+		if part {
+			expected = []string{
+				":alice PART #friends",
+				":me PART #friends :only participant left",
+			}
+		}
+		if lines := client.lines(conn); !equalLines(lines, expected) {
+			t.Errorf("part %t: got %q, expected %q", part, lines, expected)
+		}
+		if item.Chat.Joined == part {
+			t.Errorf("part %t: chat joined is %t after becoming the sole member", part, item.Chat.Joined)
+		}
+
+		// leaving the group afterwards leaves the channel for good, which
+		// is only sent if the channel hasn't been parted already.
+		handleTestMessage(t, conn, membershipEvent(item, me, "B", "leave", selfID))
+		expected = []string{":me PART #friends"}
+		if part {
+			expected = nil
+		}
+		if lines := client.lines(conn); !equalLines(lines, expected) {
+			t.Errorf("part %t: after leaving got %q, expected %q", part, lines, expected)
+		}
+		if item.Chat.Joined || !item.Chat.Left {
+			t.Errorf("part %t: chat joined is %t and left is %t after leaving", part, item.Chat.Joined, item.Chat.Left)
+		}
+		if isSoleMember(item.Chat) {
+			t.Errorf("part %t: user is the sole member of a group they left", part)
+		}
+
+		// the user is added again by someone else.
+		bob := testContact("31622222222", "bob")
+		handleTestMessage(t, conn, membershipEvent(item, bob, "C", "add", selfID))
+		if !item.Chat.Joined || item.Chat.Left {
+			t.Errorf("part %t: chat joined is %t and left is %t after being added", part, item.Chat.Joined, item.Chat.Left)
+		}
+
+		cancel()
+		restore()
+	}
+}
+
+func TestCrossChatQuote(t *testing.T) {
+	defer withConfig(config.Config{SnippetLength: 50})()
+
+	conn, client, cancel := newTestConnection(t)
+	defer cancel()
+
+	bob := testContact("31622222222", "bob")
+	carol := testContact("31633333333", "carol")
+	dave := testContact("31644444444", "dave")
+	erin := testContact("31655555555", "erin")
+
+	friends := addTestGroup(conn, "1", "friends", bob)
+	work := addTestGroup(conn, "2", "work", carol, dave)
+	addTestPrivateChat(conn, carol)
+	addTestPrivateChat(conn, erin)
+
+	// the quoted message of carol in another chat mentions dave, who's in that
+	// chat, and erin, who's only known from a private chat.  WhatsApp doesn't
+	// include the sender of quoted messages from other chats.
+	quoted := testMessage(work, carol, "A", "ping @31644444444 and @31655555555")
+	quoted.Sender = nil
+	quoted.MentionedIDs = []whapp.ID{dave.ID, erin.ID}
+
+	reply := testMessage(friends, bob, "B", "forwarded")
+	reply.QuotedMessage = &quoted
+	handleTestMessage(t, conn, reply)
+
+	expected := []string{
+		":bob PRIVMSG #friends :> <carol> ping @dave and @erin",
+		":bob PRIVMSG #friends :forwarded",
+	}
+	if lines := client.lines(conn); !equalLines(lines, expected) {
+		t.Errorf("got %q, expected %q", lines, expected)
+	}
+}
+
+func TestSystemSender(t *testing.T) {
+	conn, client, cancel := newTestConnection(t)
+	defer cancel()
+
+	system := testContact("0", "")
+	if !system.ID.IsSystem() {
+		t.Fatalf("%s isn't the system ID", system.ID)
+	}
+	spoof := testContact("31611111111", "WhatsApp")
+
+	official := addTestPrivateChat(conn, system)
+	other := addTestPrivateChat(conn, spoof)
+
+	// messages of WhatsApp itself are sent to its own channel, while a
+	// contact using its name can't pass for it.
+	handleTestMessage(t, conn, testMessage(official, system, "A", "your code is 123"))
+	handleTestMessage(t, conn, testMessage(other, spoof, "B", "your code is 456"))
+
+	expected := []string{
+		":me JOIN #whatsapp",
+		":whapp-irc 332 me #whatsapp :Messages from WhatsApp itself",
+		":whapp-irc 366 me #whatsapp :End of /NAMES list.",
+		":WhatsApp PRIVMSG #whatsapp :your code is 123",
+		":WhatsApp_2 PRIVMSG me :your code is 456",
+	}
+	if lines := client.lines(conn); !equalLines(lines, expected) {
+		t.Errorf("got %q, expected %q", lines, expected)
+	}
+}
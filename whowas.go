@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// the maximum amount and age of the entries kept for WHOWAS.
+const (
+	maxWhowasEntries = 100
+	maxWhowasAge     = 24 * time.Hour
+)
+
+// whowasEntry is a participant that recently left a chat.
+type whowasEntry struct {
+	nick     string
+	realname string
+	channel  string
+	left     time.Time
+}
+
+// rememberDeparture records that the participant with the given nick and
+// realname left the given channel, so that it can be found using WHOWAS.
+func (conn *Connection) rememberDeparture(nick, realname, channel string) {
+	conn.whowasMutex.Lock()
+	defer conn.whowasMutex.Unlock()
+
+	if len(conn.whowas) >= maxWhowasEntries {
+		conn.whowas = conn.whowas[1:]
+	}
+	conn.whowas = append(conn.whowas, whowasEntry{
+		nick:     nick,
+		realname: realname,
+		channel:  channel,
+		left:     time.Now(),
+	})
+}
+
+// findDepartures returns the recent entries for the given nick, the most recent
+// first.
+func (conn *Connection) findDepartures(nick string) []whowasEntry {
+	conn.whowasMutex.Lock()
+	defer conn.whowasMutex.Unlock()
+
+	var res []whowasEntry
+	for i := len(conn.whowas) - 1; i >= 0; i-- {
+		entry := conn.whowas[i]
+		if time.Since(entry.left) > maxWhowasAge {
+			break
+		} else if strings.EqualFold(entry.nick, nick) {
+			res = append(res, entry)
+		}
+	}
+	return res
+}